@@ -1,68 +1,138 @@
 package main
 
 import (
-	"fmt"
-	"github.com/kelseyhightower/envconfig"
-	log "github.com/sirupsen/logrus"
-	"net"
+	"flag"
 	"net/http"
 	"os"
-	"time"
-	"github.com/viki-org/dnscache"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 func main() {
 
 	log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
 
-	config, err := LoadAppConfig()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	config, printConfig, err := LoadAppConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		// The flag package has already printed the usage.
+		os.Exit(0)
+	}
 	if err != nil {
 		log.WithField("error", err.Error()).Error("Error loading config")
+		os.Exit(1)
+	}
+	if config.IsLocal() {
+		useLocalLogFormat()
+	}
+	if printConfig {
+		config.PrintConfig(os.Stdout)
+	}
+	if ReportConfigProblems(os.Stderr, append(config.Validate(), config.ResourceProblems()...)) {
+		log.Error("Invalid config, see problems above")
+		os.Exit(1)
+	}
+	if printConfig {
+		return
 	}
 
+	logControl, err := NewLogControl(config)
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Error setting up logging")
+		os.Exit(1)
+	}
+	if config.IsLocal() && config.ServiceBaseURL == "" {
+		upstream, err := startLocalUpstream(config)
+		if err != nil {
+			log.WithField("error", err.Error()).Error("Error starting local fake service")
+			os.Exit(1)
+		}
+		defer upstream.Close()
+		log.WithField("url", config.ServiceBaseURL).Info("Started local fake service")
+	}
+	if socketOptionsSupported {
+		client, server, err := CheckSocketOptions(clientSocketOptions(config), serverSocketOptions(config))
+		if err != nil {
+			log.WithField("error", err.Error()).Error("Socket options can't be applied")
+			os.Exit(1)
+		}
+		log.WithFields(map[string]interface{}{"client": client, "server": server}).Info("Socket options as the kernel has them")
+	}
+	balancer, err := NewBalancer(config)
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Error setting up the service's endpoints")
+		os.Exit(1)
+	}
+	discovery := NewDiscovery(config, balancer)
+	if discovery.Enabled() {
+		if err := discovery.Refresh(); err != nil {
+			log.WithField("error", err.Error()).Error("Error discovering the service's endpoints")
+			os.Exit(1)
+		}
+	}
+	discovery.Start()
+	healthChecker := NewHealthChecker(config, balancer)
+	healthChecker.Start()
+	outliers := NewOutlierDetector(config, balancer)
+	outliers.Start()
+	socketSampler := NewSocketSampler(config, balancer)
+	socketSampler.Start()
 	log.WithField("port", config.Port).Info("Listening")
 
-	resolver := dnscache.New(time.Second * 60) //how often to refresh cached dns records, happens in background
+	conns := NewConnRegistry()
+	httpClient := NewSwappableHTTPClient(NewHTTPClient(config, conns))
+	// Once a removed endpoint has drained, its idle connections would otherwise sit in the pool until they time out.
+	balancer.OnDrained = func(endpoint *Endpoint) { conns.CloseTo(endpoint.Address) }
+	reloader := NewConfigReloader(os.Args[1:], config, httpClient)
+	reloader.LogControl = logControl
+	reloader.Conns = conns
+	reloader.WatchSignals()
+	reloader.WatchFile()
 
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: config.HTTPClientMaxIdleConnsPerHost,
-			// Go does not cache DNS lookups, so we define a custom Dial function that does.
-			// This fixed a problem where requests were timing out during DNS lookup
-			// even though we were hitting the same hostname over and over.
-			Dial: func(network string, address string) (net.Conn, error) {
-				separator := strings.LastIndex(address, ":")
-				ip, err := resolver.FetchOneString(address[:separator])
-				if err != nil {
-					return nil, err
-				}
-				return net.Dial("tcp", ip + address[separator:])
-			},
-			DialContext: (&net.Dialer{
-				Timeout:   time.Duration(config.HTTPClientDialerTimeoutMS) * time.Millisecond,
-				KeepAlive: time.Duration(config.HTTPClientDialerKeepAliveMS) * time.Millisecond,
-			}).DialContext,
-			MaxIdleConns:          config.HTTPClientMaxIdleConns,
-			IdleConnTimeout:       time.Duration(config.HTTPClientIdleConnTimeoutMS) * time.Millisecond,
-			TLSHandshakeTimeout:   time.Duration(config.HTTPClientTLSHandshakeTimeoutMS) * time.Millisecond,
-			ExpectContinueTimeout: time.Duration(config.HTTPClientExpectContinueTimeoutMS) * time.Millisecond,
-		},
-		Timeout: time.Duration(config.HTTPClientTimeoutMS) * time.Millisecond,
+	service := &Service{Endpoints: balancer, HttpClient: httpClient}
+	var recorder *TrafficRecorder
+	if config.RecordFile != "" {
+		recorder, err = NewTrafficRecorder(config.RecordFile)
+		if err != nil {
+			log.WithField("error", err.Error()).Error("Error opening traffic recording")
+			os.Exit(1)
+		}
+		defer recorder.Close()
+		log.WithField("file", config.RecordFile).Info("Recording traffic")
+		service.TrafficRecorder = recorder
 	}
+	handler := &HTTPClientTestHandler{Service: *service, TrafficRecorder: recorder, LogControl: logControl}
+	server := NewServer(config, nil, httpClient)
+	server.Background = []interface{ Stop() }{socketSampler, outliers, healthChecker, discovery}
+	router := NewRouter(handler, map[string]http.Handler{
+		"healthcheck": server.HealthCheck(),
+		"live":        http.HandlerFunc(InternalLiveCheck),
+		"ready":       NewReadinessCheck(config, balancer, httpClient, server),
+		"reload":      reloader,
+		"loglevel":    logControl,
+		"connections": ConnectionsHandler{Conns: conns, HTTPClient: httpClient},
+		"sockets":     socketSampler,
+		"endpoints":   balancer,
+		"outliers":    outliers,
+		"discovery":   discovery,
+	})
+	if config.IsLocal() {
+		router = withPprof(router)
+	}
+	server.HTTPServer.Handler = router
 
-	service := &Service{config.ServiceBaseURL, httpClient}
-	handler := &HTTPClientTestHandler{*service}
-	err = http.ListenAndServe(fmt.Sprintf(":%d", config.Port), NewRouter(handler))
-
-	if err != nil {
-		log.WithField("error", err.Error()).Error("Problem starting server")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	err = server.Run(signals)
+	if err != nil && err != http.ErrServerClosed {
+		log.WithField("error", err.Error()).Error("Problem running server")
 		os.Exit(1)
 	}
 }
-
-func LoadAppConfig() (*AppConfig, error) {
-	var config AppConfig
-	err := envconfig.Process("", &config)
-	return &config, err
-}
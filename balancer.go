@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The SERVICE_BALANCER strategies.
+const (
+	BalancerRoundRobin    = "round-robin"
+	BalancerRandom        = "random"
+	BalancerLeastInFlight = "least-in-flight"
+	BalancerP2C           = "p2c"
+	BalancerPeakEWMA      = "peak-ewma"
+)
+
+// balancingStrategies makes the BalancingStrategy for each SERVICE_BALANCER value.
+var balancingStrategies = map[string]func() BalancingStrategy{
+	BalancerRoundRobin:    func() BalancingStrategy { return &roundRobin{} },
+	BalancerRandom:        func() BalancingStrategy { return randomChoice{} },
+	BalancerLeastInFlight: func() BalancingStrategy { return leastInFlight{} },
+	BalancerP2C:           func() BalancingStrategy { return powerOfTwoChoices{cost: inFlightCost} },
+	BalancerPeakEWMA:      func() BalancingStrategy { return powerOfTwoChoices{cost: peakEWMACost} },
+}
+
+// balancerNames lists the SERVICE_BALANCER values for error messages.
+func balancerNames() string {
+	var names []string
+	for name := range balancingStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// BalancingStrategy picks which endpoint the next call goes to. It's only given endpoints
+// that are in rotation, and always at least one.
+type BalancingStrategy interface {
+	Pick(endpoints []*Endpoint) *Endpoint
+}
+
+type roundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (r *roundRobin) Pick(endpoints []*Endpoint) *Endpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	return endpoints[r.next%len(endpoints)]
+}
+
+type randomChoice struct{}
+
+func (randomChoice) Pick(endpoints []*Endpoint) *Endpoint {
+	return endpoints[rand.Intn(len(endpoints))]
+}
+
+// leastInFlight picks the endpoint with the fewest calls in flight, the first of them on a tie.
+type leastInFlight struct{}
+
+func (leastInFlight) Pick(endpoints []*Endpoint) *Endpoint {
+	least := endpoints[0]
+	for _, endpoint := range endpoints[1:] {
+		if inFlightCost(endpoint) < inFlightCost(least) {
+			least = endpoint
+		}
+	}
+	return least
+}
+
+// powerOfTwoChoices picks two endpoints at random and takes the cheaper one, which gets most of the
+// benefit of always picking the cheapest without every caller piling onto the same endpoint.
+type powerOfTwoChoices struct {
+	cost func(endpoint *Endpoint) float64
+}
+
+func (p powerOfTwoChoices) Pick(endpoints []*Endpoint) *Endpoint {
+	if len(endpoints) == 1 {
+		return endpoints[0]
+	}
+	i := rand.Intn(len(endpoints))
+	j := rand.Intn(len(endpoints) - 1)
+	if j >= i {
+		j++
+	}
+	if p.cost(endpoints[j]) < p.cost(endpoints[i]) {
+		return endpoints[j]
+	}
+	return endpoints[i]
+}
+
+func inFlightCost(endpoint *Endpoint) float64 {
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+	return float64(endpoint.inFlight)
+}
+
+// peakEWMAPenalty is the cost of an endpoint with a call in flight but no latency measured yet,
+// so an endpoint nothing is known about gets one call and then waits for its answer.
+const peakEWMAPenalty = 1e6
+
+// peakEWMACost is the endpoint's peak-EWMA latency, scaled up by the calls already waiting on it.
+func peakEWMACost(endpoint *Endpoint) float64 {
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+	if endpoint.ewmaAt.IsZero() {
+		if endpoint.inFlight == 0 {
+			return 0
+		}
+		return peakEWMAPenalty + float64(endpoint.inFlight)
+	}
+	return endpoint.ewmaMS * float64(endpoint.inFlight+1)
+}
+
+// Endpoint is one instance of the service that calls can be sent to.
+type Endpoint struct {
+	// Address is the instance's host:port, or for a service on a Unix socket the socket's path.
+	Address string
+	// URL is SERVICE_BASE_URL pointed at Address, what calls to the endpoint are sent to.
+	URL string
+	// Host, when set, is sent as the Host header instead of Address: SERVICE_BASE_URL's host,
+	// since the endpoints are all instances of that service.
+	Host string
+
+	mu       sync.Mutex
+	inFlight int
+	requests int64
+	errors   int64
+	// ewmaMS is the peak-EWMA latency: a new latency higher than it replaces it straight away,
+	// and lower ones pull it down gradually, by how long it's been since the last one.
+	ewmaMS float64
+	ewmaAt time.Time
+	// healthy goes false after enough failed health checks in a row, and healthStreak counts
+	// the checks in a row that disagree with it.
+	healthy        bool
+	healthStreak   int
+	lastCheck      time.Time
+	lastCheckError string
+	// The OutlierDetector's view of the endpoint: its calls in the current interval, its failed calls
+	// in a row, and when its ejection, the ejections'th in a row, ends.
+	window            outlierWindow
+	consecutiveErrors int
+	ejectedUntil      time.Time
+	ejections         int
+	ejectionReason    string
+	// draining is set once the endpoint has been removed, while its calls in flight finish.
+	draining bool
+}
+
+// ejected is whether the endpoint is ejected as an outlier at now. The caller holds e.mu.
+func (e *Endpoint) ejected(now time.Time) bool {
+	return now.Before(e.ejectedUntil)
+}
+
+// dialAddress is where connections to the endpoint go: the socket for a service on a Unix socket,
+// otherwise the endpoint's address, or the proxy's if calls to the endpoint go through it.
+func (e *Endpoint) dialAddress(proxy *Proxy) (network string, address string) {
+	if strings.HasPrefix(e.Address, "/") {
+		return "unix", e.Address
+	}
+	if proxy.UsedFor(e.Address) {
+		return "tcp", proxy.Address()
+	}
+	return "tcp", e.Address
+}
+
+// EndpointStats is how an endpoint has been doing, for /internal/endpoints and experiments.
+type EndpointStats struct {
+	Address        string     `json:"address"`
+	URL            string     `json:"url"`
+	InFlight       int        `json:"inFlight"`
+	Requests       int64      `json:"requests"`
+	Errors         int64      `json:"errors"`
+	LatencyEWMAMS  float64    `json:"latencyEWMAMS"`
+	Healthy        bool       `json:"healthy"`
+	LastCheck      *time.Time `json:"lastCheck,omitempty"`
+	LastCheckError string     `json:"lastCheckError,omitempty"`
+	Ejected        bool       `json:"ejected"`
+	EjectedUntil   *time.Time `json:"ejectedUntil,omitempty"`
+	EjectionReason string     `json:"ejectionReason,omitempty"`
+	// Ejections is how many times in a row the endpoint has been ejected, which its next ejection is longer for.
+	Ejections int `json:"ejections"`
+	// Draining is true for an endpoint that has been removed but still has calls in flight.
+	Draining bool `json:"draining,omitempty"`
+}
+
+func (e *Endpoint) Stats() EndpointStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stats := EndpointStats{
+		Address:        e.Address,
+		URL:            e.URL,
+		InFlight:       e.inFlight,
+		Requests:       e.requests,
+		Errors:         e.errors,
+		LatencyEWMAMS:  e.ewmaMS,
+		Healthy:        e.healthy,
+		LastCheckError: e.lastCheckError,
+		Ejected:        e.ejected(time.Now()),
+		Ejections:      e.ejections,
+		Draining:       e.draining,
+	}
+	if !e.lastCheck.IsZero() {
+		lastCheck := e.lastCheck
+		stats.LastCheck = &lastCheck
+	}
+	if stats.Ejected {
+		ejectedUntil := e.ejectedUntil
+		stats.EjectedUntil, stats.EjectionReason = &ejectedUntil, e.ejectionReason
+	}
+	return stats
+}
+
+// Balancer spreads calls over the service's endpoints with the SERVICE_BALANCER strategy, leaving out
+// endpoints that have failed their health checks or are ejected as outliers, unless they all are.
+type Balancer struct {
+	Strategy string
+	// Decay is how quickly the peak-EWMA latency forgets a slow call.
+	Decay time.Duration
+	// BaseURL is SERVICE_BASE_URL, which endpoints given as host:ports are swapped into.
+	BaseURL string
+	// DrainTimeout is the longest SetEndpoints waits for a removed endpoint's calls in flight to finish.
+	// OnDrained, if set, is called once they have, or it's given up waiting.
+	DrainTimeout time.Duration
+	OnDrained    func(endpoint *Endpoint)
+
+	strategy      BalancingStrategy
+	mu            sync.RWMutex
+	endpoints     []*Endpoint
+	draining      []*Endpoint
+	healthChecked bool
+	// outliers, once an OutlierDetector is started, is told how every call went.
+	outliers *OutlierDetector
+}
+
+// NewBalancer makes a Balancer over SERVICE_ENDPOINTS, or over SERVICE_BASE_URL alone if there are none.
+// With service discovery it starts with no endpoints, for a Discovery to set.
+func NewBalancer(config *AppConfig) (*Balancer, error) {
+	newStrategy, ok := balancingStrategies[config.ServiceBalancer]
+	if !ok {
+		return nil, fmt.Errorf("%q is not one of %s", config.ServiceBalancer, balancerNames())
+	}
+	balancer := &Balancer{
+		Strategy:     config.ServiceBalancer,
+		Decay:        time.Duration(config.ServiceBalancerEWMADecayMS) * time.Millisecond,
+		BaseURL:      config.ServiceBaseURL,
+		DrainTimeout: time.Duration(config.ServiceDiscoveryDrainMS) * time.Millisecond,
+		strategy:     newStrategy(),
+	}
+	if config.ServiceDiscoveryFile != "" || config.ServiceDiscoverySRV != "" {
+		// Discovery fills the endpoints in before any calls are made.
+		return balancer, nil
+	}
+	if len(config.ServiceEndpoints) == 0 {
+		address := unixSocketPath(config.ServiceBaseURL)
+		if address == "" {
+			serviceURL, err := url.Parse(config.ServiceBaseURL)
+			if err != nil {
+				return nil, err
+			}
+			address = canonicalAddress(serviceURL)
+		}
+		balancer.endpoints = []*Endpoint{{Address: address, URL: serviceRequestURL(config), healthy: true}}
+		return balancer, nil
+	}
+	for _, address := range config.ServiceEndpoints {
+		endpoint, err := newEndpoint(config.ServiceBaseURL, address)
+		if err != nil {
+			return nil, err
+		}
+		balancer.endpoints = append(balancer.endpoints, endpoint)
+	}
+	return balancer, nil
+}
+
+// newEndpoint points serviceBaseURL at address, a host:port or a host to use the scheme's default port with.
+func newEndpoint(serviceBaseURL, address string) (*Endpoint, error) {
+	serviceURL, err := url.Parse(serviceBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if serviceURL.Scheme == unixScheme {
+		return nil, fmt.Errorf("endpoint %s: a service on a Unix socket can't have other endpoints", address)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = canonicalAddress(&url.URL{Scheme: serviceURL.Scheme, Host: address})
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("endpoint %q is not a host:port", address)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return nil, fmt.Errorf("endpoint %q has an invalid port", address)
+	}
+	endpointURL := *serviceURL
+	endpointURL.Host = address
+	return &Endpoint{Address: address, URL: endpointURL.String(), Host: serviceURL.Host, healthy: true}, nil
+}
+
+// Endpoints are every endpoint, in rotation or not, leaving out removed ones that are still draining.
+func (b *Balancer) Endpoints() []*Endpoint {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]*Endpoint(nil), b.endpoints...)
+}
+
+// drainPollInterval is how often a removed endpoint is checked for calls still in flight.
+const drainPollInterval = 100 * time.Millisecond
+
+// SetEndpoints changes the endpoints calls are spread over to addresses, given like SERVICE_ENDPOINTS.
+// Endpoints that stay keep their stats and health. Removed ones get no new calls, and are drained in
+// the background: kept in /internal/endpoints until their calls in flight finish or DrainTimeout passes.
+// If any address is invalid, nothing changes.
+func (b *Balancer) SetEndpoints(addresses []string) (added []string, removed []string, err error) {
+	if len(addresses) == 0 {
+		return nil, nil, errors.New("there has to be at least one endpoint")
+	}
+	var fresh []*Endpoint
+	seen := make(map[string]bool)
+	for _, address := range addresses {
+		endpoint, err := newEndpoint(b.BaseURL, address)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !seen[endpoint.Address] {
+			seen[endpoint.Address] = true
+			fresh = append(fresh, endpoint)
+		}
+	}
+
+	b.mu.Lock()
+	current := make(map[string]*Endpoint)
+	for _, endpoint := range append(b.draining, b.endpoints...) {
+		current[endpoint.Address] = endpoint
+	}
+	var draining []*Endpoint
+	for _, endpoint := range b.draining {
+		if !seen[endpoint.Address] {
+			draining = append(draining, endpoint)
+		}
+	}
+	var drain []*Endpoint
+	for _, endpoint := range b.endpoints {
+		if !seen[endpoint.Address] {
+			drain = append(drain, endpoint)
+			removed = append(removed, endpoint.Address)
+		}
+	}
+	for i, endpoint := range fresh {
+		if existing, ok := current[endpoint.Address]; ok {
+			existing.mu.Lock()
+			if existing.draining {
+				added = append(added, existing.Address)
+			}
+			existing.draining = false
+			existing.mu.Unlock()
+			fresh[i] = existing
+		} else {
+			added = append(added, endpoint.Address)
+		}
+	}
+	b.endpoints = fresh
+	b.draining = append(draining, drain...)
+	b.mu.Unlock()
+
+	for _, endpoint := range drain {
+		endpoint.mu.Lock()
+		endpoint.draining = true
+		endpoint.mu.Unlock()
+		go b.drain(endpoint)
+	}
+	return added, removed, nil
+}
+
+// drain waits for a removed endpoint's calls in flight to finish, then forgets it,
+// unless it's added back in the meantime.
+func (b *Balancer) drain(endpoint *Endpoint) {
+	deadline := time.Now().Add(b.DrainTimeout)
+	for {
+		endpoint.mu.Lock()
+		draining, inFlight := endpoint.draining, endpoint.inFlight
+		endpoint.mu.Unlock()
+		if !draining {
+			return
+		}
+		if inFlight == 0 || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(drainPollInterval)
+	}
+
+	b.mu.Lock()
+	stillDraining := false
+	for i, other := range b.draining {
+		if other == endpoint {
+			b.draining = append(b.draining[:i:i], b.draining[i+1:]...)
+			stillDraining = true
+			break
+		}
+	}
+	b.mu.Unlock()
+	if !stillDraining {
+		return
+	}
+	fields := map[string]interface{}{"endpoint": endpoint.Address}
+	if inFlight := endpoint.Stats().InFlight; inFlight > 0 {
+		fields["inFlight"] = inFlight
+		log.WithFields(fields).Warn("Endpoint removed, gave up waiting for its calls in flight")
+	} else {
+		log.WithFields(fields).Info("Endpoint removed and drained")
+	}
+	if b.OnDrained != nil {
+		b.OnDrained(endpoint)
+	}
+}
+
+// Pick chooses the endpoint for a call. The call has to be reported with the func it returns once
+// it's done, with the error it failed with, if any, for the endpoint's stats.
+func (b *Balancer) Pick() (*Endpoint, func(err error)) {
+	endpoints := b.Endpoints()
+	now := time.Now()
+	var candidates []*Endpoint
+	for _, endpoint := range endpoints {
+		endpoint.mu.Lock()
+		if endpoint.healthy && !endpoint.ejected(now) {
+			candidates = append(candidates, endpoint)
+		}
+		endpoint.mu.Unlock()
+	}
+	if len(candidates) == 0 {
+		// Better to try an endpoint that's failing its health checks, or ejected, than to fail the call outright.
+		candidates = endpoints
+	}
+	endpoint := b.strategy.Pick(candidates)
+	start := time.Now()
+	endpoint.mu.Lock()
+	endpoint.inFlight++
+	endpoint.mu.Unlock()
+	var once sync.Once
+	return endpoint, func(err error) {
+		once.Do(func() { b.done(endpoint, time.Since(start), err) })
+	}
+}
+
+func (b *Balancer) done(endpoint *Endpoint, latency time.Duration, err error) {
+	endpoint.mu.Lock()
+	endpoint.inFlight--
+	endpoint.requests++
+	if err != nil {
+		endpoint.errors++
+	}
+	now := time.Now()
+	latencyMS := durationMS(latency)
+	if endpoint.ewmaAt.IsZero() || latencyMS > endpoint.ewmaMS || b.Decay <= 0 {
+		endpoint.ewmaMS = latencyMS
+	} else {
+		weight := math.Exp(-float64(now.Sub(endpoint.ewmaAt)) / float64(b.Decay))
+		endpoint.ewmaMS = endpoint.ewmaMS*weight + latencyMS*(1-weight)
+	}
+	endpoint.ewmaAt = now
+	endpoint.mu.Unlock()
+
+	b.mu.RLock()
+	outliers := b.outliers
+	b.mu.RUnlock()
+	if outliers != nil {
+		outliers.record(endpoint, latencyMS, err)
+	}
+}
+
+// Healthy counts the endpoints in rotation, out of all of them.
+func (b *Balancer) Healthy() (healthy int, total int) {
+	for _, endpoint := range b.Endpoints() {
+		if endpoint.Stats().Healthy {
+			healthy++
+		}
+		total++
+	}
+	return healthy, total
+}
+
+// Stats are every endpoint's stats, the ones still draining after the rest.
+func (b *Balancer) Stats() []EndpointStats {
+	b.mu.RLock()
+	endpoints := append(append([]*Endpoint(nil), b.endpoints...), b.draining...)
+	b.mu.RUnlock()
+	var stats []EndpointStats
+	for _, endpoint := range endpoints {
+		stats = append(stats, endpoint.Stats())
+	}
+	return stats
+}
+
+// ServeHTTP answers /internal/endpoints with the strategy and every endpoint's stats.
+func (b *Balancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"strategy":      b.Strategy,
+		"healthChecked": b.HealthChecked(),
+		"endpoints":     b.Stats(),
+	})
+}
+
+// HealthChecked is true once a HealthChecker is checking the endpoints.
+func (b *Balancer) HealthChecked() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.healthChecked
+}
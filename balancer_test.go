@@ -0,0 +1,164 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testBalancer makes a Balancer with strategy over addresses.
+func testBalancer(t *testing.T, strategy string, addresses ...string) *Balancer {
+	balancer, err := NewBalancer(testConfig(t, map[string]string{"SERVICE_BALANCER": strategy}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := balancer.SetEndpoints(addresses); err != nil {
+		t.Fatal(err)
+	}
+	return balancer
+}
+
+// pickCounts makes n calls that finish straight away, and counts the calls each endpoint got.
+func pickCounts(balancer *Balancer, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		endpoint, done := balancer.Pick()
+		done(nil)
+		counts[endpoint.Address]++
+	}
+	return counts
+}
+
+func TestRoundRobin(t *testing.T) {
+	balancer := testBalancer(t, BalancerRoundRobin, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	var got []string
+	for i := 0; i < 9; i++ {
+		endpoint, done := balancer.Pick()
+		done(nil)
+		got = append(got, endpoint.Address)
+	}
+	if got[0] == got[1] || got[1] == got[2] || got[0] == got[2] {
+		t.Errorf("the first three calls went to %v, want one to each endpoint", got[:3])
+	}
+	for i := 3; i < len(got); i++ {
+		if got[i] != got[i-3] {
+			t.Errorf("calls went to %v, want the same order every round", got)
+			break
+		}
+	}
+}
+
+func TestRandom(t *testing.T) {
+	balancer := testBalancer(t, BalancerRandom, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	counts := pickCounts(balancer, 3000)
+	for _, endpoint := range balancer.Endpoints() {
+		if got := counts[endpoint.Address]; got < 800 || got > 1200 {
+			t.Errorf("%s got %d of 3000 calls, want about 1000", endpoint.Address, got)
+		}
+	}
+}
+
+func TestLeastInFlight(t *testing.T) {
+	balancer := testBalancer(t, BalancerLeastInFlight, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	var dones []func(error)
+	var got []string
+	for i := 0; i < 3; i++ {
+		endpoint, done := balancer.Pick()
+		dones = append(dones, done)
+		got = append(got, endpoint.Address)
+	}
+	if got[0] != "10.0.0.1:80" || got[1] != "10.0.0.2:80" || got[2] != "10.0.0.3:80" {
+		t.Errorf("calls held open went to %v, want one to each endpoint in turn", got)
+	}
+	dones[1](nil)
+	if endpoint, _ := balancer.Pick(); endpoint.Address != "10.0.0.2:80" {
+		t.Errorf("the next call went to %s, want 10.0.0.2:80, the only one with nothing in flight", endpoint.Address)
+	}
+}
+
+func TestP2CAvoidsTheBusiestEndpoint(t *testing.T) {
+	balancer := testBalancer(t, BalancerP2C, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	busy := balancer.Endpoints()[0]
+	busy.mu.Lock()
+	busy.inFlight = 5
+	busy.mu.Unlock()
+	counts := pickCounts(balancer, 300)
+	if counts[busy.Address] != 0 {
+		t.Errorf("the endpoint with 5 calls in flight got %d calls, want none", counts[busy.Address])
+	}
+	if len(counts) != 2 {
+		t.Errorf("calls went to %v, want them spread over the other two", counts)
+	}
+}
+
+func TestPeakEWMA(t *testing.T) {
+	balancer := testBalancer(t, BalancerPeakEWMA, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	endpoints := balancer.Endpoints()
+	call := func(endpoint *Endpoint, latency time.Duration) {
+		endpoint.mu.Lock()
+		endpoint.inFlight++
+		endpoint.mu.Unlock()
+		balancer.done(endpoint, latency, nil)
+	}
+	slow := endpoints[0]
+	call(slow, time.Millisecond)
+	call(slow, 100*time.Millisecond)
+	for _, endpoint := range endpoints[1:] {
+		call(endpoint, time.Millisecond)
+	}
+	if got := slow.Stats().LatencyEWMAMS; got != 100 {
+		t.Errorf("a slower call moved the EWMA to %vms, want straight to 100ms", got)
+	}
+	counts := pickCounts(balancer, 300)
+	if counts[slow.Address] != 0 {
+		t.Errorf("the endpoint with a 100ms EWMA got %d calls, want none", counts[slow.Address])
+	}
+	call(slow, time.Millisecond)
+	if got := slow.Stats().LatencyEWMAMS; got < 99 {
+		t.Errorf("one fast call pulled the EWMA down to %vms, want it to decay over SERVICE_BALANCER_EWMA_DECAY_MS", got)
+	}
+}
+
+func TestPeakEWMACostOfAnUnmeasuredEndpoint(t *testing.T) {
+	endpoint := &Endpoint{Address: "10.0.0.1:80", healthy: true}
+	if got := peakEWMACost(endpoint); got != 0 {
+		t.Errorf("an endpoint nothing is known about costs %v, want 0", got)
+	}
+	endpoint.inFlight = 1
+	if got := peakEWMACost(endpoint); got < peakEWMAPenalty {
+		t.Errorf("an unmeasured endpoint with a call in flight costs %v, want at least %v", got, peakEWMAPenalty)
+	}
+}
+
+func TestPickLeavesOutUnhealthyAndEjectedEndpoints(t *testing.T) {
+	balancer := testBalancer(t, BalancerRoundRobin, "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	endpoints := balancer.Endpoints()
+	endpoints[0].mu.Lock()
+	endpoints[0].healthy = false
+	endpoints[0].mu.Unlock()
+	endpoints[1].mu.Lock()
+	endpoints[1].ejectedUntil = time.Now().Add(time.Minute)
+	endpoints[1].mu.Unlock()
+	if counts := pickCounts(balancer, 10); counts["10.0.0.3:80"] != 10 {
+		t.Errorf("calls went to %v, want them all to 10.0.0.3:80", counts)
+	}
+
+	endpoints[2].mu.Lock()
+	endpoints[2].healthy = false
+	endpoints[2].mu.Unlock()
+	if counts := pickCounts(balancer, 9); len(counts) != 3 {
+		t.Errorf("with none in rotation calls went to %v, want them spread over all of them", counts)
+	}
+}
+
+func TestSetEndpointsErrors(t *testing.T) {
+	balancer := testBalancer(t, BalancerRoundRobin, "10.0.0.1:80")
+	if _, _, err := balancer.SetEndpoints(nil); err == nil {
+		t.Error("no endpoints gave no error")
+	}
+	if _, _, err := balancer.SetEndpoints([]string{"10.0.0.2:80", "10.0.0.3:nope"}); err == nil {
+		t.Error("an invalid endpoint gave no error")
+	}
+	if endpoints := balancer.Endpoints(); len(endpoints) != 1 || endpoints[0].Address != "10.0.0.1:80" {
+		t.Errorf("endpoints are %v after the errors, want 10.0.0.1:80 alone", endpoints)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// certValidity is how long generated certificates last. They're only for local experiments.
+const certValidity = 365 * 24 * time.Hour
+
+// runGenerateCertsCommand writes a throwaway CA and a server and client certificate signed by it,
+// for trying out the HTTP_CLIENT_TLS_* settings against a local https service.
+func runGenerateCertsCommand(args []string) int {
+	flags := flag.NewFlagSet("generate-certs", flag.ContinueOnError)
+	dir := flags.String("dir", "certs", "directory to write the certificates and keys to")
+	hosts := flags.String("hosts", "localhost,127.0.0.1", "comma-separated names and IPs the server certificate is for")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := GenerateCerts(*dir, strings.Split(*hosts, ",")); err != nil {
+		fmt.Fprintln(os.Stderr, "generate-certs:", err)
+		return 1
+	}
+	fmt.Printf("wrote ca.pem, server.pem, server-key.pem, client.pem and client-key.pem to %s\n", *dir)
+	return 0
+}
+
+// GenerateCerts writes ca.pem, server.pem and server-key.pem for hosts, and client.pem and client-key.pem, to dir.
+func GenerateCerts(dir string, hosts []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	caTemplate := certTemplate("http-client-test CA")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	caCert, caKey, err := writeCert(dir, "ca", caTemplate, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	serverTemplate := certTemplate(hosts[0])
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, host)
+		}
+	}
+	if _, _, err := writeCert(dir, "server", serverTemplate, caCert, caKey); err != nil {
+		return err
+	}
+
+	clientTemplate := certTemplate("http-client-test")
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	_, _, err = writeCert(dir, "client", clientTemplate, caCert, caKey)
+	return err
+}
+
+func certTemplate(commonName string) *x509.Certificate {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+// writeCert creates a key and a certificate from template signed by parent, or self-signed if parent is nil,
+// and writes them to name.pem and name-key.pem, except for the CA's key which is only kept in memory.
+func writeCert(dir, name string, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0644); err != nil {
+		return nil, nil, err
+	}
+	if !template.IsCA {
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+		if err := ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+			return nil, nil, err
+		}
+	}
+	return cert, key, nil
+}
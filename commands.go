@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// commands are the things the binary can do besides serving /api, selected by the first argument.
+// Each one gets the remaining arguments and returns the process exit code.
+var commands = map[string]func(args []string) int{
+	"experiment":      runExperimentCommand,
+	"generate-certs":  runGenerateCertsCommand,
+	"generate-fakes":  runGenerateFakesCommand,
+	"proxy":           runProxyCommand,
+	"replay":          runReplayCommand,
+	"report":          runReportCommand,
+	"verify-contract": runVerifyContractCommand,
+}
+
+func runCommand(name string, args []string) int {
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q. Run with no arguments to start the server, or use one of:\n", name)
+		names := make([]string, 0, len(commands))
+		for commandName := range commands {
+			names = append(names, commandName)
+		}
+		sort.Strings(names)
+		for _, commandName := range names {
+			fmt.Fprintf(os.Stderr, "  %s\n", commandName)
+		}
+		return 2
+	}
+	return command(args)
+}
@@ -1,19 +1,93 @@
 package main
 
 type AppConfig struct {
-	Port                              int    `default:"8000"`
-	ServiceBaseURL                    string `envconfig:"SERVICE_BASE_URL" required:"true"`
-	Env                               string `envconfig:"ENV_NAME" required:"true"`
-	HTTPClientMaxIdleConnsPerHost     int    `envconfig:"HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST" required:"true"`
-	HTTPClientMaxIdleConns            int    `envconfig:"HTTP_CLIENT_MAX_IDLE_CONNS" required:"true"`
-	HTTPClientDialerTimeoutMS         int    `envconfig:"HTTP_CLIENT_DIALER_TIMEOUT_MS" required:"true"`
-	HTTPClientDialerKeepAliveMS       int    `envconfig:"HTTP_CLIENT_DIALER_KEEPALIVE_MS" required:"true"`
-	HTTPClientIdleConnTimeoutMS       int    `envconfig:"HTTP_CLIENT_IDLE_CONN_TIMEOUT_MS" required:"true"`
-	HTTPClientTLSHandshakeTimeoutMS   int    `envconfig:"HTTP_CLIENT_TLS_HANDSHAKE_TIMEOUT_MS" required:"true"`
-	HTTPClientExpectContinueTimeoutMS int    `envconfig:"HTTP_CLIENT_EXPECT_CONTINUE_TIMEOUT_MS" required:"true"`
-	HTTPClientTimeoutMS               int    `envconfig:"HTTP_CLIENT_TIMEOUT_MS" required:"true"`
+	Port                                int      `default:"8000"`
+	ServiceBaseURL                      string   `envconfig:"SERVICE_BASE_URL" validate:"required"`
+	ServicePath                         string   `envconfig:"SERVICE_PATH"`
+	ServiceEndpoints                    []string `envconfig:"SERVICE_ENDPOINTS"`
+	ServiceDiscoveryFile                string   `envconfig:"SERVICE_DISCOVERY_FILE"`
+	ServiceDiscoverySRV                 string   `envconfig:"SERVICE_DISCOVERY_SRV"`
+	ServiceDiscoveryIntervalMS          int      `envconfig:"SERVICE_DISCOVERY_INTERVAL_MS" default:"2000"`
+	ServiceDiscoveryDrainMS             int      `envconfig:"SERVICE_DISCOVERY_DRAIN_MS" default:"30000"`
+	ServiceBalancer                     string   `envconfig:"SERVICE_BALANCER" default:"round-robin"`
+	ServiceBalancerEWMADecayMS          int      `envconfig:"SERVICE_BALANCER_EWMA_DECAY_MS" default:"10000"`
+	ServiceHealthCheckIntervalMS        int      `envconfig:"SERVICE_HEALTH_CHECK_INTERVAL_MS" default:"0"`
+	ServiceHealthCheckTimeoutMS         int      `envconfig:"SERVICE_HEALTH_CHECK_TIMEOUT_MS" default:"1000"`
+	ServiceHealthCheckPath              string   `envconfig:"SERVICE_HEALTH_CHECK_PATH"`
+	ServiceUnhealthyThreshold           int      `envconfig:"SERVICE_HEALTH_CHECK_UNHEALTHY_THRESHOLD" default:"2"`
+	ServiceHealthyThreshold             int      `envconfig:"SERVICE_HEALTH_CHECK_HEALTHY_THRESHOLD" default:"2"`
+	ServiceOutlierDetection             bool     `envconfig:"SERVICE_OUTLIER_DETECTION" default:"false"`
+	ServiceOutlierConsecutiveErrors     int      `envconfig:"SERVICE_OUTLIER_CONSECUTIVE_ERRORS" default:"5"`
+	ServiceOutlierSuccessRateStdev      float64  `envconfig:"SERVICE_OUTLIER_SUCCESS_RATE_STDEV" default:"1.9"`
+	ServiceOutlierLatencyFactor         float64  `envconfig:"SERVICE_OUTLIER_LATENCY_FACTOR" default:"3"`
+	ServiceOutlierMinRequests           int      `envconfig:"SERVICE_OUTLIER_MIN_REQUESTS" default:"100"`
+	ServiceOutlierIntervalMS            int      `envconfig:"SERVICE_OUTLIER_INTERVAL_MS" default:"10000"`
+	ServiceOutlierBaseEjectionMS        int      `envconfig:"SERVICE_OUTLIER_BASE_EJECTION_MS" default:"30000"`
+	ServiceOutlierMaxEjectionMS         int      `envconfig:"SERVICE_OUTLIER_MAX_EJECTION_MS" default:"300000"`
+	ServiceOutlierMaxEjectionPercent    int      `envconfig:"SERVICE_OUTLIER_MAX_EJECTION_PERCENT" default:"10"`
+	Env                                 string   `envconfig:"ENV_NAME" validate:"required"`
+	HTTPClientMaxIdleConnsPerHost       int      `envconfig:"HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST" validate:"required"`
+	HTTPClientMaxIdleConns              int      `envconfig:"HTTP_CLIENT_MAX_IDLE_CONNS" validate:"required"`
+	HTTPClientDialerTimeoutMS           int      `envconfig:"HTTP_CLIENT_DIALER_TIMEOUT_MS" validate:"required"`
+	HTTPClientDialerKeepAliveMS         int      `envconfig:"HTTP_CLIENT_DIALER_KEEPALIVE_MS" validate:"required"`
+	HTTPClientIdleConnTimeoutMS         int      `envconfig:"HTTP_CLIENT_IDLE_CONN_TIMEOUT_MS" validate:"required"`
+	HTTPClientTLSHandshakeTimeoutMS     int      `envconfig:"HTTP_CLIENT_TLS_HANDSHAKE_TIMEOUT_MS" validate:"required"`
+	HTTPClientExpectContinueTimeoutMS   int      `envconfig:"HTTP_CLIENT_EXPECT_CONTINUE_TIMEOUT_MS" validate:"required"`
+	HTTPClientTimeoutMS                 int      `envconfig:"HTTP_CLIENT_TIMEOUT_MS" validate:"required"`
+	HTTPClientTCPNoDelay                bool     `envconfig:"HTTP_CLIENT_TCP_NODELAY" default:"true"`
+	HTTPClientSendBufferBytes           int      `envconfig:"HTTP_CLIENT_SEND_BUFFER_BYTES" default:"0"`
+	HTTPClientReceiveBufferBytes        int      `envconfig:"HTTP_CLIENT_RECEIVE_BUFFER_BYTES" default:"0"`
+	HTTPClientTCPKeepAliveIntervalS     int      `envconfig:"HTTP_CLIENT_TCP_KEEPALIVE_INTERVAL_SECONDS" default:"0"`
+	HTTPClientTCPKeepAliveCount         int      `envconfig:"HTTP_CLIENT_TCP_KEEPALIVE_COUNT" default:"0"`
+	HTTPClientTCPUserTimeoutMS          int      `envconfig:"HTTP_CLIENT_TCP_USER_TIMEOUT_MS" default:"0"`
+	HTTPClientLingerSeconds             int      `envconfig:"HTTP_CLIENT_LINGER_SECONDS" default:"-1"`
+	HTTPClientTLSCAFile                 string   `envconfig:"HTTP_CLIENT_TLS_CA_FILE"`
+	HTTPClientTLSCertFile               string   `envconfig:"HTTP_CLIENT_TLS_CERT_FILE"`
+	HTTPClientTLSKeyFile                string   `envconfig:"HTTP_CLIENT_TLS_KEY_FILE"`
+	HTTPClientTLSServerName             string   `envconfig:"HTTP_CLIENT_TLS_SERVER_NAME"`
+	HTTPClientTLSMinVersion             string   `envconfig:"HTTP_CLIENT_TLS_MIN_VERSION"`
+	HTTPClientTLSCipherSuites           []string `envconfig:"HTTP_CLIENT_TLS_CIPHER_SUITES"`
+	HTTPClientTLSSessionCacheSize       int      `envconfig:"HTTP_CLIENT_TLS_SESSION_CACHE_SIZE" default:"0"`
+	HTTPClientProtocol                  string   `envconfig:"HTTP_CLIENT_PROTOCOL" default:"http1"`
+	HTTPClientHTTP2MaxConcurrentStreams int      `envconfig:"HTTP_CLIENT_HTTP2_MAX_CONCURRENT_STREAMS" default:"0"`
+	HTTPClientHTTP2ReadIdleTimeoutMS    int      `envconfig:"HTTP_CLIENT_HTTP2_READ_IDLE_TIMEOUT_MS" default:"0"`
+	HTTPClientHTTP2PingTimeoutMS        int      `envconfig:"HTTP_CLIENT_HTTP2_PING_TIMEOUT_MS" default:"0"`
+	HTTPClientHTTP2Connections          int      `envconfig:"HTTP_CLIENT_HTTP2_CONNECTIONS" default:"1"`
+	HTTPClientLocalAddrs                []string `envconfig:"HTTP_CLIENT_LOCAL_ADDRS"`
+	HTTPClientProxyURL                  string   `envconfig:"HTTP_CLIENT_PROXY_URL" secret:"true"`
+	HTTPClientNoProxy                   []string `envconfig:"HTTP_CLIENT_NO_PROXY"`
+	LocalFakeTLS                        bool     `envconfig:"LOCAL_FAKE_TLS" default:"false"`
+	RecordFile                          string   `envconfig:"RECORD_FILE"`
+	ExpectedConcurrency                 int      `envconfig:"EXPECTED_CONCURRENCY" default:"0"`
+	SocketStatsIntervalMS               int      `envconfig:"SOCKET_STATS_INTERVAL_MS" default:"5000"`
+	LogLevel                            string   `envconfig:"LOG_LEVEL" default:"info"`
+	LogSampleRate                       float64  `envconfig:"LOG_SAMPLE_RATE" default:"0"`
+	ServerReadHeaderTimeoutMS           int      `envconfig:"SERVER_READ_HEADER_TIMEOUT_MS" default:"5000"`
+	ServerReadTimeoutMS                 int      `envconfig:"SERVER_READ_TIMEOUT_MS" default:"10000"`
+	ServerWriteTimeoutMS                int      `envconfig:"SERVER_WRITE_TIMEOUT_MS" default:"30000"`
+	ServerIdleTimeoutMS                 int      `envconfig:"SERVER_IDLE_TIMEOUT_MS" default:"120000"`
+	ServerMaxHeaderBytes                int      `envconfig:"SERVER_MAX_HEADER_BYTES" default:"1048576"`
+	ServerKeepAlives                    bool     `envconfig:"SERVER_KEEPALIVES" default:"true"`
+	ServerTCPNoDelay                    bool     `envconfig:"SERVER_TCP_NODELAY" default:"true"`
+	ServerSendBufferBytes               int      `envconfig:"SERVER_SEND_BUFFER_BYTES" default:"0"`
+	ServerReceiveBufferBytes            int      `envconfig:"SERVER_RECEIVE_BUFFER_BYTES" default:"0"`
+	ServerTCPKeepAliveIntervalS         int      `envconfig:"SERVER_TCP_KEEPALIVE_INTERVAL_SECONDS" default:"0"`
+	ServerTCPKeepAliveCount             int      `envconfig:"SERVER_TCP_KEEPALIVE_COUNT" default:"0"`
+	ServerTCPUserTimeoutMS              int      `envconfig:"SERVER_TCP_USER_TIMEOUT_MS" default:"0"`
+	ServerLingerSeconds                 int      `envconfig:"SERVER_LINGER_SECONDS" default:"-1"`
+	ShutdownDrainMS                     int      `envconfig:"SHUTDOWN_DRAIN_MS" default:"5000"`
+	ShutdownTimeoutMS                   int      `envconfig:"SHUTDOWN_TIMEOUT_MS" default:"15000"`
+	ReadyProbeIntervalMS                int      `envconfig:"READY_PROBE_INTERVAL_MS" default:"5000"`
+	ReadyProbeTimeoutMS                 int      `envconfig:"READY_PROBE_TIMEOUT_MS" default:"1000"`
+	ReadyMaxInFlight                    int      `envconfig:"READY_MAX_IN_FLIGHT" default:"0"`
+
+	// sources says where each setting's value came from, see LoadAppConfig.
+	sources    map[string]string
+	configFile string
+	profile    string
 }
 
+// IsLocal is true for ENV_NAME=local, which turns on local development mode, see devmode.go.
 func (c *AppConfig) IsLocal() bool {
 	return c.Env == "local"
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// Settings are layered, each layer overriding the ones before it:
+//
+//	defaults (the default tag) < profile < config file < environment < command-line flags
+//
+// Every setting is known by its environment variable name. In a config file the same name can be
+// written in any case, with - or _; as a flag it's lower case with dashes, so HTTP_CLIENT_TIMEOUT_MS
+// is http_client_timeout_ms in a file and --http-client-timeout-ms on the command line.
+
+const (
+	sourceDefault = "default"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// configSetting is one AppConfig field that can be set from outside.
+type configSetting struct {
+	Name  string
+	Field reflect.StructField
+	Index int
+}
+
+func appConfigSettings() []configSetting {
+	var settings []configSetting
+	configType := reflect.TypeOf(AppConfig{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		settings = append(settings, configSetting{Name: configSettingName(field), Field: field, Index: i})
+	}
+	return settings
+}
+
+// displayValue is value as it's safe to print or log. Settings tagged secret:"true" are URLs
+// that can carry a password, which is masked.
+func (s configSetting) displayValue(value interface{}) interface{} {
+	raw, ok := value.(string)
+	if !ok || s.Field.Tag.Get("secret") != "true" {
+		return value
+	}
+	if parsed, err := url.Parse(raw); err == nil {
+		return parsed.Redacted()
+	}
+	if raw != "" {
+		return "xxxxx"
+	}
+	return raw
+}
+
+func normalizeSettingName(name string) string {
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func settingFlagName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "-", -1))
+}
+
+// ConfigLoader builds the config from all the layers. LookupEnv is the environment and Output is
+// where the usage and flag errors go; tests give it an environment of their own and a buffer, so the
+// shell they run in can't change what they load.
+type ConfigLoader struct {
+	LookupEnv func(name string) (string, bool)
+	Output    io.Writer
+}
+
+// LoadAppConfig builds the config from all the layers, using args as the command-line flags and the
+// process's environment. printConfig is true when --print-config was given.
+func LoadAppConfig(args []string) (config *AppConfig, printConfig bool, err error) {
+	return ConfigLoader{LookupEnv: os.LookupEnv, Output: os.Stderr}.Load(args)
+}
+
+// Load builds the config from all the layers, using args as the command-line flags.
+func (l ConfigLoader) Load(args []string) (config *AppConfig, printConfig bool, err error) {
+	settings := appConfigSettings()
+	flags := flag.NewFlagSet("http-client-test", flag.ContinueOnError)
+	flags.SetOutput(l.Output)
+	envConfigFile, _ := l.LookupEnv("CONFIG_FILE")
+	envProfile, _ := l.LookupEnv("CONFIG_PROFILE")
+	configFile := flags.String("config", envConfigFile, "JSON or YAML config file (env CONFIG_FILE)")
+	profileName := flags.String("profile", envProfile, "named profile to start from (env CONFIG_PROFILE)")
+	flags.BoolVar(&printConfig, "print-config", false, "print every setting with its value and where it came from, then exit")
+	flagValues := make(map[string]*string, len(settings))
+	for _, setting := range settings {
+		flagValues[setting.Name] = flags.String(settingFlagName(setting.Name), "", "overrides "+setting.Name)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	config = &AppConfig{sources: make(map[string]string), configFile: *configFile}
+	for _, setting := range settings {
+		if value, ok := setting.Field.Tag.Lookup("default"); ok {
+			if err := config.set(setting, value, sourceDefault); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	fileSettings := map[string]interface{}{}
+	fileProfiles := map[string]map[string]interface{}{}
+	if *configFile != "" {
+		var file struct {
+			Profile  string                            `json:"profile"`
+			Profiles map[string]map[string]interface{} `json:"profiles"`
+		}
+		if err := decodeFile(*configFile, &file); err != nil {
+			return nil, false, err
+		}
+		if err := decodeFile(*configFile, &fileSettings); err != nil {
+			return nil, false, err
+		}
+		delete(fileSettings, "profile")
+		delete(fileSettings, "profiles")
+		fileProfiles = file.Profiles
+		if *profileName == "" {
+			*profileName = file.Profile
+		}
+	}
+
+	if *profileName != "" {
+		profile, ok := fileProfiles[*profileName]
+		if !ok {
+			profile, ok = configProfiles[*profileName]
+		}
+		if !ok {
+			return nil, false, fmt.Errorf("unknown config profile %q, known profiles are %s", *profileName, strings.Join(configProfileNames(fileProfiles), ", "))
+		}
+		config.profile = *profileName
+		if err := config.setAll(settings, profile, "profile "+*profileName); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := config.setAll(settings, fileSettings, "file "+*configFile); err != nil {
+		return nil, false, err
+	}
+	if err := config.setFromEnv(settings, l.LookupEnv); err != nil {
+		return nil, false, err
+	}
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		for _, setting := range settings {
+			if f.Name == settingFlagName(setting.Name) && flagErr == nil {
+				flagErr = config.set(setting, *flagValues[setting.Name], sourceFlag)
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, false, flagErr
+	}
+	if config.IsLocal() && config.profile == "" {
+		for _, setting := range settings {
+			value, ok := configProfiles[localDefaultsProfile][setting.Name]
+			if ok && config.sources[setting.Name] == "" {
+				if err := config.set(setting, configValueString(value), "profile "+localDefaultsProfile+" (local)"); err != nil {
+					return nil, false, err
+				}
+			}
+		}
+	}
+	return config, printConfig, nil
+}
+
+// setAll sets settings from a profile or config file, refusing names it doesn't know so typos don't go unnoticed.
+// Settings are set in the order AppConfig declares them, so the same file always fails the same way.
+func (c *AppConfig) setAll(settings []configSetting, values map[string]interface{}, source string) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	byName := make(map[string]string, len(values))
+	for _, name := range names {
+		normalized := normalizeSettingName(name)
+		if other, ok := byName[normalized]; ok {
+			return fmt.Errorf("%s: %q and %q are the same setting", source, other, name)
+		}
+		byName[normalized] = name
+	}
+	known := make(map[string]bool, len(settings))
+	for _, setting := range settings {
+		known[setting.Name] = true
+	}
+	for _, name := range names {
+		if !known[normalizeSettingName(name)] {
+			return fmt.Errorf("%s: unknown setting %q", source, name)
+		}
+	}
+	for _, setting := range settings {
+		if name, ok := byName[setting.Name]; ok {
+			if err := c.set(setting, configValueString(values[name]), source); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setFromEnv is the environment layer. envconfig.Process reads the environment, into a config of its own
+// since it sets every setting the environment leaves out to its default, and the settings lookupEnv finds
+// are copied over from it. envconfig always reads the process's own environment, so with a lookupEnv that
+// finds nothing, as tests use, it isn't read at all.
+func (c *AppConfig) setFromEnv(settings []configSetting, lookupEnv func(string) (string, bool)) error {
+	var fromEnv []configSetting
+	for _, setting := range settings {
+		if _, ok := lookupEnv(setting.Name); ok {
+			fromEnv = append(fromEnv, setting)
+		}
+	}
+	if len(fromEnv) == 0 {
+		return nil
+	}
+	var env AppConfig
+	if err := envconfig.Process("", &env); err != nil {
+		return err
+	}
+	config, envValues := reflect.ValueOf(c).Elem(), reflect.ValueOf(&env).Elem()
+	for _, setting := range fromEnv {
+		config.Field(setting.Index).Set(envValues.Field(setting.Index))
+		c.sources[setting.Name] = sourceEnv
+	}
+	return nil
+}
+
+// configValueString turns a value decoded from JSON or YAML back into the string form the environment would give.
+func configValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		if v == float64(int64(v)) {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = configValueString(item)
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (c *AppConfig) set(setting configSetting, value string, source string) error {
+	field := reflect.ValueOf(c).Elem().Field(setting.Index)
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s from %s: %q is not a whole number", setting.Name, source, value)
+		}
+		field.SetInt(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s from %s: %q is not true or false", setting.Name, source, value)
+		}
+		field.SetBool(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return fmt.Errorf("%s from %s: %q is not a number", setting.Name, source, value)
+		}
+		field.SetFloat(parsed)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("%s: settings of type %s aren't supported", setting.Name, field.Type())
+	}
+	c.sources[setting.Name] = source
+	return nil
+}
+
+// Source says where the effective value of a setting came from, or "" if it was never set.
+func (c *AppConfig) Source(setting string) string {
+	return c.sources[setting]
+}
+
+// PrintConfig writes every setting with its effective value and where it came from.
+func (c *AppConfig) PrintConfig(w io.Writer) {
+	profile := c.profile
+	if profile == "" {
+		profile = "none"
+	}
+	configFile := c.configFile
+	if configFile == "" {
+		configFile = "none"
+	}
+	fmt.Fprintf(w, "Profile: %s\nConfig file: %s\n\n", profile, configFile)
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SETTING\tVALUE\tSOURCE")
+	config := reflect.ValueOf(c).Elem()
+	for _, setting := range appConfigSettings() {
+		source := c.sources[setting.Name]
+		if source == "" {
+			source = "unset"
+		}
+		value := setting.displayValue(config.Field(setting.Index).Interface())
+		if items, ok := value.([]string); ok {
+			value = strings.Join(items, ",")
+		}
+		fmt.Fprintf(table, "%s\t%v\t%s\n", setting.Name, value, source)
+	}
+	table.Flush()
+}
+
+func configProfileNames(fileProfiles map[string]map[string]interface{}) []string {
+	var names []string
+	for name := range configProfiles {
+		names = append(names, name)
+	}
+	for name := range fileProfiles {
+		if _, builtIn := configProfiles[name]; !builtIn {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetAllInDeclarationOrder(t *testing.T) {
+	values := map[string]interface{}{
+		"http_client_timeout_ms":              "soon",
+		"http-client-max-idle-conns-per-host": "lots",
+		"HTTP_CLIENT_DIALER_TIMEOUT_MS":       "never",
+	}
+	// Map order changes from run to run, so try enough times that a random order would show.
+	for i := 0; i < 20; i++ {
+		config := &AppConfig{sources: make(map[string]string)}
+		err := config.setAll(appConfigSettings(), values, "file test.yml")
+		if err == nil || !strings.HasPrefix(err.Error(), "HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST from file test.yml") {
+			t.Fatalf("got %v, want the error for HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST, the first declared", err)
+		}
+	}
+}
+
+func TestSetAllRefusesUnknownAndDuplicateSettings(t *testing.T) {
+	tests := map[string]map[string]interface{}{
+		`unknown setting "http_client_timout_ms"`: {"http_client_timout_ms": 1, "port": 8000},
+		`"PORT" and "port" are the same setting`:  {"port": 8000, "PORT": 9000},
+	}
+	for want, values := range tests {
+		config := &AppConfig{sources: make(map[string]string)}
+		if err := config.setAll(appConfigSettings(), values, "file test.yml"); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	}
+}
+
+func TestLoadAppConfigHelp(t *testing.T) {
+	var usage bytes.Buffer
+	if _, _, err := testLoader(&usage).Load([]string{"-h"}); err != flag.ErrHelp {
+		t.Errorf("got %v, want flag.ErrHelp so main can exit 0", err)
+	}
+	for _, want := range []string{"-print-config", "-profile", "-http-client-timeout-ms", "overrides HTTP_CLIENT_TIMEOUT_MS"} {
+		if !strings.Contains(usage.String(), want) {
+			t.Errorf("usage doesn't mention %s:\n%s", want, usage.String())
+		}
+	}
+}
+
+func TestLoadLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	file := `{"http_client_timeout_ms": 100, "HTTP_CLIENT_MAX_IDLE_CONNS": 5, "env_name": "file"}`
+	if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HTTP_CLIENT_TIMEOUT_MS", "700")
+	t.Setenv("HTTP_CLIENT_MAX_IDLE_CONNS", "6")
+	loader := testLoader(ioutil.Discard)
+	// Only what this test sets is taken from the environment.
+	loader.LookupEnv = func(name string) (string, bool) {
+		if name == "HTTP_CLIENT_TIMEOUT_MS" || name == "HTTP_CLIENT_MAX_IDLE_CONNS" {
+			return os.LookupEnv(name)
+		}
+		return "", false
+	}
+	config, _, err := loader.Load([]string{"--config", path, "--http-client-max-idle-conns", "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		setting    string
+		got, want  interface{}
+		wantSource string
+	}{
+		{"PORT", config.Port, 8000, sourceDefault},
+		{"ENV_NAME", config.Env, "file", "file " + path},
+		{"HTTP_CLIENT_TIMEOUT_MS", config.HTTPClientTimeoutMS, 700, sourceEnv},
+		{"HTTP_CLIENT_MAX_IDLE_CONNS", config.HTTPClientMaxIdleConns, 7, sourceFlag},
+	}
+	for _, test := range tests {
+		if test.got != test.want || config.Source(test.setting) != test.wantSource {
+			t.Errorf("%s = %v from %q, want %v from %q", test.setting, test.got, config.Source(test.setting), test.want, test.wantSource)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+// configProfiles are named starting points for experiments, selected with --profile or CONFIG_PROFILE.
+// A config file can add its own under "profiles", and those win over these if the names clash.
+var configProfiles = map[string]map[string]interface{}{
+	// What you get from http.DefaultClient, spelled out.
+	"go-defaults": {
+		"HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST":    2,
+		"HTTP_CLIENT_MAX_IDLE_CONNS":             100,
+		"HTTP_CLIENT_DIALER_TIMEOUT_MS":          30000,
+		"HTTP_CLIENT_DIALER_KEEPALIVE_MS":        30000,
+		"HTTP_CLIENT_IDLE_CONN_TIMEOUT_MS":       90000,
+		"HTTP_CLIENT_TLS_HANDSHAKE_TIMEOUT_MS":   10000,
+		"HTTP_CLIENT_EXPECT_CONTINUE_TIMEOUT_MS": 1000,
+		"HTTP_CLIENT_TIMEOUT_MS":                 0,
+	},
+	// Keep lots of connections to the one upstream around for a long time.
+	"aggressive-pooling": {
+		"HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST":    1000,
+		"HTTP_CLIENT_MAX_IDLE_CONNS":             1000,
+		"HTTP_CLIENT_DIALER_TIMEOUT_MS":          500,
+		"HTTP_CLIENT_DIALER_KEEPALIVE_MS":        15000,
+		"HTTP_CLIENT_IDLE_CONN_TIMEOUT_MS":       300000,
+		"HTTP_CLIENT_TLS_HANDSHAKE_TIMEOUT_MS":   1000,
+		"HTTP_CLIENT_EXPECT_CONTINUE_TIMEOUT_MS": 1000,
+		"HTTP_CLIENT_TIMEOUT_MS":                 1500,
+	},
+	// Give up quickly on anything slow, so problems show up as errors rather than latency.
+	"fail-fast": {
+		"HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST":    100,
+		"HTTP_CLIENT_MAX_IDLE_CONNS":             100,
+		"HTTP_CLIENT_DIALER_TIMEOUT_MS":          100,
+		"HTTP_CLIENT_DIALER_KEEPALIVE_MS":        30000,
+		"HTTP_CLIENT_IDLE_CONN_TIMEOUT_MS":       90000,
+		"HTTP_CLIENT_TLS_HANDSHAKE_TIMEOUT_MS":   200,
+		"HTTP_CLIENT_EXPECT_CONTINUE_TIMEOUT_MS": 100,
+		"HTTP_CLIENT_TIMEOUT_MS":                 300,
+	},
+}
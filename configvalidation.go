@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSaneTimeoutMS is the point past which a timeout looks like a typo (seconds given as milliseconds, say).
+const maxSaneTimeoutMS = int(10 * time.Minute / time.Millisecond)
+
+// ConfigProblem is something wrong with the configuration, or, for warnings, something that works but is risky.
+type ConfigProblem struct {
+	Setting string
+	Message string
+	Warning bool
+}
+
+func (p ConfigProblem) String() string {
+	severity := "error"
+	if p.Warning {
+		severity = "warning"
+	}
+	return fmt.Sprintf("%-8s %s: %s", severity, p.Setting, p.Message)
+}
+
+// Validate checks the whole config and returns every problem it finds rather than stopping at the first,
+// so a broken deployment can be fixed in one go.
+func (c *AppConfig) Validate() []ConfigProblem {
+	var problems []ConfigProblem
+	missing := make(map[string]bool)
+	addError := func(setting, format string, args ...interface{}) {
+		problems = append(problems, ConfigProblem{Setting: setting, Message: fmt.Sprintf(format, args...)})
+	}
+	// Warnings about a setting that's missing altogether would only be noise next to the error.
+	addWarning := func(setting, format string, args ...interface{}) {
+		if !missing[setting] {
+			problems = append(problems, ConfigProblem{Setting: setting, Message: fmt.Sprintf(format, args...), Warning: true})
+		}
+	}
+
+	configType := reflect.TypeOf(*c)
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if field.Tag.Get("validate") != "required" {
+			continue
+		}
+		if c.Source(configSettingName(field)) == "" {
+			if configSettingName(field) == "SERVICE_BASE_URL" && c.IsLocal() {
+				// Local mode starts a fake service instead.
+				continue
+			}
+			missing[configSettingName(field)] = true
+			addError(configSettingName(field), "is required")
+		}
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		addError("PORT", "%d is not a valid port", c.Port)
+	}
+
+	discovery := c.ServiceDiscoveryFile != "" || c.ServiceDiscoverySRV != ""
+	if c.ServiceBaseURL != "" {
+		serviceURL, err := url.Parse(c.ServiceBaseURL)
+		switch {
+		case err != nil:
+			addError("SERVICE_BASE_URL", "can't be parsed: %s", err)
+		case serviceURL.Scheme == unixScheme:
+			if serviceURL.Host != "" || serviceURL.Path == "" {
+				addError("SERVICE_BASE_URL", "a Unix socket needs an absolute path, as in unix:///var/run/service.sock")
+			} else if _, err := os.Stat(serviceURL.Path); err != nil {
+				addWarning("SERVICE_BASE_URL", "%s", err)
+			}
+			if len(c.HTTPClientLocalAddrs) > 0 {
+				addWarning("HTTP_CLIENT_LOCAL_ADDRS", "do nothing for a service on a Unix socket")
+			}
+			if clientSocketOptions(c) != defaultSocketOptions {
+				addWarning("HTTP_CLIENT_*", "socket options do nothing for a service on a Unix socket")
+			}
+		case serviceURL.Scheme != "http" && serviceURL.Scheme != "https":
+			addError("SERVICE_BASE_URL", "scheme must be http, https or unix, got %q", serviceURL.Scheme)
+		case serviceURL.Host == "":
+			addError("SERVICE_BASE_URL", "has no host")
+		}
+		if c.ServicePath != "" && (err != nil || serviceURL.Scheme != unixScheme) {
+			addWarning("SERVICE_PATH", "only applies to unix:// services; put the path in SERVICE_BASE_URL")
+		}
+		for _, address := range c.ServiceEndpoints {
+			if _, err := newEndpoint(c.ServiceBaseURL, address); err != nil {
+				addError("SERVICE_ENDPOINTS", "%s", err)
+			}
+		}
+		if discovery && err == nil && serviceURL.Scheme == unixScheme {
+			addError("SERVICE_BASE_URL", "a service on a Unix socket can't have its endpoints discovered")
+		}
+	}
+	if discovery {
+		if len(c.ServiceEndpoints) > 0 {
+			addError("SERVICE_ENDPOINTS", "can't be combined with SERVICE_DISCOVERY_FILE or SERVICE_DISCOVERY_SRV")
+		}
+		if c.ServiceDiscoveryIntervalMS <= 0 {
+			addError("SERVICE_DISCOVERY_INTERVAL_MS", "must be more than 0")
+		}
+	}
+	if _, ok := balancingStrategies[c.ServiceBalancer]; !ok {
+		addError("SERVICE_BALANCER", "%q is not one of %s", c.ServiceBalancer, balancerNames())
+	}
+	if c.ServiceHealthCheckIntervalMS > 0 {
+		if c.ServiceHealthCheckTimeoutMS == 0 {
+			addError("SERVICE_HEALTH_CHECK_TIMEOUT_MS", "0 would fail every health check")
+		}
+		if c.ServiceUnhealthyThreshold < 1 {
+			addError("SERVICE_HEALTH_CHECK_UNHEALTHY_THRESHOLD", "must be at least 1")
+		}
+		if c.ServiceHealthyThreshold < 1 {
+			addError("SERVICE_HEALTH_CHECK_HEALTHY_THRESHOLD", "must be at least 1")
+		}
+	} else if c.ServiceHealthCheckPath != "" {
+		addWarning("SERVICE_HEALTH_CHECK_PATH", "does nothing without SERVICE_HEALTH_CHECK_INTERVAL_MS")
+	}
+	if c.ServiceOutlierDetection {
+		if c.ServiceOutlierIntervalMS == 0 {
+			addError("SERVICE_OUTLIER_INTERVAL_MS", "must be more than 0 with SERVICE_OUTLIER_DETECTION")
+		}
+		if c.ServiceOutlierMinRequests == 0 {
+			addError("SERVICE_OUTLIER_MIN_REQUESTS", "must be at least 1 with SERVICE_OUTLIER_DETECTION")
+		}
+		if c.ServiceOutlierBaseEjectionMS == 0 {
+			addError("SERVICE_OUTLIER_BASE_EJECTION_MS", "0 would never take an outlier out of rotation")
+		}
+		if c.ServiceOutlierMaxEjectionMS > 0 && c.ServiceOutlierMaxEjectionMS < c.ServiceOutlierBaseEjectionMS {
+			addError("SERVICE_OUTLIER_MAX_EJECTION_MS", "is shorter than SERVICE_OUTLIER_BASE_EJECTION_MS")
+		}
+		if c.ServiceOutlierMaxEjectionPercent < 0 || c.ServiceOutlierMaxEjectionPercent > 100 {
+			addError("SERVICE_OUTLIER_MAX_EJECTION_PERCENT", "%d is not a percentage", c.ServiceOutlierMaxEjectionPercent)
+		}
+		if c.ServiceOutlierSuccessRateStdev < 0 {
+			addError("SERVICE_OUTLIER_SUCCESS_RATE_STDEV", "can't be negative")
+		}
+		if c.ServiceOutlierLatencyFactor != 0 && c.ServiceOutlierLatencyFactor <= 1 {
+			addError("SERVICE_OUTLIER_LATENCY_FACTOR", "%g would eject endpoints no slower than the others", c.ServiceOutlierLatencyFactor)
+		}
+		if c.ServiceOutlierConsecutiveErrors == 0 && c.ServiceOutlierSuccessRateStdev == 0 && c.ServiceOutlierLatencyFactor == 0 {
+			addWarning("SERVICE_OUTLIER_DETECTION", "every check is turned off, so nothing will be ejected")
+		}
+		if len(c.ServiceEndpoints) < 2 && !discovery {
+			addWarning("SERVICE_OUTLIER_DETECTION", "does nothing without at least two SERVICE_ENDPOINTS to fall back on")
+		}
+	}
+
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		addError("LOG_LEVEL", "%q is not one of debug, info, warn, error, fatal or panic", c.LogLevel)
+	}
+	if c.LogSampleRate < 0 || c.LogSampleRate > 1 {
+		addError("LOG_SAMPLE_RATE", "%g is not a fraction between 0 and 1", c.LogSampleRate)
+	}
+
+	if c.HTTPClientMaxIdleConnsPerHost < 0 {
+		addError("HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST", "can't be negative")
+	} else if c.HTTPClientMaxIdleConnsPerHost == 0 {
+		addWarning("HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST", "0 means Go's default of %d, which causes connection churn under load", http.DefaultMaxIdleConnsPerHost)
+	}
+	if c.HTTPClientMaxIdleConns < 0 {
+		addError("HTTP_CLIENT_MAX_IDLE_CONNS", "can't be negative")
+	} else if c.HTTPClientMaxIdleConns == 0 {
+		addWarning("HTTP_CLIENT_MAX_IDLE_CONNS", "0 means no limit on idle connections")
+	}
+	if c.HTTPClientMaxIdleConns > 0 && c.HTTPClientMaxIdleConnsPerHost > c.HTTPClientMaxIdleConns {
+		addError("HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST", "%d is more than HTTP_CLIENT_MAX_IDLE_CONNS (%d), so it can never be reached",
+			c.HTTPClientMaxIdleConnsPerHost, c.HTTPClientMaxIdleConns)
+	}
+
+	timeouts := []struct {
+		setting string
+		value   int
+		zero    string
+	}{
+		{"HTTP_CLIENT_DIALER_TIMEOUT_MS", c.HTTPClientDialerTimeoutMS, "0 means dialling only stops at the OS limit, which can be minutes"},
+		{"HTTP_CLIENT_IDLE_CONN_TIMEOUT_MS", c.HTTPClientIdleConnTimeoutMS, "0 means idle connections are kept forever, even after the upstream has dropped them"},
+		{"HTTP_CLIENT_TLS_HANDSHAKE_TIMEOUT_MS", c.HTTPClientTLSHandshakeTimeoutMS, "0 means no limit on TLS handshakes"},
+		{"HTTP_CLIENT_EXPECT_CONTINUE_TIMEOUT_MS", c.HTTPClientExpectContinueTimeoutMS, ""},
+		{"HTTP_CLIENT_TIMEOUT_MS", c.HTTPClientTimeoutMS, "0 means no timeout: a call to the service can hang forever"},
+	}
+	for _, timeout := range timeouts {
+		switch {
+		case timeout.value < 0:
+			addError(timeout.setting, "can't be negative")
+		case timeout.value == 0 && timeout.zero != "":
+			addWarning(timeout.setting, "%s", timeout.zero)
+		case timeout.value > maxSaneTimeoutMS:
+			addWarning(timeout.setting, "%dms is over %s, is that meant to be milliseconds?", timeout.value, time.Duration(maxSaneTimeoutMS)*time.Millisecond)
+		}
+	}
+	if c.HTTPClientDialerKeepAliveMS < 0 {
+		addWarning("HTTP_CLIENT_DIALER_KEEPALIVE_MS", "negative turns TCP keep-alive probes off")
+	}
+	if c.HTTPClientTimeoutMS > 0 {
+		if c.HTTPClientDialerTimeoutMS > c.HTTPClientTimeoutMS {
+			addWarning("HTTP_CLIENT_DIALER_TIMEOUT_MS", "%dms is longer than HTTP_CLIENT_TIMEOUT_MS (%dms), so the overall timeout always wins",
+				c.HTTPClientDialerTimeoutMS, c.HTTPClientTimeoutMS)
+		}
+		if c.HTTPClientTLSHandshakeTimeoutMS > c.HTTPClientTimeoutMS {
+			addWarning("HTTP_CLIENT_TLS_HANDSHAKE_TIMEOUT_MS", "%dms is longer than HTTP_CLIENT_TIMEOUT_MS (%dms), so the overall timeout always wins",
+				c.HTTPClientTLSHandshakeTimeoutMS, c.HTTPClientTimeoutMS)
+		}
+	}
+
+	if tlsConfig, err := NewClientTLSConfig(c); err != nil {
+		addError("HTTP_CLIENT_TLS_*", "%s", err)
+	} else if tlsConfig != nil && (strings.HasPrefix(c.ServiceBaseURL, "http:") || unixSocketPath(c.ServiceBaseURL) != "") {
+		addWarning("HTTP_CLIENT_TLS_*", "SERVICE_BASE_URL isn't https, so the TLS settings do nothing")
+	}
+	if len(c.HTTPClientTLSCipherSuites) > 0 {
+		addWarning("HTTP_CLIENT_TLS_CIPHER_SUITES", "only apply to TLS 1.2 and earlier; Go picks the suites itself for TLS 1.3, which is used whenever the service supports it")
+	}
+
+	if c.LocalFakeTLS && (!c.IsLocal() || c.ServiceBaseURL != "") {
+		addWarning("LOCAL_FAKE_TLS", "only applies to the fake service started in local mode when SERVICE_BASE_URL isn't set")
+	}
+
+	switch c.HTTPClientProtocol {
+	case ProtocolHTTP1:
+		if c.HTTPClientHTTP2Connections > 1 || c.HTTPClientHTTP2MaxConcurrentStreams > 0 || c.HTTPClientHTTP2ReadIdleTimeoutMS > 0 {
+			addWarning("HTTP_CLIENT_HTTP2_*", "HTTP_CLIENT_PROTOCOL is %s, so the HTTP/2 settings do nothing", ProtocolHTTP1)
+		}
+	case ProtocolHTTP2:
+		if strings.HasPrefix(c.ServiceBaseURL, "http:") || unixSocketPath(c.ServiceBaseURL) != "" {
+			addWarning("HTTP_CLIENT_PROTOCOL", "%s is only negotiated over TLS, so calls to an http service stay on HTTP/1.1; use %s for HTTP/2 without TLS",
+				ProtocolHTTP2, ProtocolH2C)
+		}
+	case ProtocolH2C:
+	default:
+		addError("HTTP_CLIENT_PROTOCOL", "%q is not one of %s, %s or %s", c.HTTPClientProtocol, ProtocolHTTP1, ProtocolHTTP2, ProtocolH2C)
+	}
+	if c.HTTPClientHTTP2Connections < 1 {
+		addError("HTTP_CLIENT_HTTP2_CONNECTIONS", "must be at least 1")
+	}
+
+	// Settings where 0 means off or Go's default and there's nothing else to check, beyond not being negative.
+	nonNegative := []struct {
+		setting string
+		value   int
+	}{
+		{"HTTP_CLIENT_TLS_SESSION_CACHE_SIZE", c.HTTPClientTLSSessionCacheSize},
+		{"HTTP_CLIENT_HTTP2_MAX_CONCURRENT_STREAMS", c.HTTPClientHTTP2MaxConcurrentStreams},
+		{"HTTP_CLIENT_HTTP2_READ_IDLE_TIMEOUT_MS", c.HTTPClientHTTP2ReadIdleTimeoutMS},
+		{"HTTP_CLIENT_HTTP2_PING_TIMEOUT_MS", c.HTTPClientHTTP2PingTimeoutMS},
+		{"SERVER_READ_HEADER_TIMEOUT_MS", c.ServerReadHeaderTimeoutMS},
+		{"SERVER_READ_TIMEOUT_MS", c.ServerReadTimeoutMS},
+		{"SERVER_WRITE_TIMEOUT_MS", c.ServerWriteTimeoutMS},
+		{"SERVER_IDLE_TIMEOUT_MS", c.ServerIdleTimeoutMS},
+		{"SERVER_MAX_HEADER_BYTES", c.ServerMaxHeaderBytes},
+		{"SHUTDOWN_DRAIN_MS", c.ShutdownDrainMS},
+		{"SHUTDOWN_TIMEOUT_MS", c.ShutdownTimeoutMS},
+		{"READY_PROBE_INTERVAL_MS", c.ReadyProbeIntervalMS},
+		{"READY_PROBE_TIMEOUT_MS", c.ReadyProbeTimeoutMS},
+		{"READY_MAX_IN_FLIGHT", c.ReadyMaxInFlight},
+		{"EXPECTED_CONCURRENCY", c.ExpectedConcurrency},
+		{"SOCKET_STATS_INTERVAL_MS", c.SocketStatsIntervalMS},
+		{"SERVICE_DISCOVERY_DRAIN_MS", c.ServiceDiscoveryDrainMS},
+		{"SERVICE_BALANCER_EWMA_DECAY_MS", c.ServiceBalancerEWMADecayMS},
+		{"SERVICE_HEALTH_CHECK_INTERVAL_MS", c.ServiceHealthCheckIntervalMS},
+		{"SERVICE_HEALTH_CHECK_TIMEOUT_MS", c.ServiceHealthCheckTimeoutMS},
+		{"SERVICE_OUTLIER_CONSECUTIVE_ERRORS", c.ServiceOutlierConsecutiveErrors},
+		{"SERVICE_OUTLIER_MIN_REQUESTS", c.ServiceOutlierMinRequests},
+		{"SERVICE_OUTLIER_INTERVAL_MS", c.ServiceOutlierIntervalMS},
+		{"SERVICE_OUTLIER_BASE_EJECTION_MS", c.ServiceOutlierBaseEjectionMS},
+		{"SERVICE_OUTLIER_MAX_EJECTION_MS", c.ServiceOutlierMaxEjectionMS},
+	}
+	for _, count := range nonNegative {
+		if count.value < 0 {
+			addError(count.setting, "can't be negative")
+		}
+	}
+	for _, prefix := range []string{"HTTP_CLIENT_", "SERVER_"} {
+		options := clientSocketOptions(c)
+		if prefix == "SERVER_" {
+			options = serverSocketOptions(c)
+		}
+		socketSettings := []struct {
+			setting string
+			value   int
+		}{
+			{"SEND_BUFFER_BYTES", options.SendBufferBytes},
+			{"RECEIVE_BUFFER_BYTES", options.ReceiveBufferBytes},
+			{"TCP_KEEPALIVE_INTERVAL_SECONDS", options.KeepAliveIntervalSeconds},
+			{"TCP_KEEPALIVE_COUNT", options.KeepAliveCount},
+			{"TCP_USER_TIMEOUT_MS", options.UserTimeoutMS},
+		}
+		for _, socket := range socketSettings {
+			if socket.value < 0 {
+				addError(prefix+socket.setting, "can't be negative")
+			}
+		}
+		if options.LingerSeconds < -1 {
+			addError(prefix+"LINGER_SECONDS", "must be -1 (off), 0 (reset on close) or a number of seconds")
+		}
+		if options.LingerSeconds == 0 {
+			addWarning(prefix+"LINGER_SECONDS", "0 resets connections on close instead of shutting them down cleanly, so unsent data is lost")
+		}
+		if !socketOptionsSupported && options != defaultSocketOptions {
+			addWarning(prefix+"*", "socket options are only applied on Linux, these will be ignored")
+		}
+	}
+	for _, spec := range c.HTTPClientLocalAddrs {
+		if _, err := parseLocalSource(spec); err != nil {
+			addError("HTTP_CLIENT_LOCAL_ADDRS", "%s", err)
+		}
+	}
+	for _, entry := range c.HTTPClientNoProxy {
+		if _, err := parseNoProxyRule(entry); err != nil {
+			addError("HTTP_CLIENT_NO_PROXY", "%s", err)
+		}
+	}
+	if proxy, err := ParseProxy(c.HTTPClientProxyURL, nil); err != nil {
+		addError("HTTP_CLIENT_PROXY_URL", "%s", err)
+	} else if proxy == nil && len(c.HTTPClientNoProxy) > 0 {
+		addWarning("HTTP_CLIENT_NO_PROXY", "does nothing without HTTP_CLIENT_PROXY_URL")
+	} else if proxy != nil && unixSocketPath(c.ServiceBaseURL) != "" {
+		addWarning("HTTP_CLIENT_PROXY_URL", "does nothing for a service on a Unix socket")
+	} else if proxy != nil && proxy.URL.Scheme != proxySchemeSOCKS5 && c.HTTPClientProtocol == ProtocolH2C {
+		addError("HTTP_CLIENT_PROXY_URL", "%s calls can't go through an %s proxy, which forwards calls to http services over HTTP/1.1; use a socks5 proxy",
+			ProtocolH2C, proxy.URL.Scheme)
+	}
+	if c.ShutdownTimeoutMS == 0 {
+		addError("SHUTDOWN_TIMEOUT_MS", "0 would drop every request in flight as soon as shutdown starts")
+	}
+	if c.ReadyProbeTimeoutMS == 0 {
+		addError("READY_PROBE_TIMEOUT_MS", "0 would fail every readiness probe")
+	}
+	switch {
+	case c.ServerWriteTimeoutMS == 0 || missing["HTTP_CLIENT_TIMEOUT_MS"]:
+		// No write timeout to cut a response off, or no client timeout to compare it with.
+	case c.HTTPClientTimeoutMS == 0:
+		addWarning("SERVER_WRITE_TIMEOUT_MS", "%dms with no HTTP_CLIENT_TIMEOUT_MS, so a hung service call has its /api response cut off",
+			c.ServerWriteTimeoutMS)
+	case c.HTTPClientTimeoutMS >= c.ServerWriteTimeoutMS:
+		addWarning("SERVER_WRITE_TIMEOUT_MS", "%dms isn't longer than HTTP_CLIENT_TIMEOUT_MS (%dms), so a slow service call can have its /api response cut off",
+			c.ServerWriteTimeoutMS, c.HTTPClientTimeoutMS)
+	}
+	return problems
+}
+
+// configSettingName is the environment variable a field is read from, following envconfig's rules.
+func configSettingName(field reflect.StructField) string {
+	if name := field.Tag.Get("envconfig"); name != "" {
+		return name
+	}
+	return strings.ToUpper(field.Name)
+}
+
+// ReportConfigProblems writes every problem, errors first, and says whether any of them were errors.
+func ReportConfigProblems(w io.Writer, problems []ConfigProblem) (hasErrors bool) {
+	if len(problems) == 0 {
+		return false
+	}
+	fmt.Fprintln(w, "Configuration problems:")
+	for _, warnings := range []bool{false, true} {
+		for _, problem := range problems {
+			if problem.Warning == warnings {
+				fmt.Fprintf(w, "  %s\n", problem)
+				hasErrors = hasErrors || !problem.Warning
+			}
+		}
+	}
+	return hasErrors
+}
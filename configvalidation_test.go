@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// validSettings is a complete config with nothing to complain about.
+var validSettings = map[string]string{
+	"SERVICE_BASE_URL":                       "http://127.0.0.1:9090/service",
+	"ENV_NAME":                               "test",
+	"HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST":    "100",
+	"HTTP_CLIENT_MAX_IDLE_CONNS":             "100",
+	"HTTP_CLIENT_DIALER_TIMEOUT_MS":          "1000",
+	"HTTP_CLIENT_DIALER_KEEPALIVE_MS":        "30000",
+	"HTTP_CLIENT_IDLE_CONN_TIMEOUT_MS":       "90000",
+	"HTTP_CLIENT_TLS_HANDSHAKE_TIMEOUT_MS":   "1000",
+	"HTTP_CLIENT_EXPECT_CONTINUE_TIMEOUT_MS": "1000",
+	"HTTP_CLIENT_TIMEOUT_MS":                 "1500",
+}
+
+// testLoader loads configs from flags alone, whatever the environment the tests run in sets.
+func testLoader(output io.Writer) ConfigLoader {
+	return ConfigLoader{LookupEnv: func(string) (string, bool) { return "", false }, Output: output}
+}
+
+// testArgs are the flags for validSettings with changes. A change to "" leaves the setting unset.
+func testArgs(changes map[string]string) []string {
+	settings := make(map[string]string, len(validSettings))
+	for name, value := range validSettings {
+		settings[name] = value
+	}
+	for name, value := range changes {
+		settings[name] = value
+	}
+	var args []string
+	for name, value := range settings {
+		if value != "" {
+			args = append(args, "--"+settingFlagName(name), value)
+		}
+	}
+	return args
+}
+
+// testConfig loads validSettings with changes as flags on top of the defaults. A change to "" leaves the setting unset.
+func testConfig(t *testing.T, changes map[string]string) *AppConfig {
+	config, _, err := testLoader(ioutil.Discard).Load(testArgs(changes))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return config
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes map[string]string
+		// want is each problem as "error SETTING" or "warning SETTING".
+		want []string
+	}{
+		{"valid", nil, nil},
+
+		{"required setting missing", map[string]string{"ENV_NAME": ""}, []string{"error ENV_NAME"}},
+		{"missing setting gets no warnings too", map[string]string{"HTTP_CLIENT_TIMEOUT_MS": ""}, []string{"error HTTP_CLIENT_TIMEOUT_MS"}},
+		{"local mode doesn't need a service", map[string]string{"ENV_NAME": "local", "SERVICE_BASE_URL": ""}, nil},
+
+		{"port out of range", map[string]string{"PORT": "70000"}, []string{"error PORT"}},
+		{"negative timeout", map[string]string{"HTTP_CLIENT_DIALER_TIMEOUT_MS": "-1"}, []string{"error HTTP_CLIENT_DIALER_TIMEOUT_MS"}},
+		{"timeout given in microseconds", map[string]string{"HTTP_CLIENT_IDLE_CONN_TIMEOUT_MS": "900000000"}, []string{"warning HTTP_CLIENT_IDLE_CONN_TIMEOUT_MS"}},
+		{"sample rate over 1", map[string]string{"LOG_SAMPLE_RATE": "1.5"}, []string{"error LOG_SAMPLE_RATE"}},
+		{"unknown log level", map[string]string{"LOG_LEVEL": "loud"}, []string{"error LOG_LEVEL"}},
+		{"no shutdown timeout", map[string]string{"SHUTDOWN_TIMEOUT_MS": "0"}, []string{"error SHUTDOWN_TIMEOUT_MS"}},
+		{"negative count", map[string]string{"SERVER_MAX_HEADER_BYTES": "-1"}, []string{"error SERVER_MAX_HEADER_BYTES"}},
+		{"bad scheme", map[string]string{"SERVICE_BASE_URL": "ftp://example.com"}, []string{"error SERVICE_BASE_URL"}},
+		{"unknown protocol", map[string]string{"HTTP_CLIENT_PROTOCOL": "spdy"}, []string{"error HTTP_CLIENT_PROTOCOL"}},
+
+		{"zero idle conns per host", map[string]string{"HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST": "0"}, []string{"warning HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST"}},
+		{"per-host idle conns over the total", map[string]string{"HTTP_CLIENT_MAX_IDLE_CONNS": "10"}, []string{"error HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST"}},
+		{"dialer timeout longer than the overall timeout", map[string]string{"HTTP_CLIENT_DIALER_TIMEOUT_MS": "2000"}, []string{"warning HTTP_CLIENT_DIALER_TIMEOUT_MS"}},
+		{"write timeout no longer than the client timeout", map[string]string{"SERVER_WRITE_TIMEOUT_MS": "1500"}, []string{"warning SERVER_WRITE_TIMEOUT_MS"}},
+		{"write timeout with no client timeout", map[string]string{"HTTP_CLIENT_TIMEOUT_MS": "0"}, []string{"warning HTTP_CLIENT_TIMEOUT_MS", "warning SERVER_WRITE_TIMEOUT_MS"}},
+		{"no write timeout and no client timeout", map[string]string{"HTTP_CLIENT_TIMEOUT_MS": "0", "SERVER_WRITE_TIMEOUT_MS": "0"}, []string{"warning HTTP_CLIENT_TIMEOUT_MS"}},
+		{"HTTP/2 to an http service", map[string]string{"HTTP_CLIENT_PROTOCOL": ProtocolHTTP2}, []string{"warning HTTP_CLIENT_PROTOCOL"}},
+		{"HTTP/2 settings with HTTP/1.1", map[string]string{"HTTP_CLIENT_HTTP2_CONNECTIONS": "4"}, []string{"warning HTTP_CLIENT_HTTP2_*"}},
+		{"h2c through an http proxy", map[string]string{"HTTP_CLIENT_PROTOCOL": ProtocolH2C, "HTTP_CLIENT_PROXY_URL": "http://127.0.0.1:3128"}, []string{"error HTTP_CLIENT_PROXY_URL"}},
+		{"no proxy without a proxy", map[string]string{"HTTP_CLIENT_NO_PROXY": "localhost"}, []string{"warning HTTP_CLIENT_NO_PROXY"}},
+		{"endpoints and discovery", map[string]string{"SERVICE_ENDPOINTS": "127.0.0.1:1,127.0.0.1:2", "SERVICE_DISCOVERY_FILE": "endpoints.yml"}, []string{"error SERVICE_ENDPOINTS"}},
+		{"outlier detection judging endpoints with no calls", map[string]string{"SERVICE_OUTLIER_DETECTION": "true", "SERVICE_ENDPOINTS": "10.0.0.1:80,10.0.0.2:80", "SERVICE_OUTLIER_MIN_REQUESTS": "0"}, []string{"error SERVICE_OUTLIER_MIN_REQUESTS"}},
+		{"outlier detection with one endpoint", map[string]string{"SERVICE_OUTLIER_DETECTION": "true"}, []string{"warning SERVICE_OUTLIER_DETECTION"}},
+
+		{"several problems at once", map[string]string{
+			"ENV_NAME":                            "",
+			"PORT":                                "0",
+			"LOG_LEVEL":                           "loud",
+			"HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST": "0",
+		}, []string{"error ENV_NAME", "error PORT", "error LOG_LEVEL", "warning HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, problem := range testConfig(t, test.changes).Validate() {
+				severity := "error"
+				if problem.Warning {
+					severity = "warning"
+				}
+				got = append(got, severity+" "+problem.Setting)
+			}
+			want := append([]string{}, test.want...)
+			sort.Strings(got)
+			sort.Strings(want)
+			if len(got) != 0 || len(want) != 0 {
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("got %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnRegistry keeps track of every connection to the service opened through NewHTTPClient's dialer,
+// so we can see what the transport's pool is holding and close connections by hand.
+type ConnRegistry struct {
+	opened uint64
+	closed uint64
+
+	mu    sync.Mutex
+	conns map[uint64]*TrackedConn
+}
+
+// TrackedConn is a net.Conn that counts what goes through it and knows whether a request is using it.
+// A connection is active from GotConn until the transport puts it back in the pool, see clientTrace.
+type TrackedConn struct {
+	bytesRead    int64
+	bytesWritten int64
+	requests     int64
+	lastUsed     int64 // UnixNano
+	active       int32 // calls using the connection; more than one only with HTTP/2
+
+	net.Conn
+	ID uint64
+	// Address is what the connection was dialed to: the host:port asked for before any DNS lookup, or the socket's path.
+	Address string
+	Opened  time.Time
+	// ConnectTCPInfo is the TCP_INFO just after connecting, or nil where there isn't any.
+	ConnectTCPInfo *TCPInfo
+	registry       *ConnRegistry
+	closed         sync.Once
+	// tunnelTarget is the service's host:port, for a connection to a proxy tunnelled on to it.
+	tunnelTarget atomic.Value
+}
+
+// ConnInfo is what /internal/connections shows about one connection.
+type ConnInfo struct {
+	ID         uint64 `json:"id"`
+	Address    string `json:"address"`
+	TunnelTo   string `json:"tunnelTo,omitempty"`
+	LocalAddr  string `json:"localAddr"`
+	RemoteAddr string `json:"remoteAddr"`
+	State      string `json:"state"`
+	// ActiveCalls is how many calls are using the connection, which can be more than one with HTTP/2.
+	ActiveCalls int32     `json:"activeCalls"`
+	AgeMS       float64   `json:"ageMS"`
+	Requests    int64     `json:"requests"`
+	BytesIn     int64     `json:"bytesIn"`
+	BytesOut    int64     `json:"bytesOut"`
+	LastUsed    time.Time `json:"lastUsed"`
+	// ConnectTCPInfo is from just after connecting, TCPInfo from now.
+	ConnectTCPInfo *TCPInfo `json:"connectTCPInfo,omitempty"`
+	TCPInfo        *TCPInfo `json:"tcpInfo,omitempty"`
+	// SocketOptions are read back from the kernel, see SocketOptions.
+	SocketOptions map[string]int `json:"socketOptions,omitempty"`
+}
+
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: make(map[uint64]*TrackedConn)}
+}
+
+// Track wraps conn, dialed to address, and keeps it in the registry until it's closed.
+func (r *ConnRegistry) Track(conn net.Conn, address string) *TrackedConn {
+	now := time.Now()
+	tracked := &TrackedConn{
+		Conn:     conn,
+		ID:       atomic.AddUint64(&r.opened, 1),
+		Address:  address,
+		Opened:   now,
+		registry: r,
+		lastUsed: now.UnixNano(),
+	}
+	tracked.ConnectTCPInfo, _ = readTCPInfo(conn)
+	r.mu.Lock()
+	r.conns[tracked.ID] = tracked
+	r.mu.Unlock()
+	return tracked
+}
+
+// Opened is how many connections have been opened, including ones since closed.
+func (r *ConnRegistry) Opened() uint64 {
+	return atomic.LoadUint64(&r.opened)
+}
+
+// Conns describes every open connection, oldest first.
+func (r *ConnRegistry) Conns() []ConnInfo {
+	r.mu.Lock()
+	conns := make([]*TrackedConn, 0, len(r.conns))
+	for _, conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	r.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	infos := make([]ConnInfo, len(conns))
+	for i, conn := range conns {
+		infos[i] = conn.Info()
+	}
+	return infos
+}
+
+// CloseAll closes every open connection, including ones in the middle of a request, and says how many it closed.
+func (r *ConnRegistry) CloseAll() int {
+	return r.closeWhere(func(conn *TrackedConn) bool { return true })
+}
+
+// CloseTo closes every open connection to address, directly or tunnelled through a proxy, and says how many it closed.
+// Calls to http services forwarded by an http proxy share connections to the proxy whatever the service, so those are left.
+func (r *ConnRegistry) CloseTo(address string) int {
+	return r.closeWhere(func(conn *TrackedConn) bool { return conn.Target() == address })
+}
+
+func (r *ConnRegistry) closeWhere(match func(conn *TrackedConn) bool) int {
+	r.mu.Lock()
+	conns := make([]*TrackedConn, 0, len(r.conns))
+	for _, conn := range r.conns {
+		if match(conn) {
+			conns = append(conns, conn)
+		}
+	}
+	r.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+func (c *TrackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.bytesRead, int64(n))
+	atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+	return n, err
+}
+
+func (c *TrackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.bytesWritten, int64(n))
+	atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+	return n, err
+}
+
+func (c *TrackedConn) Close() error {
+	c.closed.Do(func() {
+		c.registry.mu.Lock()
+		delete(c.registry.conns, c.ID)
+		c.registry.mu.Unlock()
+		atomic.AddUint64(&c.registry.closed, 1)
+	})
+	return c.Conn.Close()
+}
+
+// acquired is called when a request starts using the connection.
+func (c *TrackedConn) acquired() {
+	atomic.AddInt64(&c.requests, 1)
+	atomic.AddInt32(&c.active, 1)
+}
+
+// released is called when the connection goes back in the pool, or for HTTP/2 when the call is done.
+func (c *TrackedConn) released() {
+	atomic.AddInt32(&c.active, -1)
+}
+
+// TCPInfo is the connection's TCP_INFO right now.
+func (c *TrackedConn) TCPInfo() (*TCPInfo, error) {
+	return readTCPInfo(c.Conn)
+}
+
+// tunnelledTo records that the connection is to a proxy that has tunnelled it on to address.
+func (c *TrackedConn) tunnelledTo(address string) {
+	c.tunnelTarget.Store(address)
+}
+
+// Target is the address the connection reaches the service at: where a proxy tunnels it to, or else Address.
+func (c *TrackedConn) Target() string {
+	if target, ok := c.tunnelTarget.Load().(string); ok {
+		return target
+	}
+	return c.Address
+}
+
+func (c *TrackedConn) Info() ConnInfo {
+	state := "idle"
+	active := atomic.LoadInt32(&c.active)
+	if active > 0 {
+		state = "active"
+	}
+	tcpInfo, _ := c.TCPInfo()
+	socketOptions, _ := ReadSocketOptions(c.Conn)
+	tunnelTo, _ := c.tunnelTarget.Load().(string)
+	return ConnInfo{
+		ID:          c.ID,
+		Address:     c.Address,
+		TunnelTo:    tunnelTo,
+		LocalAddr:   c.LocalAddr().String(),
+		RemoteAddr:  c.RemoteAddr().String(),
+		State:       state,
+		ActiveCalls: active,
+		AgeMS:       durationMS(time.Since(c.Opened)),
+		Requests:    atomic.LoadInt64(&c.requests),
+		BytesIn:     atomic.LoadInt64(&c.bytesRead),
+		BytesOut:    atomic.LoadInt64(&c.bytesWritten),
+		LastUsed:    time.Unix(0, atomic.LoadInt64(&c.lastUsed)),
+
+		ConnectTCPInfo: c.ConnectTCPInfo,
+		TCPInfo:        tcpInfo,
+		SocketOptions:  socketOptions,
+	}
+}
+
+// trackedConn finds the TrackedConn under a connection the transport hands to httptrace, if there is one.
+// For https it's under the TLS connection.
+func trackedConn(conn net.Conn) *TrackedConn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tracked, _ := conn.(*TrackedConn)
+	return tracked
+}
+
+// ConnectionsHandler is /internal/connections. GET lists the connections; POST with action=close-idle
+// closes the ones sitting in the pool, and action=close-all closes every one, even mid-request.
+type ConnectionsHandler struct {
+	Conns      *ConnRegistry
+	HTTPClient *SwappableHTTPClient
+}
+
+func (h ConnectionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		switch action := r.URL.Query().Get("action"); action {
+		case "close-idle":
+			before := len(h.Conns.Conns())
+			h.HTTPClient.Client().CloseIdleConnections()
+			response["closed"] = before - len(h.Conns.Conns())
+		case "close-all":
+			response["closed"] = h.Conns.CloseAll()
+		default:
+			http.Error(w, "action must be close-idle or close-all", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "GET to list connections, POST ?action=close-idle or ?action=close-all to close them", http.StatusMethodNotAllowed)
+		return
+	}
+	conns := h.Conns.Conns()
+	active := 0
+	// Counted by source IP, to see connections spread over HTTP_CLIENT_LOCAL_ADDRS.
+	bySource := map[string]int{}
+	for _, conn := range conns {
+		if conn.State == "active" {
+			active++
+		}
+		if host, _, err := net.SplitHostPort(conn.LocalAddr); err == nil {
+			bySource[host]++
+		}
+	}
+	response["open"] = len(conns)
+	response["active"] = active
+	response["idle"] = len(conns) - active
+	response["bySource"] = bySource
+	response["openedTotal"] = h.Conns.Opened()
+	response["closedTotal"] = atomic.LoadUint64(&h.Conns.closed)
+	response["connections"] = conns
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ContractResult is the outcome of checking one fake endpoint against the real upstream.
+type ContractResult struct {
+	Endpoint string   `json:"endpoint"`
+	Method   string   `json:"method"`
+	URL      string   `json:"url"`
+	Skipped  bool     `json:"skipped,omitempty"`
+	Passed   bool     `json:"passed"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// ContractVerifier replays the requests from a mockingjay config against a real upstream and checks
+// the answers are compatible with what the fake promises, and with what ServiceResponse can decode.
+type ContractVerifier struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func runVerifyContractCommand(args []string) int {
+	flags := flag.NewFlagSet("verify-contract", flag.ContinueOnError)
+	fakeConfig := flags.String("fake", "fakes/fake-service.yml", "mockingjay config listing the endpoints to verify")
+	baseURL := flags.String("base-url", "", `real upstream to verify against, or "local" for an in-process fake serving -fake`)
+	timeoutMS := flags.Int("timeout-ms", 5000, "timeout for each request")
+	format := flags.String("format", "text", "report format: text or json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *baseURL == "" {
+		fmt.Fprintln(os.Stderr, "verify-contract: -base-url is required")
+		return 2
+	}
+	endpoints, err := LoadFakeEndpoints(*fakeConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify-contract:", err)
+		return 1
+	}
+	if *baseURL == "local" {
+		upstream := NewFakeUpstream(endpoints, nil)
+		if err := upstream.Start(); err != nil {
+			fmt.Fprintln(os.Stderr, "verify-contract:", err)
+			return 1
+		}
+		defer upstream.Close()
+		*baseURL = upstream.URL
+	}
+	verifier := ContractVerifier{
+		BaseURL:    strings.TrimRight(*baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: time.Duration(*timeoutMS) * time.Millisecond},
+	}
+	results := verifier.Verify(endpoints)
+	if *format == "json" {
+		out, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		WriteContractReport(os.Stdout, results)
+	}
+	for _, result := range results {
+		if !result.Passed && !result.Skipped {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (v ContractVerifier) Verify(endpoints []FakeEndpoint) []ContractResult {
+	results := make([]ContractResult, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		result := ContractResult{Endpoint: endpoint.Name, Method: endpoint.Request.Method, URL: v.BaseURL + endpoint.Request.URI}
+		if endpoint.CDCDisabled {
+			result.Skipped = true
+		} else {
+			result.Problems = v.verifyEndpoint(endpoint)
+			result.Passed = len(result.Problems) == 0
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (v ContractVerifier) verifyEndpoint(endpoint FakeEndpoint) []string {
+	body := endpoint.Request.Body
+	if body == "" || body == "*" {
+		// The fake accepts anything, so send what Service would.
+		body = ServiceRequest{RequestID: "verify-contract"}.String()
+	}
+	req, err := http.NewRequest(endpoint.Request.Method, v.BaseURL+endpoint.Request.URI, strings.NewReader(body))
+	if err != nil {
+		return []string{err.Error()}
+	}
+	for name, value := range endpoint.Request.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := v.HTTPClient.Do(req)
+	if err != nil {
+		return []string{fmt.Sprintf("request failed: %s", err)}
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return []string{fmt.Sprintf("reading response failed: %s", err)}
+	}
+
+	var problems []string
+	if resp.StatusCode != endpoint.Response.Code {
+		problems = append(problems, fmt.Sprintf("status is %d, fake says %d", resp.StatusCode, endpoint.Response.Code))
+	}
+	for name, want := range endpoint.Response.Headers {
+		if got := resp.Header.Get(name); !headerValuesMatch(name, got, want) {
+			problems = append(problems, fmt.Sprintf("header %s is %q, fake says %q", name, got, want))
+		}
+	}
+
+	var fakeJSON interface{}
+	if err := json.Unmarshal([]byte(endpoint.Response.Body), &fakeJSON); err != nil {
+		// Not a JSON fake, so the best we can do is compare bodies exactly.
+		if string(respBody) != endpoint.Response.Body {
+			problems = append(problems, "body differs from the fake")
+		}
+		return problems
+	}
+	var realJSON interface{}
+	if err := json.Unmarshal(respBody, &realJSON); err != nil {
+		return append(problems, fmt.Sprintf("body is not JSON: %s", err))
+	}
+	problems = append(problems, jsonShapeProblems("", fakeJSON, realJSON)...)
+	if endpoint.Response.Code == http.StatusOK {
+		problems = append(problems, serviceResponseProblems(respBody)...)
+	}
+	return problems
+}
+
+// headerValuesMatch compares media types for Content-Type, so "application/json; charset=utf-8" still matches.
+func headerValuesMatch(name, got, want string) bool {
+	if strings.EqualFold(name, "Content-Type") {
+		gotType, _, errGot := mime.ParseMediaType(got)
+		wantType, _, errWant := mime.ParseMediaType(want)
+		if errGot == nil && errWant == nil {
+			return gotType == wantType
+		}
+	}
+	return got == want
+}
+
+// jsonShapeProblems checks that everything in the fake's JSON is in the real JSON with the same type.
+// Extra fields in the real response are fine; values don't have to match.
+func jsonShapeProblems(path string, fake, real interface{}) []string {
+	if jsonType(fake) != jsonType(real) {
+		return []string{fmt.Sprintf("%s is %s, fake says %s", jsonPath(path), jsonType(real), jsonType(fake))}
+	}
+	var problems []string
+	switch fakeValue := fake.(type) {
+	case map[string]interface{}:
+		realValue := real.(map[string]interface{})
+		keys := make([]string, 0, len(fakeValue))
+		for key := range fakeValue {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			realField, ok := realValue[key]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s is missing", jsonPath(path+"."+key)))
+				continue
+			}
+			problems = append(problems, jsonShapeProblems(path+"."+key, fakeValue[key], realField)...)
+		}
+	case []interface{}:
+		realValue := real.([]interface{})
+		if len(fakeValue) > 0 {
+			for i, item := range realValue {
+				problems = append(problems, jsonShapeProblems(fmt.Sprintf("%s[%d]", path, i), fakeValue[0], item)...)
+			}
+		}
+	}
+	return problems
+}
+
+// serviceResponseProblems checks the body has every field ServiceResponse reads, with the right JSON type.
+func serviceResponseProblems(body []byte) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return []string{fmt.Sprintf("body can't be read as a ServiceResponse: %s", err)}
+	}
+	var problems []string
+	responseType := reflect.TypeOf(ServiceResponse{})
+	for i := 0; i < responseType.NumField(); i++ {
+		field := responseType.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		raw, ok := fields[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("ServiceResponse.%s: %q is missing", field.Name, name))
+			continue
+		}
+		if err := json.Unmarshal(raw, reflect.New(field.Type).Interface()); err != nil {
+			problems = append(problems, fmt.Sprintf("ServiceResponse.%s: %q can't be decoded: %s", field.Name, name, err))
+		}
+	}
+	return problems
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func jsonPath(path string) string {
+	if path == "" {
+		return "body"
+	}
+	return "body" + path
+}
+
+func WriteContractReport(w io.Writer, results []ContractResult) {
+	passed, failed, skipped := 0, 0, 0
+	for _, result := range results {
+		switch {
+		case result.Skipped:
+			skipped++
+			fmt.Fprintf(w, "SKIP  %s (cdcdisabled)\n", result.Endpoint)
+		case result.Passed:
+			passed++
+			fmt.Fprintf(w, "PASS  %s  %s %s\n", result.Endpoint, result.Method, result.URL)
+		default:
+			failed++
+			fmt.Fprintf(w, "FAIL  %s  %s %s\n", result.Endpoint, result.Method, result.URL)
+			for _, problem := range result.Problems {
+				fmt.Fprintf(w, "      - %s\n", problem)
+			}
+		}
+	}
+	fmt.Fprintf(w, "\n%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyAgainst serves real from a local fake upstream and checks the fake endpoint against it.
+func verifyAgainst(t *testing.T, real FakeEndpoint, fake FakeEndpoint) ContractResult {
+	upstream := NewFakeUpstream([]FakeEndpoint{real}, nil)
+	if err := upstream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	verifier := ContractVerifier{BaseURL: upstream.URL, HTTPClient: &http.Client{Timeout: 5 * time.Second}}
+	results := verifier.Verify([]FakeEndpoint{fake})
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	return results[0]
+}
+
+func serviceEndpoint(code int, body string) FakeEndpoint {
+	return FakeEndpoint{
+		Name: "service",
+		Request: FakeRequest{
+			URI:     "/service",
+			Method:  "POST",
+			Headers: map[string]string{"content-type": "application/json"},
+			Body:    "*",
+		},
+		Response: FakeResponse{Code: code, Body: body, Headers: map[string]string{"Content-Type": "application/json"}},
+	}
+}
+
+func TestVerifyContract(t *testing.T) {
+	const good = `{"requestid":"6ba7b810-9dad-11d1-80b4-00c04fd430c8","qux":"flubber"}`
+	tests := []struct {
+		name        string
+		real, fake  FakeEndpoint
+		wantProblem string
+	}{
+		{"pass", serviceEndpoint(200, good), serviceEndpoint(200, good), ""},
+		{"extra fields are fine", serviceEndpoint(200, `{"requestid":"a","qux":"b","extra":1}`), serviceEndpoint(200, good), ""},
+		{"status mismatch", serviceEndpoint(500, good), serviceEndpoint(200, good), "status is 500, fake says 200"},
+		{"wrong type", serviceEndpoint(200, `{"requestid":"a","qux":7}`), serviceEndpoint(200, good), "body.qux is number, fake says string"},
+		// The fake leaves qux out too, so only the ServiceResponse check notices.
+		{"missing ServiceResponse field", serviceEndpoint(200, `{"requestid":"a"}`), serviceEndpoint(200, `{"requestid":"a"}`), `ServiceResponse.Qux: "qux" is missing`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := verifyAgainst(t, test.real, test.fake)
+			if test.wantProblem == "" {
+				if !result.Passed {
+					t.Errorf("failed with %q, want a pass", result.Problems)
+				}
+				return
+			}
+			if result.Passed {
+				t.Fatalf("passed, want %q", test.wantProblem)
+			}
+			found := false
+			for _, problem := range result.Problems {
+				found = found || strings.Contains(problem, test.wantProblem)
+			}
+			if !found {
+				t.Errorf("problems are %q, want one with %q", result.Problems, test.wantProblem)
+			}
+		})
+	}
+}
+
+func TestVerifyContractSkipsCDCDisabled(t *testing.T) {
+	fake := serviceEndpoint(200, "{}")
+	fake.CDCDisabled = true
+	result := verifyAgainst(t, serviceEndpoint(500, ""), fake)
+	if !result.Skipped || result.Passed {
+		t.Errorf("got %+v, want it skipped", result)
+	}
+}
+
+func TestVerifyContractCommandLocal(t *testing.T) {
+	if status := runVerifyContractCommand([]string{"-fake", "fakes/fake-service.yml", "-base-url", "local", "-format", "json"}); status != 0 {
+		t.Errorf("verify-contract against a local fake exited %d, want 0", status)
+	}
+}
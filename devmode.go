@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/pprof"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Local mode, ENV_NAME=local, is for running the app on a laptop: logs are for reading rather than
+// shipping, settings that aren't given fall back to Go's defaults, the fake service is started in
+// process when SERVICE_BASE_URL isn't set, and pprof is served on /debug/pprof/.
+
+// localFakeConfig is the mockingjay config served by the in-process fake in local mode.
+const localFakeConfig = "fakes/fake-service.yml"
+
+// localFakeSource is the source of settings that point at the local fake.
+const localFakeSource = "local fake " + localFakeConfig
+
+// localDefaultsProfile fills in whatever settings are still unset in local mode.
+const localDefaultsProfile = "go-defaults"
+
+func useLocalLogFormat() {
+	log.SetFormatter(&log.TextFormatter{ForceColors: true, FullTimestamp: true, TimestampFormat: "15:04:05.000"})
+}
+
+// startLocalUpstream serves localFakeConfig in process and points SERVICE_BASE_URL at its first endpoint.
+// There's no monkey config, so it answers straight away. With LOCAL_FAKE_TLS it serves https, and the
+// client trusts its CA unless HTTP_CLIENT_TLS_CA_FILE says otherwise.
+func startLocalUpstream(config *AppConfig) (*FakeUpstream, error) {
+	endpoints, err := LoadFakeEndpoints(localFakeConfig)
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New(localFakeConfig + " has no endpoints")
+	}
+	upstream := NewFakeUpstream(endpoints, nil)
+	upstream.TLS = config.LocalFakeTLS
+	if err := upstream.Start(); err != nil {
+		return nil, err
+	}
+	config.ServiceBaseURL = upstream.URL + endpoints[0].Request.URI
+	config.sources["SERVICE_BASE_URL"] = localFakeSource
+	if upstream.CAFile != "" && config.HTTPClientTLSCAFile == "" {
+		config.HTTPClientTLSCAFile = upstream.CAFile
+		config.sources["HTTP_CLIENT_TLS_CA_FILE"] = localFakeSource
+	}
+	return upstream, nil
+}
+
+// withPprof serves the runtime profiles on /debug/pprof/ alongside handler.
+func withPprof(handler http.Handler) http.Handler {
+	serveMux := http.NewServeMux()
+	serveMux.Handle("/", handler)
+	serveMux.HandleFunc("/debug/pprof/", pprof.Index)
+	serveMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	serveMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	serveMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	serveMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return serveMux
+}
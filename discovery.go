@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Discovery keeps a Balancer's endpoints in line with SERVICE_DISCOVERY_FILE and SERVICE_DISCOVERY_SRV,
+// checking every Interval. The file is only decoded again when its contents change; the SRV records
+// are looked up every time. With both, the endpoints are everything either lists.
+//
+// A file that can't be read, a failed lookup, or finding no endpoints at all leaves the endpoints as
+// they were, so a bad deploy of the file or a DNS blip doesn't take every endpoint away.
+type Discovery struct {
+	Balancer *Balancer
+	File     string
+	SRV      string
+	Interval time.Duration
+
+	mu sync.Mutex
+	// fileHash is the hash of the file's contents, which unlike its modification time changes with every
+	// rewrite, even one within the filesystem's timestamp granularity that keeps its size.
+	fileHash      [sha256.Size]byte
+	fileEndpoints []string
+	lastRefresh   time.Time
+	lastError     string
+	lastChange    time.Time
+	stop          chan struct{}
+	stopped       chan struct{}
+}
+
+// DiscoveryFile is the format of SERVICE_DISCOVERY_FILE, as JSON or YAML:
+//
+//	endpoints:
+//	  - 10.0.0.1:8080
+//	  - 10.0.0.2:8080
+type DiscoveryFile struct {
+	Endpoints []string `json:"endpoints"`
+}
+
+func NewDiscovery(config *AppConfig, balancer *Balancer) *Discovery {
+	return &Discovery{
+		Balancer: balancer,
+		File:     config.ServiceDiscoveryFile,
+		SRV:      config.ServiceDiscoverySRV,
+		Interval: time.Duration(config.ServiceDiscoveryIntervalMS) * time.Millisecond,
+	}
+}
+
+// Enabled is whether there's anywhere to discover endpoints from.
+func (d *Discovery) Enabled() bool {
+	return d.File != "" || d.SRV != ""
+}
+
+// Start refreshes the endpoints every Interval in the background. It does nothing unless Enabled.
+func (d *Discovery) Start() {
+	if !d.Enabled() {
+		return
+	}
+	d.stop, d.stopped = make(chan struct{}), make(chan struct{})
+	go func(stop, stopped chan struct{}) {
+		defer close(stopped)
+		ticker := time.NewTicker(d.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.Refresh()
+			case <-stop:
+				return
+			}
+		}
+	}(d.stop, d.stopped)
+}
+
+// Stop stops refreshing the endpoints, waiting for a refresh already under way. The balancer keeps the
+// ones it has.
+func (d *Discovery) Stop() {
+	if d.stop == nil {
+		return
+	}
+	close(d.stop)
+	<-d.stopped
+	d.stop, d.stopped = nil, nil
+}
+
+// Refresh reads the file if it's changed and looks the SRV records up, and hands the balancer the
+// endpoints found, logging any that were added or removed.
+func (d *Discovery) Refresh() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastRefresh = time.Now()
+	addresses, err := d.discover()
+	if err == nil && len(addresses) == 0 {
+		err = errors.New("no endpoints found")
+	}
+	var added, removed []string
+	if err == nil {
+		added, removed, err = d.Balancer.SetEndpoints(addresses)
+	}
+	if err != nil {
+		// Before the first endpoints are found there's nothing to keep, and the caller reports the error.
+		if d.lastError != err.Error() && len(d.Balancer.Endpoints()) > 0 {
+			log.WithField("error", err.Error()).Warn("Service discovery failed, keeping the endpoints as they were")
+		}
+		d.lastError = err.Error()
+		return err
+	}
+	d.lastError = ""
+	if len(added) > 0 || len(removed) > 0 {
+		d.lastChange = d.lastRefresh
+		log.WithFields(map[string]interface{}{
+			"added":     added,
+			"removed":   removed,
+			"endpoints": len(addresses),
+		}).Info("Service endpoints changed")
+	}
+	return nil
+}
+
+func (d *Discovery) discover() ([]string, error) {
+	var addresses []string
+	if d.File != "" {
+		data, err := ioutil.ReadFile(d.File)
+		if err != nil {
+			return nil, err
+		}
+		if hash := sha256.Sum256(data); d.fileEndpoints == nil || hash != d.fileHash {
+			var file DiscoveryFile
+			if err := decodeFileData(d.File, data, &file); err != nil {
+				return nil, err
+			}
+			d.fileHash, d.fileEndpoints = hash, append([]string{}, file.Endpoints...)
+		}
+		addresses = append(addresses, d.fileEndpoints...)
+	}
+	if d.SRV != "" {
+		found, err := lookupSRVEndpoints(d.SRV)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, found...)
+	}
+	return addresses, nil
+}
+
+// lookupSRVEndpoints looks up the SRV records for name, such as _http._tcp.service.internal, and gives the
+// host:port of each with the best priority. Their weights are left to the balancer.
+func lookupSRVEndpoints(name string) ([]string, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, record := range records {
+		// LookupSRV sorts the records by priority, best first.
+		if record.Priority != records[0].Priority {
+			break
+		}
+		host := strings.TrimSuffix(record.Target, ".")
+		if host == "" {
+			return nil, fmt.Errorf("%s: an SRV record with target \".\" means the service isn't available", name)
+		}
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	return addresses, nil
+}
+
+// ServeHTTP answers /internal/discovery with where endpoints come from and how the last refresh went.
+func (d *Discovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	status := map[string]interface{}{
+		"enabled":    d.Enabled(),
+		"file":       d.File,
+		"srv":        d.SRV,
+		"intervalMS": durationMS(d.Interval),
+	}
+	if !d.lastRefresh.IsZero() {
+		status["lastRefresh"] = d.lastRefresh
+	}
+	if !d.lastChange.IsZero() {
+		status["lastChange"] = d.lastChange
+	}
+	if d.lastError != "" {
+		status["error"] = d.lastError
+	}
+	d.mu.Unlock()
+	var endpoints []string
+	for _, endpoint := range d.Balancer.Endpoints() {
+		endpoints = append(endpoints, endpoint.Address)
+	}
+	status["endpoints"] = endpoints
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
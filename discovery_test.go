@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// endpointAddresses are the balancer's endpoints in rotation, and the ones still draining.
+func endpointAddresses(balancer *Balancer) (addresses []string, draining []string) {
+	for _, stats := range balancer.Stats() {
+		if stats.Draining {
+			draining = append(draining, stats.Address)
+		} else {
+			addresses = append(addresses, stats.Address)
+		}
+	}
+	return addresses, draining
+}
+
+// testDiscovery makes a Discovery from a file in a directory removed after the test, with the balancer
+// sending each endpoint it's done draining on drained.
+func testDiscovery(t *testing.T, name string) (discovery *Discovery, path string, drained chan string) {
+	path = filepath.Join(t.TempDir(), name)
+	config := testConfig(t, map[string]string{"SERVICE_DISCOVERY_FILE": path})
+	balancer, err := NewBalancer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drained = make(chan string, 8)
+	balancer.OnDrained = func(endpoint *Endpoint) { drained <- endpoint.Address }
+	return NewDiscovery(config, balancer), path, drained
+}
+
+func writeDiscoveryFile(t *testing.T, path, contents string) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscoveryFileRewritten(t *testing.T) {
+	discovery, path, drained := testDiscovery(t, "endpoints.yml")
+	balancer := discovery.Balancer
+	writeDiscoveryFile(t, path, "endpoints:\n  - 10.0.0.1:80\n  - 10.0.0.2:80\n")
+	if err := discovery.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if addresses, _ := endpointAddresses(balancer); !reflect.DeepEqual(addresses, []string{"10.0.0.1:80", "10.0.0.2:80"}) {
+		t.Fatalf("endpoints are %v, want the file's", addresses)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A call still in flight to the endpoint about to be removed holds up its draining.
+	var done func(error)
+	for {
+		var endpoint *Endpoint
+		if endpoint, done = balancer.Pick(); endpoint.Address == "10.0.0.2:80" {
+			break
+		}
+		done(nil)
+	}
+	// The same size and modification time, as a rewrite within the timestamp granularity would have.
+	writeDiscoveryFile(t, path, "endpoints:\n  - 10.0.0.1:80\n  - 10.0.0.3:80\n")
+	if err := os.Chtimes(path, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := discovery.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	addresses, draining := endpointAddresses(balancer)
+	if !reflect.DeepEqual(addresses, []string{"10.0.0.1:80", "10.0.0.3:80"}) || !reflect.DeepEqual(draining, []string{"10.0.0.2:80"}) {
+		t.Fatalf("endpoints are %v with %v draining, want 10.0.0.1:80 and 10.0.0.3:80 with 10.0.0.2:80 draining", addresses, draining)
+	}
+	if counts := pickCounts(balancer, 10); counts["10.0.0.2:80"] != 0 {
+		t.Errorf("calls went to %v, want none to the removed endpoint", counts)
+	}
+
+	select {
+	case address := <-drained:
+		t.Fatalf("%s drained with a call still in flight", address)
+	case <-time.After(3 * drainPollInterval):
+	}
+	done(nil)
+	select {
+	case address := <-drained:
+		if address != "10.0.0.2:80" {
+			t.Errorf("%s drained, want 10.0.0.2:80", address)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("10.0.0.2:80 wasn't drained once its call finished")
+	}
+	if _, draining := endpointAddresses(balancer); len(draining) != 0 {
+		t.Errorf("%v still draining", draining)
+	}
+}
+
+func TestDiscoveryKeepsEndpointsOnBadFile(t *testing.T) {
+	tests := []struct {
+		name, contents, wantErr string
+	}{
+		{"not JSON", `{"endpoints": [`, "endpoints.json"},
+		{"no endpoints", `{"endpoints": []}`, "no endpoints found"},
+		{"invalid endpoint", `{"endpoints": ["10.0.0.3:nope"]}`, "10.0.0.3:nope"},
+		{"removed", "", "no such file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			discovery, path, _ := testDiscovery(t, "endpoints.json")
+			writeDiscoveryFile(t, path, `{"endpoints": ["10.0.0.1:80", "10.0.0.2:80"]}`)
+			if err := discovery.Refresh(); err != nil {
+				t.Fatal(err)
+			}
+			if test.contents == "" {
+				os.Remove(path)
+			} else {
+				writeDiscoveryFile(t, path, test.contents)
+			}
+			if err := discovery.Refresh(); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got %v, want an error with %q", err, test.wantErr)
+			}
+			addresses, draining := endpointAddresses(discovery.Balancer)
+			if !reflect.DeepEqual(addresses, []string{"10.0.0.1:80", "10.0.0.2:80"}) || len(draining) != 0 {
+				t.Errorf("endpoints are %v with %v draining, want them left as they were", addresses, draining)
+			}
+		})
+	}
+}
+
+func TestDiscoveryNeedsEndpointsToStart(t *testing.T) {
+	discovery, path, _ := testDiscovery(t, "endpoints.json")
+	writeDiscoveryFile(t, path, `{"endpoints": []}`)
+	if err := discovery.Refresh(); err == nil {
+		t.Error("a file with no endpoints gave no error")
+	}
+	if endpoints := discovery.Balancer.Endpoints(); len(endpoints) != 0 {
+		t.Errorf("endpoints are %v, want none yet", endpoints)
+	}
+}
+
+func TestDiscoveryStop(t *testing.T) {
+	discovery, path, _ := testDiscovery(t, "endpoints.yml")
+	discovery.Interval = 5 * time.Millisecond
+	writeDiscoveryFile(t, path, "endpoints:\n  - 10.0.0.1:80\n")
+	discovery.Start()
+	for deadline := time.Now().Add(time.Second); len(discovery.Balancer.Endpoints()) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the file's endpoints weren't picked up after Start")
+		}
+	}
+	discovery.Stop()
+	writeDiscoveryFile(t, path, "endpoints:\n  - 10.0.0.2:80\n")
+	time.Sleep(5 * discovery.Interval)
+	if addresses, _ := endpointAddresses(discovery.Balancer); !reflect.DeepEqual(addresses, []string{"10.0.0.1:80"}) {
+		t.Errorf("endpoints are %v after Stop, want 10.0.0.1:80 still", addresses)
+	}
+	discovery.Stop()
+}
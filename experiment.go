@@ -0,0 +1,680 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ExperimentMatrix describes a set of runs: every combination of the listed transport settings
+// and latency profiles is run once against a fresh in-process fake upstream.
+// Axes left empty use the value from experimentBaseConfig.
+type ExperimentMatrix struct {
+	Requests            int    `json:"requests"`
+	Concurrency         int    `json:"concurrency"`
+	FakeConfig          string `json:"fakeConfig"`
+	MaxIdleConnsPerHost []int  `json:"maxIdleConnsPerHost"`
+	IdleConnTimeoutMS   []int  `json:"idleConnTimeoutMS"`
+	TimeoutMS           []int  `json:"timeoutMS"`
+	// Protocols are HTTP_CLIENT_PROTOCOL values. http2 needs TLS, h2c needs it off.
+	Protocols []string `json:"protocols"`
+	// TLS has the fake upstream serve https, and TLSSessionCacheSize varies HTTP_CLIENT_TLS_SESSION_CACHE_SIZE.
+	TLS                 bool  `json:"tls"`
+	TLSSessionCacheSize []int `json:"tlsSessionCacheSize"`
+	// Networks are how to reach the fake upstream: "tcp" over loopback, or "unix" over a Unix socket.
+	Networks []string `json:"networks"`
+	// Proxies are what to call the fake upstream through: "none", or an in-process FakeProxy as "http" or "socks5".
+	Proxies []string `json:"proxies"`
+	// Balancers are SERVICE_BALANCER values, and Endpoints has each cell start a fake upstream per
+	// profile listed, for the balancer to spread calls over. Endpoints take the place of LatencyProfiles.
+	Balancers []string         `json:"balancers"`
+	Endpoints []LatencyProfile `json:"endpoints"`
+	// OutlierDetection turns SERVICE_OUTLIER_DETECTION on or off, with its timings scaled down to suit
+	// a run of a few seconds. It needs Endpoints.
+	OutlierDetection []bool           `json:"outlierDetection"`
+	LatencyProfiles  []LatencyProfile `json:"latencyProfiles"`
+}
+
+// LatencyProfile is a named set of monkey rules for the fake upstream, given inline or as a monkey.yml file.
+type LatencyProfile struct {
+	Name       string       `json:"name"`
+	Monkey     []MonkeyRule `json:"monkey,omitempty"`
+	MonkeyFile string       `json:"monkeyFile,omitempty"`
+}
+
+type ExperimentSettings struct {
+	MaxIdleConnsPerHost int    `json:"maxIdleConnsPerHost"`
+	IdleConnTimeoutMS   int    `json:"idleConnTimeoutMS"`
+	TimeoutMS           int    `json:"timeoutMS"`
+	Protocol            string `json:"protocol"`
+	TLSSessionCacheSize int    `json:"tlsSessionCacheSize"`
+	Network             string `json:"network"`
+	Proxy               string `json:"proxy"`
+	Balancer            string `json:"balancer"`
+	OutlierDetection    bool   `json:"outlierDetection"`
+	LatencyProfile      string `json:"latencyProfile"`
+}
+
+// ExperimentCell is the outcome of running one combination of settings.
+type ExperimentCell struct {
+	Name                string             `json:"name"`
+	Settings            ExperimentSettings `json:"settings"`
+	Requests            int                `json:"requests"`
+	Errors              map[string]int     `json:"errors"`
+	ErrorCount          int                `json:"errorCount"`
+	LatencyMS           LatencySummary     `json:"latencyMS"`
+	NewDials            int                `json:"newDials"`
+	Reuses              int                `json:"reuses"`
+	PeakOpenConnections int64              `json:"peakOpenConnections"`
+	// FullHandshakes and ResumedHandshakes count the TLS handshakes of each kind, and HandshakeMS times them.
+	FullHandshakes    int                       `json:"fullHandshakes,omitempty"`
+	ResumedHandshakes int                       `json:"resumedHandshakes,omitempty"`
+	HandshakeMS       map[string]LatencySummary `json:"handshakeMS,omitempty"`
+	// Endpoints is how the calls were shared out over the matrix's endpoints, in the same order.
+	Endpoints         []ExperimentEndpoint `json:"endpoints,omitempty"`
+	DurationMS        float64              `json:"durationMS"`
+	RequestsPerSecond float64              `json:"requestsPerSecond"`
+
+	// PhasesMS breaks the calls down by tracePhases.
+	PhasesMS map[string]LatencySummary `json:"phasesMS"`
+	// LatencySamplesMS holds every call's latency, in the order the calls finished, for histograms and comparisons.
+	LatencySamplesMS []float64 `json:"latencySamplesMS"`
+}
+
+// ExperimentEndpoint is how one of a cell's fake upstreams did, and how many times it was ejected as an outlier.
+type ExperimentEndpoint struct {
+	Name      string         `json:"name"`
+	Requests  int            `json:"requests"`
+	Errors    int            `json:"errors"`
+	Ejections int            `json:"ejections,omitempty"`
+	LatencyMS LatencySummary `json:"latencyMS"`
+}
+
+type ExperimentResults struct {
+	StartedAt time.Time        `json:"startedAt"`
+	Matrix    ExperimentMatrix `json:"matrix"`
+	Cells     []ExperimentCell `json:"cells"`
+}
+
+type LatencySummary struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func runExperimentCommand(args []string) int {
+	flags := flag.NewFlagSet("experiment", flag.ContinueOnError)
+	matrixPath := flags.String("matrix", "", "JSON or YAML file describing the settings to combine")
+	outPath := flags.String("out", "experiment-results.json", "where to write the results as JSON")
+	logLevel := flags.String("log-level", "fatal", "log level while running; errors are counted in the results either way")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *matrixPath == "" {
+		fmt.Fprintln(os.Stderr, "experiment: -matrix is required")
+		return 2
+	}
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "experiment:", err)
+		return 2
+	}
+	log.SetLevel(level)
+
+	var matrix ExperimentMatrix
+	if err := decodeFile(*matrixPath, &matrix); err != nil {
+		fmt.Fprintln(os.Stderr, "experiment:", err)
+		return 1
+	}
+	results, err := RunExperiment(matrix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "experiment:", err)
+		return 1
+	}
+	out, _ := json.MarshalIndent(results, "", "  ")
+	if err := ioutil.WriteFile(*outPath, out, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "experiment:", err)
+		return 1
+	}
+	WriteExperimentTable(os.Stdout, results)
+	return 0
+}
+
+// experimentBaseConfig mirrors http.DefaultTransport, so anything a matrix doesn't vary is a Go default.
+func experimentBaseConfig() AppConfig {
+	return AppConfig{
+		HTTPClientMaxIdleConnsPerHost:     http.DefaultMaxIdleConnsPerHost,
+		HTTPClientMaxIdleConns:            100,
+		HTTPClientDialerTimeoutMS:         30000,
+		HTTPClientDialerKeepAliveMS:       30000,
+		HTTPClientIdleConnTimeoutMS:       90000,
+		HTTPClientTLSHandshakeTimeoutMS:   10000,
+		HTTPClientExpectContinueTimeoutMS: 1000,
+		HTTPClientTimeoutMS:               0,
+		HTTPClientProtocol:                ProtocolHTTP1,
+		HTTPClientHTTP2Connections:        1,
+		ServiceBalancer:                   BalancerRoundRobin,
+		ServiceBalancerEWMADecayMS:        10000,
+		ServiceOutlierConsecutiveErrors:   5,
+		ServiceOutlierSuccessRateStdev:    1.9,
+		ServiceOutlierLatencyFactor:       3,
+		ServiceOutlierMinRequests:         20,
+		ServiceOutlierIntervalMS:          500,
+		ServiceOutlierBaseEjectionMS:      2000,
+		ServiceOutlierMaxEjectionMS:       10000,
+		ServiceOutlierMaxEjectionPercent:  50,
+	}
+}
+
+// RunExperiment runs every cell of the matrix one after the other.
+func RunExperiment(matrix ExperimentMatrix) (ExperimentResults, error) {
+	results := ExperimentResults{StartedAt: time.Now(), Matrix: matrix}
+	if matrix.FakeConfig == "" {
+		matrix.FakeConfig = "fakes/fake-service.yml"
+	}
+	endpoints, err := LoadFakeEndpoints(matrix.FakeConfig)
+	if err != nil {
+		return results, err
+	}
+	if len(endpoints) == 0 {
+		return results, fmt.Errorf("%s has no endpoints", matrix.FakeConfig)
+	}
+	for _, network := range matrix.Networks {
+		if network != "tcp" && network != "unix" {
+			return results, fmt.Errorf("network %q is not tcp or unix", network)
+		}
+		if network == "unix" && matrix.TLS {
+			return results, errors.New("the fake upstream only serves TLS over tcp")
+		}
+	}
+	for _, proxy := range matrix.Proxies {
+		if proxy != "none" && proxy != proxySchemeHTTP && proxy != proxySchemeSOCKS5 {
+			return results, fmt.Errorf("proxy %q is not none, http or socks5", proxy)
+		}
+		for _, network := range matrix.Networks {
+			if network == "unix" && proxy != "none" {
+				return results, errors.New("a proxy can't be used with the unix network")
+			}
+		}
+	}
+	if len(matrix.Endpoints) > 0 {
+		if len(matrix.LatencyProfiles) > 0 {
+			return results, errors.New("latencyProfiles can't be combined with endpoints, give each endpoint its own profile")
+		}
+		if matrix.TLS || len(matrix.Networks) > 0 {
+			return results, errors.New("endpoints are only served as plain http over tcp")
+		}
+	}
+	for _, balancer := range matrix.Balancers {
+		if _, ok := balancingStrategies[balancer]; !ok {
+			return results, fmt.Errorf("balancer %q is not one of %s", balancer, balancerNames())
+		}
+	}
+	for _, outlierDetection := range matrix.OutlierDetection {
+		if outlierDetection && len(matrix.Endpoints) < 2 {
+			return results, errors.New("outlierDetection needs at least two endpoints")
+		}
+	}
+	base := experimentBaseConfig()
+	profiles := matrix.LatencyProfiles
+	if len(profiles) == 0 {
+		profiles = []LatencyProfile{{Name: "none"}}
+	}
+	if len(matrix.Endpoints) > 0 {
+		var names []string
+		for _, endpoint := range matrix.Endpoints {
+			names = append(names, endpoint.Name)
+		}
+		profiles = []LatencyProfile{{Name: strings.Join(names, "+")}}
+	}
+	for _, maxIdleConnsPerHost := range intsOrDefault(matrix.MaxIdleConnsPerHost, base.HTTPClientMaxIdleConnsPerHost) {
+		for _, idleConnTimeoutMS := range intsOrDefault(matrix.IdleConnTimeoutMS, base.HTTPClientIdleConnTimeoutMS) {
+			for _, timeoutMS := range intsOrDefault(matrix.TimeoutMS, base.HTTPClientTimeoutMS) {
+				for _, protocol := range stringsOrDefault(matrix.Protocols, base.HTTPClientProtocol) {
+					for _, sessionCacheSize := range intsOrDefault(matrix.TLSSessionCacheSize, base.HTTPClientTLSSessionCacheSize) {
+						for _, network := range stringsOrDefault(matrix.Networks, "tcp") {
+							for _, proxy := range stringsOrDefault(matrix.Proxies, "none") {
+								for _, balancer := range stringsOrDefault(matrix.Balancers, base.ServiceBalancer) {
+									for _, outlierDetection := range boolsOrDefault(matrix.OutlierDetection, base.ServiceOutlierDetection) {
+										for _, profile := range profiles {
+											monkey, err := profileMonkey(profile)
+											if err != nil {
+												return results, err
+											}
+											settings := ExperimentSettings{
+												MaxIdleConnsPerHost: maxIdleConnsPerHost,
+												IdleConnTimeoutMS:   idleConnTimeoutMS,
+												TimeoutMS:           timeoutMS,
+												Protocol:            protocol,
+												TLSSessionCacheSize: sessionCacheSize,
+												Network:             network,
+												Proxy:               proxy,
+												Balancer:            balancer,
+												OutlierDetection:    outlierDetection,
+												LatencyProfile:      profile.Name,
+											}
+											cell, err := runExperimentCell(matrix, endpoints, monkey, settings)
+											if err != nil {
+												return results, err
+											}
+											results.Cells = append(results.Cells, cell)
+										}
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return results, nil
+}
+
+// profileMonkey is a latency profile's monkey rules, loading them from its MonkeyFile if it has one.
+func profileMonkey(profile LatencyProfile) ([]MonkeyRule, error) {
+	if profile.MonkeyFile != "" {
+		return LoadMonkeyRules(profile.MonkeyFile)
+	}
+	return profile.Monkey, nil
+}
+
+func runExperimentCell(matrix ExperimentMatrix, endpoints []FakeEndpoint, monkey []MonkeyRule, settings ExperimentSettings) (ExperimentCell, error) {
+	cell := ExperimentCell{
+		Name:     experimentCellName(matrix, settings),
+		Settings: settings,
+		Requests: matrix.Requests,
+		Errors:   map[string]int{},
+	}
+	monkeys := [][]MonkeyRule{monkey}
+	if len(matrix.Endpoints) > 0 {
+		monkeys = nil
+		for _, profile := range matrix.Endpoints {
+			endpointMonkey, err := profileMonkey(profile)
+			if err != nil {
+				return cell, err
+			}
+			monkeys = append(monkeys, endpointMonkey)
+		}
+	}
+	var upstreams []*FakeUpstream
+	for _, monkey := range monkeys {
+		upstream := NewFakeUpstream(endpoints, monkey)
+		upstream.TLS = matrix.TLS
+		if settings.Network == "unix" {
+			dir, err := ioutil.TempDir("", "fake-upstream")
+			if err != nil {
+				return cell, err
+			}
+			defer os.RemoveAll(dir)
+			upstream.SocketPath = filepath.Join(dir, "fake.sock")
+		}
+		if err := upstream.Start(); err != nil {
+			return cell, err
+		}
+		defer upstream.Close()
+		upstreams = append(upstreams, upstream)
+	}
+	upstream := upstreams[0]
+
+	config := experimentBaseConfig()
+	config.HTTPClientMaxIdleConnsPerHost = settings.MaxIdleConnsPerHost
+	config.HTTPClientIdleConnTimeoutMS = settings.IdleConnTimeoutMS
+	config.HTTPClientTimeoutMS = settings.TimeoutMS
+	config.HTTPClientProtocol = settings.Protocol
+	config.HTTPClientTLSCAFile = upstream.CAFile
+	config.HTTPClientTLSSessionCacheSize = settings.TLSSessionCacheSize
+	config.ServiceBaseURL = upstream.URL + endpoints[0].Request.URI
+	if upstream.SocketPath != "" {
+		config.ServiceBaseURL, config.ServicePath = upstream.URL, endpoints[0].Request.URI
+	}
+	if len(matrix.Endpoints) > 0 {
+		for _, endpointUpstream := range upstreams {
+			config.ServiceEndpoints = append(config.ServiceEndpoints, strings.TrimPrefix(endpointUpstream.URL, "http://"))
+		}
+	}
+	if settings.Balancer != "" {
+		config.ServiceBalancer = settings.Balancer
+	}
+	config.ServiceOutlierDetection = settings.OutlierDetection
+	balancer, err := NewBalancer(&config)
+	if err != nil {
+		return cell, err
+	}
+	outliers := NewOutlierDetector(&config, balancer)
+	outliers.Start()
+	defer outliers.Stop()
+	if settings.Proxy != "" && settings.Proxy != "none" {
+		proxy := NewFakeProxy("", "")
+		if err := proxy.Start("127.0.0.1:0"); err != nil {
+			return cell, err
+		}
+		defer proxy.Close()
+		config.HTTPClientProxyURL = settings.Proxy + "://" + proxy.Addr
+	}
+	conns := NewConnRegistry()
+	httpClient := NewHTTPClient(&config, conns)
+	defer httpClient.CloseIdleConnections()
+
+	collector := &traceCollector{}
+	service := Service{Endpoints: balancer, HttpClient: httpClient, TraceRecorder: collector}
+	loadGenerator := LoadGenerator{Requests: matrix.Requests, Concurrency: matrix.Concurrency, RequestIDPrefix: cell.Name + "-"}
+	elapsed := loadGenerator.Run(service)
+
+	latencies := make([]float64, 0, len(collector.traces))
+	phases := make(map[string][]float64)
+	handshakes := make(map[string][]float64)
+	byEndpoint := make(map[string][]*RequestTrace)
+	gotConn := 0
+	for _, trace := range collector.traces {
+		latencies = append(latencies, durationMS(trace.Duration()))
+		byEndpoint[trace.Endpoint] = append(byEndpoint[trace.Endpoint], trace)
+		for phase, took := range trace.Phases() {
+			phases[phase] = append(phases[phase], durationMS(took))
+		}
+		if trace.Err != nil {
+			cell.Errors[classifyError(trace.Err)]++
+			cell.ErrorCount++
+		}
+		if trace.TLS != nil {
+			kind := "full"
+			if trace.TLS.Resumed {
+				kind = "resumed"
+				cell.ResumedHandshakes++
+			} else {
+				cell.FullHandshakes++
+			}
+			handshakes[kind] = append(handshakes[kind], durationMS(trace.Phases()["tls"]))
+		}
+		if trace.GotConn {
+			gotConn++
+		}
+	}
+	// GotConn's Reused is false for every call that shares a new HTTP/2 connection, so dials are counted
+	// where they happen instead, and every other call that got a connection reused one.
+	cell.NewDials = int(conns.Opened())
+	if gotConn > cell.NewDials {
+		cell.Reuses = gotConn - cell.NewDials
+	}
+	cell.LatencyMS = summarizeLatencies(latencies)
+	cell.LatencySamplesMS = latencies
+	cell.PhasesMS = make(map[string]LatencySummary, len(phases))
+	for phase, samples := range phases {
+		cell.PhasesMS[phase] = summarizeLatencies(samples)
+	}
+	if len(handshakes) > 0 {
+		cell.HandshakeMS = make(map[string]LatencySummary, len(handshakes))
+		for kind, samples := range handshakes {
+			cell.HandshakeMS[kind] = summarizeLatencies(samples)
+		}
+	}
+	if len(matrix.Endpoints) > 0 {
+		ejections := make(map[string]int)
+		for _, ejection := range outliers.Ejections() {
+			ejections[ejection.Endpoint]++
+		}
+		for i, endpoint := range balancer.Endpoints() {
+			result := ExperimentEndpoint{Name: fmt.Sprintf("%d-%s", i, matrix.Endpoints[i].Name), Ejections: ejections[endpoint.Address]}
+			var endpointLatencies []float64
+			for _, trace := range byEndpoint[endpoint.Address] {
+				result.Requests++
+				if trace.Err != nil {
+					result.Errors++
+				}
+				endpointLatencies = append(endpointLatencies, durationMS(trace.Duration()))
+			}
+			result.LatencyMS = summarizeLatencies(endpointLatencies)
+			cell.Endpoints = append(cell.Endpoints, result)
+		}
+	}
+	for _, endpointUpstream := range upstreams {
+		cell.PeakOpenConnections += endpointUpstream.PeakOpenConnections()
+	}
+	cell.DurationMS = durationMS(elapsed)
+	if elapsed > 0 {
+		cell.RequestsPerSecond = float64(matrix.Requests) / elapsed.Seconds()
+	}
+	log.WithFields(map[string]interface{}{
+		"cell":   cell.Name,
+		"errors": cell.ErrorCount,
+		"p99":    cell.LatencyMS.P99,
+	}).Info("Experiment cell done")
+	return cell, nil
+}
+
+// WriteExperimentTable writes one row per cell, lined up for reading in a terminal.
+func WriteExperimentTable(w io.Writer, results ExperimentResults) {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "maxidle/host\tidletimeout\ttimeout\tprotocol\tnetwork\tproxy\tbalancer\toutliers\tprofile\treqs\terrors\tp50\tp90\tp99\tmax\tdials\treuses\tpeakconns\treq/s\t")
+	for _, cell := range results.Cells {
+		fmt.Fprintf(table, "%d\t%dms\t%dms\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%.1f\t%.1f\t%.1f\t%.1f\t%d\t%d\t%d\t%.0f\t\n",
+			cell.Settings.MaxIdleConnsPerHost,
+			cell.Settings.IdleConnTimeoutMS,
+			cell.Settings.TimeoutMS,
+			cell.Settings.Protocol,
+			cell.Settings.Network,
+			cell.Settings.Proxy,
+			cell.Settings.Balancer,
+			onOff(cell.Settings.OutlierDetection),
+			cell.Settings.LatencyProfile,
+			cell.Requests,
+			formatErrorClasses(cell),
+			cell.LatencyMS.P50,
+			cell.LatencyMS.P90,
+			cell.LatencyMS.P99,
+			cell.LatencyMS.Max,
+			cell.NewDials,
+			cell.Reuses,
+			cell.PeakOpenConnections,
+			cell.RequestsPerSecond)
+	}
+	table.Flush()
+	if results.Matrix.TLS {
+		writeHandshakeTable(w, results)
+	}
+	if len(results.Matrix.Endpoints) > 0 {
+		writeEndpointTable(w, results)
+	}
+}
+
+// writeEndpointTable shows how each cell shared the calls out over the endpoints, and how each endpoint did.
+func writeEndpointTable(w io.Writer, results ExperimentResults) {
+	fmt.Fprintln(w)
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "balancer\toutliers\tprofile\tendpoint\treqs\tshare\terrors\tejections\tp50\tp99\t")
+	for _, cell := range results.Cells {
+		for _, endpoint := range cell.Endpoints {
+			share := 0.0
+			if cell.Requests > 0 {
+				share = 100 * float64(endpoint.Requests) / float64(cell.Requests)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\t%.1f%%\t%d\t%d\t%.1f\t%.1f\t\n",
+				cell.Settings.Balancer,
+				onOff(cell.Settings.OutlierDetection),
+				cell.Settings.LatencyProfile,
+				endpoint.Name,
+				endpoint.Requests,
+				share,
+				endpoint.Errors,
+				endpoint.Ejections,
+				endpoint.LatencyMS.P50,
+				endpoint.LatencyMS.P99)
+		}
+	}
+	table.Flush()
+}
+
+// writeHandshakeTable compares full and resumed TLS handshakes, cell by cell.
+func writeHandshakeTable(w io.Writer, results ExperimentResults) {
+	fmt.Fprintln(w)
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "cell\tsessioncache\tfull\tresumed\tfull p50\tfull p99\tresumed p50\tresumed p99\t")
+	for _, cell := range results.Cells {
+		full, resumed := cell.HandshakeMS["full"], cell.HandshakeMS["resumed"]
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%.2f\t%.2f\t%.2f\t%.2f\t\n",
+			cell.Name,
+			cell.Settings.TLSSessionCacheSize,
+			cell.FullHandshakes,
+			cell.ResumedHandshakes,
+			full.P50,
+			full.P99,
+			resumed.P50,
+			resumed.P99)
+	}
+	table.Flush()
+}
+
+func formatErrorClasses(cell ExperimentCell) string {
+	if cell.ErrorCount == 0 {
+		return "0"
+	}
+	classes := make([]string, 0, len(cell.Errors))
+	for class, count := range cell.Errors {
+		classes = append(classes, fmt.Sprintf("%s:%d", class, count))
+	}
+	sort.Strings(classes)
+	return strings.Join(classes, ",")
+}
+
+func experimentCellName(matrix ExperimentMatrix, settings ExperimentSettings) string {
+	name := fmt.Sprintf("maxidle%d-idle%dms-timeout%dms-%s",
+		settings.MaxIdleConnsPerHost, settings.IdleConnTimeoutMS, settings.TimeoutMS, settings.LatencyProfile)
+	if settings.Protocol != "" && settings.Protocol != ProtocolHTTP1 {
+		name += "-" + settings.Protocol
+	}
+	if matrix.TLS {
+		name += fmt.Sprintf("-tls-sessioncache%d", settings.TLSSessionCacheSize)
+	}
+	if settings.Network != "" && settings.Network != "tcp" {
+		name += "-" + settings.Network
+	}
+	if settings.Proxy != "" && settings.Proxy != "none" {
+		name += "-proxy-" + settings.Proxy
+	}
+	if settings.Balancer != "" && settings.Balancer != BalancerRoundRobin {
+		name += "-" + settings.Balancer
+	}
+	if settings.OutlierDetection {
+		name += "-outliers"
+	}
+	return name
+}
+
+// classifyError buckets an error from Service.Call into something worth counting.
+func classifyError(err error) string {
+	if err == ErrNon200Response {
+		return "non-200"
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		if urlErr.Timeout() {
+			return "timeout"
+		}
+		err = urlErr.Err
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "timeout"
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		return opErr.Op
+	}
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return "decode"
+	}
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return "eof"
+	}
+	return "other"
+}
+
+func summarizeLatencies(latencies []float64) LatencySummary {
+	if len(latencies) == 0 {
+		return LatencySummary{}
+	}
+	sorted := append([]float64(nil), latencies...)
+	sort.Float64s(sorted)
+	total := 0.0
+	for _, latency := range sorted {
+		total += latency
+	}
+	return LatencySummary{
+		Mean: total / float64(len(sorted)),
+		P50:  percentile(sorted, 50),
+		P90:  percentile(sorted, 90),
+		P95:  percentile(sorted, 95),
+		P99:  percentile(sorted, 99),
+		Max:  sorted[len(sorted)-1],
+	}
+}
+
+// percentile uses the nearest-rank method on already sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func intsOrDefault(values []int, fallback int) []int {
+	if len(values) == 0 {
+		return []int{fallback}
+	}
+	return values
+}
+
+func stringsOrDefault(values []string, fallback string) []string {
+	if len(values) == 0 {
+		return []string{fallback}
+	}
+	return values
+}
+
+func boolsOrDefault(values []bool, fallback bool) []bool {
+	if len(values) == 0 {
+		return []bool{fallback}
+	}
+	return values
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// traceCollector is a TraceRecorder that keeps every trace in memory for summarising later.
+type traceCollector struct {
+	mu     sync.Mutex
+	traces []*RequestTrace
+}
+
+func (c *traceCollector) Record(trace *RequestTrace) {
+	c.mu.Lock()
+	c.traces = append(c.traces, trace)
+	c.mu.Unlock()
+}
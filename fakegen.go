@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// monkeyBands split observed latencies for fitting monkey rules: the fastest half, then up to p90, p99,
+// and the slowest 1%. Each band becomes a rule delaying by the band's median, so the fake keeps the tail.
+var monkeyBands = []float64{0, 0.5, 0.9, 0.99, 1}
+
+func runGenerateFakesCommand(args []string) int {
+	flags := flag.NewFlagSet("generate-fakes", flag.ContinueOnError)
+	recordingPath := flags.String("recording", "", "JSONL traffic recording made with RECORD_FILE")
+	fakeOut := flags.String("fake-out", "fakes/fake-service.yml", "where to write the fake-service endpoints")
+	monkeyOut := flags.String("monkey-out", "fakes/monkey.yml", "where to write the fitted latency profile")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *recordingPath == "" {
+		fmt.Fprintln(os.Stderr, "generate-fakes: -recording is required")
+		return 2
+	}
+	records, err := ReadTrafficRecords(*recordingPath, UpstreamRecord)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "generate-fakes:", err)
+		return 1
+	}
+	endpoints := FakeEndpointsFromRecords(records)
+	if len(endpoints) == 0 {
+		fmt.Fprintln(os.Stderr, "generate-fakes: no successful upstream exchanges in", *recordingPath)
+		return 1
+	}
+	latencies := upstreamLatencies(records)
+	rules := FitMonkeyRules(latencies)
+
+	if err := writeFile(*fakeOut, func(w io.Writer) error { return WriteFakeEndpointsYAML(w, endpoints) }); err != nil {
+		fmt.Fprintln(os.Stderr, "generate-fakes:", err)
+		return 1
+	}
+	if err := writeFile(*monkeyOut, func(w io.Writer) error { WriteMonkeyRulesYAML(w, rules); return nil }); err != nil {
+		fmt.Fprintln(os.Stderr, "generate-fakes:", err)
+		return 1
+	}
+	observed := summarizeLatencies(latencies)
+	fmt.Printf("wrote %d endpoints to %s and %d monkey rules to %s\n", len(endpoints), *fakeOut, len(rules), *monkeyOut)
+	fmt.Printf("observed upstream latency ms from %d exchanges: p50 %.1f p90 %.1f p99 %.1f max %.1f\n",
+		len(latencies), observed.P50, observed.P90, observed.P99, observed.Max)
+	return 0
+}
+
+func writeFile(path string, write func(io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(file)
+	if err := write(out); err != nil {
+		file.Close()
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// FakeEndpointsFromRecords makes one endpoint per method and path seen, answering with the response
+// the upstream gave most often. Exchanges that failed before getting a response are ignored.
+func FakeEndpointsFromRecords(records []TrafficRecord) []FakeEndpoint {
+	type response struct {
+		code        int
+		body        string
+		contentType string
+	}
+	type route struct {
+		method string
+		path   string
+	}
+	counts := make(map[route]map[response]int)
+	var routes []route
+	for _, record := range records {
+		if record.StatusCode == 0 {
+			continue
+		}
+		path := record.URL
+		if parsed, err := url.Parse(record.URL); err == nil {
+			path = parsed.Path
+		}
+		r := route{record.Method, path}
+		if counts[r] == nil {
+			counts[r] = make(map[response]int)
+			routes = append(routes, r)
+		}
+		counts[r][response{record.StatusCode, record.ResponseBody, record.ResponseHeaders.Get("Content-Type")}]++
+	}
+
+	var endpoints []FakeEndpoint
+	for _, r := range routes {
+		var best response
+		bestCount := 0
+		for resp, count := range counts[r] {
+			if count > bestCount || count == bestCount && resp.body < best.body {
+				best, bestCount = resp, count
+			}
+		}
+		endpoint := FakeEndpoint{
+			Name: fmt.Sprintf("recorded %s %s", r.method, r.path),
+			Request: FakeRequest{
+				URI:     r.path,
+				Method:  r.method,
+				Headers: map[string]string{"content-type": "application/json"},
+				Body:    "*",
+			},
+			Response: FakeResponse{Code: best.code, Body: best.body},
+		}
+		if best.contentType != "" {
+			endpoint.Response.Headers = map[string]string{"content-type": best.contentType}
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+// upstreamLatencies estimates how long the upstream itself took for each exchange: from finishing writing
+// the request to the first byte of the response, which leaves out connection setup on our side.
+func upstreamLatencies(records []TrafficRecord) []float64 {
+	var latencies []float64
+	for _, record := range records {
+		if record.StatusCode == 0 {
+			continue
+		}
+		wrote, okWrote := record.Timings["wroterequest"]
+		firstByte, okFirstByte := record.Timings["gotfirstresponsebyte"]
+		if okWrote && okFirstByte {
+			latencies = append(latencies, durationMS(firstByte.Sub(wrote)))
+		} else {
+			latencies = append(latencies, record.DurationMS)
+		}
+	}
+	return latencies
+}
+
+// FitMonkeyRules turns observed latencies into rules for FakeUpstream, which applies the first rule that fires.
+// Rules go slowest band first, each with its frequency conditional on the slower rules not having fired,
+// so overall every band gets its share of requests.
+func FitMonkeyRules(latencies []float64) []MonkeyRule {
+	if len(latencies) == 0 {
+		return nil
+	}
+	sorted := append([]float64(nil), latencies...)
+	sort.Float64s(sorted)
+	var rules []MonkeyRule
+	remaining := 1.0
+	for band := len(monkeyBands) - 1; band > 0; band-- {
+		from := int(monkeyBands[band-1] * float64(len(sorted)))
+		until := int(monkeyBands[band] * float64(len(sorted)))
+		if until <= from {
+			continue
+		}
+		share := float64(until-from) / float64(len(sorted))
+		frequency := 1.0
+		if band > 1 {
+			frequency = share / remaining
+		}
+		rules = append(rules, MonkeyRule{
+			Delay:     int(sorted[from+(until-from)/2] + 0.5),
+			Frequency: frequency,
+		})
+		remaining -= share
+	}
+	return rules
+}
+
+// WriteFakeEndpointsYAML writes endpoints in the mockingjay format used by fakes/fake-service.yml.
+func WriteFakeEndpointsYAML(w io.Writer, endpoints []FakeEndpoint) error {
+	data, err := yaml.Marshal(endpoints)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "---\n%s", data)
+	return err
+}
+
+// WriteMonkeyRulesYAML writes rules in the format used by fakes/monkey.yml.
+func WriteMonkeyRulesYAML(w io.Writer, rules []MonkeyRule) {
+	fmt.Fprintln(w, "---")
+	for _, rule := range rules {
+		fmt.Fprintf(w, "- delay: %d\n", rule.Delay)
+		fmt.Fprintf(w, "  frequency: %.4g\n", rule.Frequency)
+	}
+}
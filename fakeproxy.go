@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FakeProxy is a minimal outbound proxy for trying HTTP_CLIENT_PROXY_URL out locally. One port speaks
+// both HTTP, tunnelling CONNECTs and forwarding plain http calls, and SOCKS5, connect only, telling them
+// apart by the first byte a client sends. With Username set, clients have to give it and Password.
+type FakeProxy struct {
+	Username string
+	Password string
+	// Addr is the host:port it's listening on, for http:// and socks5:// proxy URLs alike.
+	Addr string
+
+	listener  net.Listener
+	transport *http.Transport
+	conns     int64
+	tunnels   int64
+	mu        sync.Mutex
+	open      map[net.Conn]struct{}
+}
+
+func NewFakeProxy(username, password string) *FakeProxy {
+	return &FakeProxy{Username: username, Password: password, transport: &http.Transport{}, open: map[net.Conn]struct{}{}}
+}
+
+// Start listens on address, "127.0.0.1:0" for a random port, and serves in the background; Addr is set once it returns.
+func (p *FakeProxy) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	p.listener = listener
+	p.Addr = listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&p.conns, 1)
+			go p.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Close stops listening and cuts every connection still open, tunnels included.
+func (p *FakeProxy) Close() error {
+	if p.listener == nil {
+		return nil
+	}
+	err := p.listener.Close()
+	p.mu.Lock()
+	for conn := range p.open {
+		conn.Close()
+	}
+	p.mu.Unlock()
+	p.transport.CloseIdleConnections()
+	return err
+}
+
+// Connections is how many client connections the proxy has accepted, and Tunnels how many of them it connected onwards.
+func (p *FakeProxy) Connections() int64 {
+	return atomic.LoadInt64(&p.conns)
+}
+
+func (p *FakeProxy) Tunnels() int64 {
+	return atomic.LoadInt64(&p.tunnels)
+}
+
+func (p *FakeProxy) track(conn net.Conn, open bool) {
+	p.mu.Lock()
+	if open {
+		p.open[conn] = struct{}{}
+	} else {
+		delete(p.open, conn)
+	}
+	p.mu.Unlock()
+}
+
+func (p *FakeProxy) serve(conn net.Conn) {
+	p.track(conn, true)
+	defer p.track(conn, false)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == socksVersion {
+		p.serveSOCKS(conn, reader)
+	} else {
+		p.serveHTTP(conn, reader)
+	}
+}
+
+// serveHTTP answers proxy requests on conn until the client closes it or a CONNECT turns it into a tunnel.
+func (p *FakeProxy) serveHTTP(conn net.Conn, reader *bufio.Reader) {
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if !p.authorized(req) {
+			resp := &http.Response{StatusCode: http.StatusProxyAuthRequired, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}, Close: true}
+			resp.Header.Set("Proxy-Authenticate", `Basic realm="fake-proxy"`)
+			resp.Write(conn)
+			return
+		}
+		if req.Method == http.MethodConnect {
+			upstream, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+				return
+			}
+			fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			p.tunnel(conn, reader, upstream)
+			return
+		}
+		if req.URL.Host == "" {
+			resp := &http.Response{StatusCode: http.StatusBadRequest, ProtoMajor: 1, ProtoMinor: 1, Close: true}
+			resp.Write(conn)
+			return
+		}
+		req.RequestURI = ""
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Proxy-Connection")
+		resp, err := p.transport.RoundTrip(req)
+		if err != nil {
+			resp = &http.Response{StatusCode: http.StatusBadGateway, ProtoMajor: 1, ProtoMinor: 1, Close: true}
+		}
+		err = resp.Write(conn)
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+func (p *FakeProxy) authorized(req *http.Request) bool {
+	if p.Username == "" {
+		return true
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+	return req.Header.Get("Proxy-Authorization") == "Basic "+credentials
+}
+
+// serveSOCKS answers a SOCKS5 connect request and tunnels the connection to where it asks for.
+func (p *FakeProxy) serveSOCKS(conn net.Conn, reader *bufio.Reader) {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(reader, greeting); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return
+	}
+	method := byte(socksAuthNone)
+	if p.Username != "" {
+		method = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return
+	}
+	conn.Write([]byte{socksVersion, method})
+	if method == socksAuthPassword && !p.socksAuthorized(conn, reader) {
+		return
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	address, err := readSocksAddress(reader, header[3])
+	if err != nil {
+		conn.Write([]byte{socksVersion, 8, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	if header[1] != socksCommandConnect {
+		conn.Write([]byte{socksVersion, 7, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	upstream, err := net.Dial("tcp", address)
+	if err != nil {
+		conn.Write([]byte{socksVersion, 5, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	bound, _ := socksAddress(upstream.LocalAddr().String())
+	conn.Write(append([]byte{socksVersion, 0, 0}, bound...))
+	p.tunnel(conn, reader, upstream)
+}
+
+// socksAuthorized checks the username and password a SOCKS5 client sends, and tells it the outcome.
+func (p *FakeProxy) socksAuthorized(conn net.Conn, reader *bufio.Reader) bool {
+	var fields [2]string
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(reader, version); err != nil {
+		return false
+	}
+	for i := range fields {
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(reader, size); err != nil {
+			return false
+		}
+		field := make([]byte, size[0])
+		if _, err := io.ReadFull(reader, field); err != nil {
+			return false
+		}
+		fields[i] = string(field)
+	}
+	if fields[0] != p.Username || fields[1] != p.Password {
+		conn.Write([]byte{1, 1})
+		return false
+	}
+	conn.Write([]byte{1, 0})
+	return true
+}
+
+// tunnel copies both ways between the client and upstream until either side closes.
+// Anything the client sent that reader has already buffered goes first.
+func (p *FakeProxy) tunnel(conn net.Conn, reader *bufio.Reader, upstream net.Conn) {
+	atomic.AddInt64(&p.tunnels, 1)
+	p.track(upstream, true)
+	defer p.track(upstream, false)
+	defer upstream.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// runProxyCommand runs a FakeProxy until it's interrupted.
+func runProxyCommand(args []string) int {
+	flags := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:3128", "address to listen on, for both HTTP and SOCKS5 clients")
+	username := flags.String("user", "", "username clients must give, if any")
+	password := flags.String("password", "", "password clients must give along with -user")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	proxy := NewFakeProxy(*username, *password)
+	if err := proxy.Start(*addr); err != nil {
+		fmt.Fprintln(os.Stderr, "proxy:", err)
+		return 1
+	}
+	defer proxy.Close()
+	log.WithFields(map[string]interface{}{
+		"http":   "http://" + proxy.Addr,
+		"socks5": "socks5://" + proxy.Addr,
+	}).Info("Proxy listening")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
+	log.WithFields(map[string]interface{}{
+		"connections": proxy.Connections(),
+		"tunnels":     proxy.Tunnels(),
+	}).Info("Proxy stopped")
+	return 0
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FakeEndpoint is one entry in a mockingjay config such as fakes/fake-service.yml.
+type FakeEndpoint struct {
+	Name        string       `json:"name" yaml:"name"`
+	CDCDisabled bool         `json:"cdcdisabled" yaml:"cdcdisabled"`
+	Request     FakeRequest  `json:"request" yaml:"request"`
+	Response    FakeResponse `json:"response" yaml:"response"`
+}
+
+type FakeRequest struct {
+	URI     string            `json:"uri" yaml:"uri"`
+	Method  string            `json:"method" yaml:"method"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Body    string            `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+type FakeResponse struct {
+	Code    int               `json:"code" yaml:"code"`
+	Body    string            `json:"body" yaml:"body"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+}
+
+// MonkeyRule is one entry in a mockingjay monkey config such as fakes/monkey.yml:
+// delay the response by Delay milliseconds for the given fraction of requests, and if Status
+// is set, answer with it and no body instead of the configured response.
+type MonkeyRule struct {
+	Delay     int     `json:"delay"`
+	Status    int     `json:"status,omitempty"`
+	Frequency float64 `json:"frequency"`
+}
+
+func LoadFakeEndpoints(path string) ([]FakeEndpoint, error) {
+	var endpoints []FakeEndpoint
+	err := decodeFile(path, &endpoints)
+	return endpoints, err
+}
+
+func LoadMonkeyRules(path string) ([]MonkeyRule, error) {
+	var rules []MonkeyRule
+	err := decodeFile(path, &rules)
+	return rules, err
+}
+
+// FakeUpstream is an in-process stand-in for fake-service: it answers the endpoints from a
+// mockingjay config, delayed according to monkey rules, and counts the connections it holds open.
+type FakeUpstream struct {
+	Endpoints []FakeEndpoint
+	Monkey    []MonkeyRule
+	// TLS serves https with a certificate from a throwaway CA, written to CAFile by Start.
+	TLS bool
+	// SocketPath has it listen on a Unix socket instead of a loopback port, and URL be unix://SocketPath.
+	SocketPath string
+	URL        string
+	CAFile     string
+
+	server    *http.Server
+	listener  net.Listener
+	certDir   string
+	openConns int64
+	peakConns int64
+	connsMu   sync.Mutex
+}
+
+func NewFakeUpstream(endpoints []FakeEndpoint, monkey []MonkeyRule) *FakeUpstream {
+	return &FakeUpstream{Endpoints: endpoints, Monkey: monkey}
+}
+
+// Start listens on a random loopback port, or SocketPath, and serves in the background; URL is set once it returns.
+// It speaks HTTP/1.1 and HTTP/2: over TLS if TLS is set, otherwise for clients that start with it (h2c).
+func (f *FakeUpstream) Start() error {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	f.server = &http.Server{Handler: f, ConnState: f.trackConnState, Protocols: protocols}
+	scheme := "http"
+	if f.TLS {
+		if err := f.generateCert(); err != nil {
+			return err
+		}
+		scheme = "https"
+	}
+	network, address := "tcp", "127.0.0.1:0"
+	if f.SocketPath != "" {
+		network, address, scheme = "unix", f.SocketPath, unixScheme
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	f.listener = listener
+	f.URL = scheme + "://" + listener.Addr().String()
+	if f.TLS {
+		go f.server.ServeTLS(listener, "", "")
+	} else {
+		go f.server.Serve(listener)
+	}
+	return nil
+}
+
+// generateCert makes a CA and a server certificate signed by it in a temporary directory.
+func (f *FakeUpstream) generateCert() error {
+	dir, err := ioutil.TempDir("", "fake-upstream-certs")
+	if err != nil {
+		return err
+	}
+	f.certDir = dir
+	if err := GenerateCerts(dir, []string{"127.0.0.1", "localhost"}); err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	if err != nil {
+		return err
+	}
+	f.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	f.CAFile = filepath.Join(dir, "ca.pem")
+	return nil
+}
+
+func (f *FakeUpstream) Close() error {
+	if f.certDir != "" {
+		os.RemoveAll(f.certDir)
+	}
+	if f.server == nil {
+		return nil
+	}
+	return f.server.Close()
+}
+
+// PeakOpenConnections is the most connections that were open at once since Start.
+func (f *FakeUpstream) PeakOpenConnections() int64 {
+	return atomic.LoadInt64(&f.peakConns)
+}
+
+// OpenConnections is how many connections are open now.
+func (f *FakeUpstream) OpenConnections() int64 {
+	f.connsMu.Lock()
+	defer f.connsMu.Unlock()
+	return f.openConns
+}
+
+func (f *FakeUpstream) trackConnState(conn net.Conn, state http.ConnState) {
+	f.connsMu.Lock()
+	defer f.connsMu.Unlock()
+	switch state {
+	case http.StateNew:
+		f.openConns++
+		if f.openConns > f.peakConns {
+			atomic.StoreInt64(&f.peakConns, f.openConns)
+		}
+	case http.StateClosed, http.StateHijacked:
+		f.openConns--
+	}
+}
+
+func (f *FakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	endpoint, ok := f.match(r, string(body))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rule := f.monkey()
+	if rule.Delay > 0 {
+		select {
+		case <-time.After(time.Duration(rule.Delay) * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if rule.Status != 0 {
+		w.WriteHeader(rule.Status)
+		return
+	}
+	for name, value := range endpoint.Response.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(endpoint.Response.Code)
+	w.Write([]byte(endpoint.Response.Body))
+}
+
+func (f *FakeUpstream) match(r *http.Request, body string) (FakeEndpoint, bool) {
+	for _, endpoint := range f.Endpoints {
+		if !strings.EqualFold(endpoint.Request.Method, r.Method) || endpoint.Request.URI != r.URL.Path {
+			continue
+		}
+		if endpoint.Request.Body != "" && endpoint.Request.Body != "*" && endpoint.Request.Body != body {
+			continue
+		}
+		headersMatch := true
+		for name, value := range endpoint.Request.Headers {
+			if !strings.EqualFold(r.Header.Get(name), value) {
+				headersMatch = false
+			}
+		}
+		if headersMatch {
+			return endpoint, true
+		}
+	}
+	return FakeEndpoint{}, false
+}
+
+// monkey is the first monkey rule that fires, checking them in order, or no rule if none does.
+func (f *FakeUpstream) monkey() MonkeyRule {
+	for _, rule := range f.Monkey {
+		if rand.Float64() < rule.Frequency {
+			return rule
+		}
+	}
+	return MonkeyRule{}
+}
@@ -3,27 +3,61 @@ package main
 import (
 	"fmt"
 	"github.com/satori/go.uuid"
-	log "github.com/sirupsen/logrus"
+	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 // HTTPClientTestHandler handles requests
 type HTTPClientTestHandler struct {
 	Service Service
+	// TrafficRecorder, when set, gets every request to /api and our response.
+	TrafficRecorder *TrafficRecorder
+	// LogControl, when set, decides which requests get debug logs whatever the log level.
+	LogControl *LogControl
 }
 
 // ServeHTTP serves HTTP
 func (handler HTTPClientTestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	u1 := uuid.NewV4()
 	serviceRequest := &ServiceRequest{RequestID: u1.String()}
-	log.WithField("requestid", serviceRequest.RequestID).Debug("About to do service.Call")
+	if handler.LogControl != nil {
+		serviceRequest.Debug = handler.LogControl.DebugRequest(r)
+	}
+	logger := requestLogger(serviceRequest.RequestID, serviceRequest.Debug)
+	logger.Debug("About to do service.Call")
 	serviceResponse, err := handler.Service.Call(*serviceRequest)
-	log.WithField("requestid", serviceRequest.RequestID).Debug("Got response from service.Call")
+	logger.Debug("Got response from service.Call")
 	if err != nil {
-		log.WithField("requestid", serviceRequest.RequestID).Error("Error calling service", err)
+		logger.Error("Error calling service", err)
 		w.WriteHeader(500)
+		handler.record(r, start, serviceRequest.RequestID, 500, w.Header(), "", err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprint(w, serviceResponse.String())
+	handler.record(r, start, serviceRequest.RequestID, 200, w.Header(), serviceResponse.String(), nil)
+}
+
+func (handler HTTPClientTestHandler) record(r *http.Request, start time.Time, requestID string, statusCode int, responseHeaders http.Header, responseBody string, err error) {
+	if handler.TrafficRecorder == nil {
+		return
+	}
+	requestBody, _ := ioutil.ReadAll(r.Body)
+	handler.TrafficRecorder.Record(TrafficRecord{
+		Type:            InboundRecord,
+		RequestID:       requestID,
+		Time:            start,
+		DurationMS:      durationMS(time.Since(start)),
+		Method:          r.Method,
+		URL:             r.URL.RequestURI(),
+		RequestHeaders:  r.Header,
+		RequestBody:     string(requestBody),
+		StatusCode:      statusCode,
+		ResponseHeaders: responseHeaders,
+		ResponseBody:    responseBody,
+		Outcome:         outcome(err),
+		Error:           errorString(err),
+	})
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthChecker actively checks every endpoint in a Balancer every Interval, taking an endpoint out of
+// rotation after UnhealthyThreshold failed checks in a row and putting it back after HealthyThreshold
+// passed ones. A check is a GET of Path that has to answer 2xx, or with no Path, opening a connection.
+type HealthChecker struct {
+	Balancer           *Balancer
+	Interval           time.Duration
+	Timeout            time.Duration
+	Path               string
+	UnhealthyThreshold int
+	HealthyThreshold   int
+	// HTTPClient makes the GET checks. It's separate from the client calls go through, so checks
+	// don't show up in its connection pool or the calls' traces.
+	HTTPClient *http.Client
+	// Proxy, if calls go through one, is where connection checks connect to instead.
+	Proxy *Proxy
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func NewHealthChecker(config *AppConfig, balancer *Balancer) *HealthChecker {
+	proxy, _ := ParseProxy(config.HTTPClientProxyURL, config.HTTPClientNoProxy)
+	checker := &HealthChecker{
+		Balancer:           balancer,
+		Interval:           time.Duration(config.ServiceHealthCheckIntervalMS) * time.Millisecond,
+		Timeout:            time.Duration(config.ServiceHealthCheckTimeoutMS) * time.Millisecond,
+		Path:               config.ServiceHealthCheckPath,
+		UnhealthyThreshold: config.ServiceUnhealthyThreshold,
+		HealthyThreshold:   config.ServiceHealthyThreshold,
+		Proxy:              proxy,
+	}
+	if checker.Path != "" {
+		checker.HTTPClient = NewHTTPClient(config, nil)
+		checker.HTTPClient.Timeout = checker.Timeout
+	}
+	return checker
+}
+
+// Start checks every endpoint straight away and then every Interval, in the background.
+// An Interval of 0 means no health checks, with every endpoint in rotation.
+func (h *HealthChecker) Start() {
+	if h.Interval == 0 {
+		return
+	}
+	h.Balancer.mu.Lock()
+	h.Balancer.healthChecked = true
+	h.Balancer.mu.Unlock()
+	h.stop, h.stopped = make(chan struct{}), make(chan struct{})
+	go func(stop, stopped chan struct{}) {
+		defer close(stopped)
+		ticker := time.NewTicker(h.Interval)
+		defer ticker.Stop()
+		for {
+			h.CheckAll()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}(h.stop, h.stopped)
+}
+
+// Stop stops checking the endpoints, waiting for checks already under way. With nothing checking them
+// any more, they're all put back in rotation.
+func (h *HealthChecker) Stop() {
+	if h.stop == nil {
+		return
+	}
+	close(h.stop)
+	<-h.stopped
+	h.stop, h.stopped = nil, nil
+	h.Balancer.mu.Lock()
+	h.Balancer.healthChecked = false
+	h.Balancer.mu.Unlock()
+	for _, endpoint := range h.Balancer.Endpoints() {
+		endpoint.mu.Lock()
+		endpoint.healthy, endpoint.healthStreak = true, 0
+		endpoint.mu.Unlock()
+	}
+}
+
+// CheckAll checks the endpoints at the same time, so a slow one doesn't hold up the others.
+func (h *HealthChecker) CheckAll() {
+	var wg sync.WaitGroup
+	for _, endpoint := range h.Balancer.Endpoints() {
+		wg.Add(1)
+		go func(endpoint *Endpoint) {
+			defer wg.Done()
+			h.record(endpoint, h.check(endpoint))
+		}(endpoint)
+	}
+	wg.Wait()
+}
+
+func (h *HealthChecker) check(endpoint *Endpoint) error {
+	if h.Path == "" {
+		network, address := endpoint.dialAddress(h.Proxy)
+		conn, err := net.DialTimeout(network, address, h.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	checkURL, err := healthCheckURL(endpoint.URL, h.Path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", checkURL, nil)
+	if err != nil {
+		return err
+	}
+	if endpoint.Host != "" {
+		req.Host = endpoint.Host
+	}
+	resp, err := h.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// healthCheckURL is an endpoint's URL with path, which can have a query, in place of its own path.
+func healthCheckURL(endpointURL, path string) (string, error) {
+	base, err := url.Parse(endpointURL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse("/" + strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// record counts the check towards the thresholds and logs an endpoint going in or out of rotation.
+func (h *HealthChecker) record(endpoint *Endpoint, err error) {
+	endpoint.mu.Lock()
+	endpoint.lastCheck = time.Now()
+	endpoint.lastCheckError = ""
+	if err != nil {
+		endpoint.lastCheckError = err.Error()
+	}
+	passed := err == nil
+	changed := false
+	if passed == endpoint.healthy {
+		endpoint.healthStreak = 0
+	} else {
+		endpoint.healthStreak++
+		threshold := h.UnhealthyThreshold
+		if passed {
+			threshold = h.HealthyThreshold
+		}
+		if endpoint.healthStreak >= threshold {
+			endpoint.healthy, endpoint.healthStreak, changed = passed, 0, true
+		}
+	}
+	endpoint.mu.Unlock()
+	if !changed {
+		return
+	}
+	fields := map[string]interface{}{"endpoint": endpoint.Address}
+	if passed {
+		log.WithFields(fields).Info("Endpoint passed its health checks, back in rotation")
+	} else {
+		fields["error"] = err.Error()
+		log.WithFields(fields).Warn("Endpoint failed its health checks, out of rotation")
+	}
+}
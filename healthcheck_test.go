@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthThresholds(t *testing.T) {
+	balancer := testBalancer(t, BalancerRoundRobin, "10.0.0.1:80")
+	endpoint := balancer.Endpoints()[0]
+	checker := &HealthChecker{Balancer: balancer, UnhealthyThreshold: 2, HealthyThreshold: 3}
+	failed := errors.New("connection refused")
+	checks := []struct {
+		err         error
+		wantHealthy bool
+	}{
+		{failed, true},
+		// A passed check in between starts the count again.
+		{nil, true},
+		{failed, true},
+		{failed, false},
+		{nil, false},
+		{nil, false},
+		{failed, false},
+		{nil, false},
+		{nil, false},
+		{nil, true},
+	}
+	for i, check := range checks {
+		checker.record(endpoint, check.err)
+		if got := endpoint.Stats().Healthy; got != check.wantHealthy {
+			t.Errorf("after check %d healthy = %v, want %v", i+1, got, check.wantHealthy)
+		}
+	}
+	if got := endpoint.Stats().LastCheckError; got != "" {
+		t.Errorf("lastCheckError is %q after a passed check, want none", got)
+	}
+}
+
+// deadAddress is a loopback address nothing is listening on.
+func deadAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+func TestHealthCheckerChecks(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	healthyAddress, failingAddress, dead := healthy.Listener.Addr().String(), failing.Listener.Addr().String(), deadAddress(t)
+
+	tests := []struct {
+		path        string
+		wantHealthy map[string]bool
+	}{
+		{"", map[string]bool{healthyAddress: true, failingAddress: true, dead: false}},
+		{"/health", map[string]bool{healthyAddress: true, failingAddress: false, dead: false}},
+	}
+	for _, test := range tests {
+		t.Run("path "+test.path, func(t *testing.T) {
+			config := testConfig(t, map[string]string{
+				"SERVICE_HEALTH_CHECK_PATH":                test.path,
+				"SERVICE_HEALTH_CHECK_UNHEALTHY_THRESHOLD": "1",
+			})
+			balancer, err := NewBalancer(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := balancer.SetEndpoints([]string{healthyAddress, failingAddress, dead}); err != nil {
+				t.Fatal(err)
+			}
+			NewHealthChecker(config, balancer).CheckAll()
+			for _, stats := range balancer.Stats() {
+				if stats.Draining {
+					continue
+				}
+				if stats.Healthy != test.wantHealthy[stats.Address] {
+					t.Errorf("%s healthy = %v (%s), want %v", stats.Address, stats.Healthy, stats.LastCheckError, test.wantHealthy[stats.Address])
+				}
+			}
+		})
+	}
+}
+
+func TestHealthCheckerStop(t *testing.T) {
+	listener, _ := acceptRemoteAddrs(t)
+	live, dead := listener.Addr().String(), deadAddress(t)
+	config := testConfig(t, map[string]string{
+		"SERVICE_HEALTH_CHECK_INTERVAL_MS":         "10",
+		"SERVICE_HEALTH_CHECK_UNHEALTHY_THRESHOLD": "1",
+	})
+	balancer, err := NewBalancer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := balancer.SetEndpoints([]string{live, dead}); err != nil {
+		t.Fatal(err)
+	}
+	checker := NewHealthChecker(config, balancer)
+	checker.Start()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if healthy, _ := balancer.Healthy(); healthy == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("endpoints are %+v, want %s out of rotation", balancer.Stats(), dead)
+		}
+	}
+	if counts := pickCounts(balancer, 4); counts[live] != 4 {
+		t.Errorf("calls went to %v, want them all to %s", counts, live)
+	}
+
+	checker.Stop()
+	if balancer.HealthChecked() {
+		t.Error("the balancer is still health checked after Stop")
+	}
+	if healthy, total := balancer.Healthy(); healthy != total {
+		t.Errorf("%d of %d endpoints are in rotation after Stop, want all of them", healthy, total)
+	}
+	lastCheck := *balancer.Endpoints()[0].Stats().LastCheck
+	time.Sleep(50 * time.Millisecond)
+	if got := *balancer.Endpoints()[0].Stats().LastCheck; !got.Equal(lastCheck) {
+		t.Errorf("checked again at %v after Stop", got)
+	}
+	checker.Stop()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// http2Pool is an http.RoundTripper that spreads calls over several HTTP/2 transports, each holding
+// its own connection to the service, sending each call to the one with the fewest streams open.
+// A single HTTP/2 connection multiplexes every call, which puts them all behind one TCP window and
+// one upstream instance behind a load balancer; this trades some of that back for more connections.
+//
+// With MaxStreams set, a connection never has more than that many calls at once, and calls beyond
+// what every connection can take wait their turn, like they would for a connection in HTTP/1.1.
+type http2Pool struct {
+	transports []*http.Transport
+	// slots holds a token per stream in use across all the transports, nil if there's no limit.
+	slots chan struct{}
+
+	mu      sync.Mutex
+	streams []int
+}
+
+func newHTTP2Pool(transports []*http.Transport, maxStreams int) *http2Pool {
+	pool := &http2Pool{transports: transports, streams: make([]int, len(transports))}
+	if maxStreams > 0 {
+		pool.slots = make(chan struct{}, maxStreams*len(transports))
+	}
+	return pool
+}
+
+func (p *http2Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	i := p.acquire()
+	resp, err := p.transports[i].RoundTrip(req)
+	if err != nil {
+		p.release(i)
+		return nil, err
+	}
+	resp.Body = &streamBody{ReadCloser: resp.Body, release: func() { p.release(i) }}
+	return resp, nil
+}
+
+// acquire picks the transport with the fewest streams open. While there's a slot for the call
+// that one always has room, since the slots are MaxStreams per transport.
+func (p *http2Pool) acquire() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	least := 0
+	for i, streams := range p.streams {
+		if streams < p.streams[least] {
+			least = i
+		}
+	}
+	p.streams[least]++
+	return least
+}
+
+func (p *http2Pool) release(i int) {
+	p.mu.Lock()
+	p.streams[i]--
+	p.mu.Unlock()
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+func (p *http2Pool) CloseIdleConnections() {
+	for _, transport := range p.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// streamBody keeps the stream counted as open until the response body is closed.
+type streamBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/viki-org/dnscache"
+)
+
+// dnsResolver is shared by every client so rebuilding the client on a config reload doesn't start another refresher.
+var dnsResolver = dnscache.New(time.Second * 60) //how often to refresh cached dns records, happens in background
+
+// The protocols HTTP_CLIENT_PROTOCOL can ask for.
+const (
+	// ProtocolHTTP1 is HTTP/1.1 only, one call per connection at a time.
+	ProtocolHTTP1 = "http1"
+	// ProtocolHTTP2 is HTTP/2 for https services that offer it, HTTP/1.1 otherwise.
+	ProtocolHTTP2 = "http2"
+	// ProtocolH2C is HTTP/2 without TLS for http services, assuming they speak it ("prior knowledge").
+	ProtocolH2C = "h2c"
+)
+
+// NewHTTPClient builds the http.Client used to call the service from the HTTPClient* settings in config.
+// Every connection it opens is tracked in conns, if that's set.
+func NewHTTPClient(config *AppConfig, conns *ConnRegistry) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(config.HTTPClientDialerTimeoutMS) * time.Millisecond,
+		KeepAlive: time.Duration(config.HTTPClientDialerKeepAliveMS) * time.Millisecond,
+	}
+	options := clientSocketOptions(config)
+	// Validate has already rejected addresses that don't parse.
+	localAddrs, _ := ParseLocalAddrs(config.HTTPClientLocalAddrs)
+	if localAddrs != nil {
+		options.BindAddressNoPort = true
+	}
+	dialer.Control = options.Control
+	tlsConfig, err := NewClientTLSConfig(config)
+	if err != nil {
+		// Validate checks this too, so it only happens if a file changed since.
+		log.WithField("error", err.Error()).Error("Couldn't load the TLS settings, using Go's defaults")
+	}
+	// Validate has already rejected a proxy URL that doesn't parse too.
+	proxy, _ := ParseProxy(config.HTTPClientProxyURL, config.HTTPClientNoProxy)
+	newTransport := func() *http.Transport {
+		transport := &http.Transport{
+			MaxIdleConnsPerHost:   config.HTTPClientMaxIdleConnsPerHost,
+			DialContext:           dialContext(dialer, localAddrs, options, conns),
+			Proxy:                 proxy.transportProxy(),
+			MaxIdleConns:          config.HTTPClientMaxIdleConns,
+			IdleConnTimeout:       time.Duration(config.HTTPClientIdleConnTimeoutMS) * time.Millisecond,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   time.Duration(config.HTTPClientTLSHandshakeTimeoutMS) * time.Millisecond,
+			ExpectContinueTimeout: time.Duration(config.HTTPClientExpectContinueTimeoutMS) * time.Millisecond,
+		}
+		if proxy != nil && proxy.URL.Scheme == proxySchemeSOCKS5 {
+			transport.DialContext = proxy.socksDialContext(transport.DialContext)
+		} else if proxy != nil {
+			transport.GetProxyConnectHeader = markProxyConnect
+			transport.OnProxyConnectResponse = markProxyConnectDone
+		}
+		if socketPath := unixSocketPath(config.ServiceBaseURL); socketPath != "" {
+			transport.DialContext = unixDialContext(dialer.Timeout, socketPath, conns)
+			transport.Proxy = nil
+		}
+		setProtocols(transport, config)
+		return transport
+	}
+	var transport http.RoundTripper = newTransport()
+	if config.HTTPClientProtocol != "" && config.HTTPClientProtocol != ProtocolHTTP1 &&
+		(config.HTTPClientHTTP2Connections > 1 || config.HTTPClientHTTP2MaxConcurrentStreams > 0) {
+		transports := []*http.Transport{transport.(*http.Transport)}
+		for len(transports) < config.HTTPClientHTTP2Connections {
+			transports = append(transports, newTransport())
+		}
+		transport = newHTTP2Pool(transports, config.HTTPClientHTTP2MaxConcurrentStreams)
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(config.HTTPClientTimeoutMS) * time.Millisecond,
+	}
+}
+
+// setProtocols sets which protocols transport speaks, and its HTTP/2 settings, from HTTP_CLIENT_PROTOCOL.
+// Setting our own DialContext stops Go trying HTTP/2 by itself, so it has to be asked for.
+func setProtocols(transport *http.Transport, config *AppConfig) {
+	protocols := new(http.Protocols)
+	switch config.HTTPClientProtocol {
+	case ProtocolHTTP2:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	case ProtocolH2C:
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		protocols.SetHTTP1(true)
+	}
+	transport.Protocols = protocols
+	// With nothing read for SendPingTimeout, the connection is pinged and closed if the ping goes unanswered.
+	transport.HTTP2 = &http.HTTP2Config{
+		SendPingTimeout: time.Duration(config.HTTPClientHTTP2ReadIdleTimeoutMS) * time.Millisecond,
+		PingTimeout:     time.Duration(config.HTTPClientHTTP2PingTimeoutMS) * time.Millisecond,
+	}
+}
+
+// dialContext dials with dialer, from localAddrs if set, looking hostnames up through dnsResolver,
+// and finishes setting options once connected.
+//
+// Go does not cache DNS lookups, so we define a custom dial function that does.
+// This fixed a problem where requests were timing out during DNS lookup
+// even though we were hitting the same hostname over and over.
+//
+// The lookup is reported to httptrace as the DNS phase, as Go's own lookup would be.
+func dialContext(dialer *net.Dialer, localAddrs *LocalAddrs, options SocketOptions, conns *ConnRegistry) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed := address
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			trace := httptrace.ContextClientTrace(ctx)
+			if trace != nil && trace.DNSStart != nil {
+				trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+			}
+			ip, err := dnsResolver.FetchOne(host)
+			if err == nil && ip == nil {
+				err = &net.DNSError{Err: "no addresses", Name: host}
+			}
+			if trace != nil && trace.DNSDone != nil {
+				trace.DNSDone(httptrace.DNSDoneInfo{Addrs: []net.IPAddr{{IP: ip}}, Err: err})
+			}
+			if err != nil {
+				return nil, err
+			}
+			address = net.JoinHostPort(ip.String(), port)
+		}
+		var conn net.Conn
+		if localAddrs != nil {
+			conn, err = localAddrs.DialContext(ctx, dialer, network, address)
+		} else {
+			conn, err = dialer.DialContext(ctx, network, address)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := options.Connected(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if conns == nil {
+			return conn, nil
+		}
+		tracked := conns.Track(conn, dialed)
+		if trace := contextRequestTrace(ctx); trace != nil {
+			trace.dialed(tracked)
+		}
+		return tracked, nil
+	}
+}
+
+// unixDialContext connects to the Unix socket at socketPath whatever address the transport asks for.
+// Its dialer has only the timeout: TCP keep-alive and the socket options don't apply to a Unix socket.
+func unixDialContext(timeout time.Duration, socketPath string, conns *ConnRegistry) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, "unix", socketPath)
+		if err != nil || conns == nil {
+			return conn, err
+		}
+		return conns.Track(conn, socketPath), nil
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LoadGenerator sends a fixed number of calls to a Service from a pool of concurrent workers,
+// the same way the handler would under load, but without going through HTTP on our side.
+type LoadGenerator struct {
+	Requests    int
+	Concurrency int
+	// RequestIDPrefix makes request ids from different runs easy to tell apart in the logs.
+	RequestIDPrefix string
+}
+
+// Run blocks until every call has finished and returns how long that took.
+func (lg LoadGenerator) Run(service Service) time.Duration {
+	concurrency := lg.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	work := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range work {
+				service.Call(ServiceRequest{RequestID: fmt.Sprintf("%s%d", lg.RequestIDPrefix, n)})
+			}
+		}()
+	}
+	for n := 0; n < lg.Requests; n++ {
+		work <- n
+	}
+	close(work)
+	wg.Wait()
+	return time.Since(start)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// maxPortAttempts is how many ports in a source's range a dial tries before giving up.
+const maxPortAttempts = 16
+
+// LocalAddrs rotates the connections a dialer opens across several local source addresses.
+// A connection is identified by its source and destination IP and port, so from one source IP to one
+// service address we can only have as many connections as there are ephemeral ports, ~28k by default
+// on Linux. Each extra source IP adds that many again.
+type LocalAddrs struct {
+	next    uint64
+	sources []*localSource
+}
+
+// localSource is an IP to connect from, and optionally the range of ports to use on it.
+// With no range the kernel picks the port.
+type localSource struct {
+	nextPort uint64
+
+	IP       net.IP
+	LowPort  int
+	HighPort int
+}
+
+// ParseLocalAddrs parses HTTP_CLIENT_LOCAL_ADDRS entries, each an IP like 127.0.0.2 or an IP and port
+// range like 127.0.0.2:40000-40999 ([::1]:40000-40999 for IPv6). It returns nil if there are none.
+func ParseLocalAddrs(specs []string) (*LocalAddrs, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	localAddrs := &LocalAddrs{}
+	for _, spec := range specs {
+		source, err := parseLocalSource(spec)
+		if err != nil {
+			return nil, err
+		}
+		localAddrs.sources = append(localAddrs.sources, source)
+	}
+	return localAddrs, nil
+}
+
+func parseLocalSource(spec string) (*localSource, error) {
+	if ip := net.ParseIP(spec); ip != nil {
+		return &localSource{IP: ip}, nil
+	}
+	host, ports, err := net.SplitHostPort(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%q isn't an IP or IP:port-port", spec)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%q isn't an IP", host)
+	}
+	low, high := ports, ports
+	if i := strings.Index(ports, "-"); i >= 0 {
+		low, high = ports[:i], ports[i+1:]
+	}
+	lowPort, lowErr := strconv.Atoi(low)
+	highPort, highErr := strconv.Atoi(high)
+	if lowErr != nil || highErr != nil || lowPort < 1 || highPort > 65535 || lowPort > highPort {
+		return nil, fmt.Errorf("%q in %q isn't a port range like 40000-40999", ports, spec)
+	}
+	return &localSource{IP: ip, LowPort: lowPort, HighPort: highPort}, nil
+}
+
+// DialContext dials address with dialer from the next source address in turn.
+// With a port range, ports already taken are skipped.
+func (l *LocalAddrs) DialContext(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	source := l.sources[(atomic.AddUint64(&l.next, 1)-1)%uint64(len(l.sources))]
+	sourceDialer := *dialer
+	if source.LowPort == 0 {
+		sourceDialer.LocalAddr = &net.TCPAddr{IP: source.IP}
+		return sourceDialer.DialContext(ctx, network, address)
+	}
+	var err error
+	for attempt := 0; attempt < maxPortAttempts; attempt++ {
+		sourceDialer.LocalAddr = &net.TCPAddr{IP: source.IP, Port: source.port()}
+		var conn net.Conn
+		conn, err = sourceDialer.DialContext(ctx, network, address)
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return conn, err
+		}
+	}
+	return nil, fmt.Errorf("no free port from %s:%d-%d after %d tries: %s", source.IP, source.LowPort, source.HighPort, maxPortAttempts, err)
+}
+
+func (s *localSource) port() int {
+	size := uint64(s.HighPort - s.LowPort + 1)
+	return s.LowPort + int((atomic.AddUint64(&s.nextPort, 1)-1)%size)
+}
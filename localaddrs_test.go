@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLocalAddrs(t *testing.T) {
+	tests := []struct {
+		spec     string
+		want     localSource
+		wantFail bool
+	}{
+		{spec: "127.0.0.2", want: localSource{IP: net.ParseIP("127.0.0.2")}},
+		{spec: "::1", want: localSource{IP: net.ParseIP("::1")}},
+		{spec: "127.0.0.2:40000-40999", want: localSource{IP: net.ParseIP("127.0.0.2"), LowPort: 40000, HighPort: 40999}},
+		{spec: "[::1]:40000-40999", want: localSource{IP: net.ParseIP("::1"), LowPort: 40000, HighPort: 40999}},
+		{spec: "127.0.0.2:40000", want: localSource{IP: net.ParseIP("127.0.0.2"), LowPort: 40000, HighPort: 40000}},
+		{spec: "localhost", wantFail: true},
+		{spec: "localhost:40000-40999", wantFail: true},
+		{spec: "127.0.0.2:40999-40000", wantFail: true},
+		{spec: "127.0.0.2:0-10", wantFail: true},
+		{spec: "127.0.0.2:60000-70000", wantFail: true},
+		{spec: "127.0.0.2:a-b", wantFail: true},
+		{spec: "::1:40000-40999", wantFail: true},
+	}
+	for _, test := range tests {
+		source, err := parseLocalSource(test.spec)
+		if test.wantFail {
+			if err == nil {
+				t.Errorf("%q parsed as %+v, want an error", test.spec, source)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+		} else if !reflect.DeepEqual(*source, test.want) {
+			t.Errorf("%q parsed as %+v, want %+v", test.spec, *source, test.want)
+		}
+	}
+
+	if localAddrs, err := ParseLocalAddrs(nil); localAddrs != nil || err != nil {
+		t.Errorf("no entries gave %v, %v, want nil", localAddrs, err)
+	}
+	if _, err := ParseLocalAddrs([]string{"127.0.0.2", "nope"}); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("a bad entry among good ones gave %v, want an error naming it", err)
+	}
+}
+
+func TestLocalSourcePortsWrapAround(t *testing.T) {
+	source := &localSource{IP: net.ParseIP("127.0.0.1"), LowPort: 40000, HighPort: 40002}
+	var got []int
+	for i := 0; i < 7; i++ {
+		got = append(got, source.port())
+	}
+	if want := []int{40000, 40001, 40002, 40000, 40001, 40002, 40000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got ports %v, want %v", got, want)
+	}
+}
+
+// acceptRemoteAddrs listens on loopback and sends the address each accepted connection came from.
+func acceptRemoteAddrs(t *testing.T) (net.Listener, <-chan *net.TCPAddr) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	remotes := make(chan *net.TCPAddr, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			remotes <- conn.RemoteAddr().(*net.TCPAddr)
+			conn.Close()
+		}
+	}()
+	return listener, remotes
+}
+
+func TestLocalAddrsRotateSources(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("every 127.0.0.x address is only loopback on Linux")
+	}
+	listener, remotes := acceptRemoteAddrs(t)
+	localAddrs, err := ParseLocalAddrs([]string{"127.0.0.2", "127.0.0.3", "127.0.0.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &net.Dialer{Timeout: time.Second}
+	var got []string
+	for i := 0; i < 6; i++ {
+		conn, err := localAddrs.DialContext(context.Background(), dialer, "tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		got = append(got, (<-remotes).IP.String())
+	}
+	want := []string{"127.0.0.2", "127.0.0.3", "127.0.0.4", "127.0.0.2", "127.0.0.3", "127.0.0.4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("connections came from %v, want %v", got, want)
+	}
+	if dialer.LocalAddr != nil {
+		t.Errorf("the shared dialer was changed to bind %s", dialer.LocalAddr)
+	}
+}
+
+// neighbouringFreePorts finds two neighbouring loopback ports that are free, and gives the lower one.
+func neighbouringFreePorts(t *testing.T) int {
+	for i := 0; i < 20; i++ {
+		low, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := low.Addr().(*net.TCPAddr).Port
+		high, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port+1))
+		low.Close()
+		if err == nil {
+			high.Close()
+			return port
+		}
+	}
+	t.Skip("couldn't find two neighbouring free ports")
+	return 0
+}
+
+func TestLocalAddrsSkipPortsInUse(t *testing.T) {
+	listener, remotes := acceptRemoteAddrs(t)
+	port := neighbouringFreePorts(t)
+	// Something else holding the first port in the range means every other dial skips it.
+	taken, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer taken.Close()
+
+	localAddrs, err := ParseLocalAddrs([]string{"127.0.0.1:" + strconv.Itoa(port) + "-" + strconv.Itoa(port+1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := localAddrs.DialContext(context.Background(), &net.Dialer{Timeout: time.Second}, "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if remote := <-remotes; remote.Port != port+1 {
+		t.Errorf("connected from port %d, want %d, the free one", remote.Port, port+1)
+	}
+
+	onlyTaken, err := ParseLocalAddrs([]string{"127.0.0.1:" + strconv.Itoa(port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := onlyTaken.DialContext(context.Background(), &net.Dialer{Timeout: time.Second}, "tcp", listener.Addr().String()); err == nil || !strings.Contains(err.Error(), "no free port") {
+		t.Errorf("dialling from a range with no free port gave %v, want a no free port error", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DebugLogHeader on a request to /api turns on debug logs for that request, whatever the log level.
+const DebugLogHeader = "X-Debug-Log"
+
+// LogControl holds the log level and sample rate, which can both be changed while the app is running.
+// A sampled request gets debug logs as if it had DebugLogHeader set, so a few requests are traced in
+// full under load without turning debug on for all of them.
+type LogControl struct {
+	mu         sync.Mutex
+	sampleRate float64
+}
+
+func NewLogControl(config *AppConfig) (*LogControl, error) {
+	control := &LogControl{}
+	return control, control.Set(config.LogLevel, config.LogSampleRate)
+}
+
+// Set changes the log level of the standard logger and the sample rate.
+func (c *LogControl) Set(levelName string, sampleRate float64) error {
+	level, err := log.ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return fmt.Errorf("sample rate %g is not a fraction between 0 and 1", sampleRate)
+	}
+	log.SetLevel(level)
+	c.mu.Lock()
+	c.sampleRate = sampleRate
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *LogControl) SampleRate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sampleRate
+}
+
+// DebugRequest says whether r should get debug logs: it asked for them, or it was sampled.
+func (c *LogControl) DebugRequest(r *http.Request) bool {
+	if forced, err := strconv.ParseBool(r.Header.Get(DebugLogHeader)); err == nil && forced {
+		return true
+	}
+	sampleRate := c.SampleRate()
+	return sampleRate > 0 && rand.Float64() < sampleRate
+}
+
+// ServeHTTP shows the log level and sample rate, and a PUT or POST with level and/or samplerate
+// query parameters changes them.
+func (c *LogControl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		levelName := r.URL.Query().Get("level")
+		if levelName == "" {
+			levelName = log.GetLevel().String()
+		}
+		sampleRate := c.SampleRate()
+		if value := r.URL.Query().Get("samplerate"); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("samplerate %q is not a number", value), http.StatusBadRequest)
+				return
+			}
+			sampleRate = parsed
+		}
+		if err := c.Set(levelName, sampleRate); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.WithFields(map[string]interface{}{"level": levelName, "samplerate": sampleRate}).Warn("Logging changed")
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "GET the log level, or PUT ?level=debug&samplerate=0.01 to change it", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"level": log.GetLevel().String(), "samplerate": c.SampleRate()})
+}
+
+// requestLogger is the logger for everything about one request. When debug is set and the standard
+// logger's level would drop debug logs, it's a debug-level logger writing to the same place.
+func requestLogger(requestID string, debug bool) *log.Entry {
+	if !debug || log.GetLevel() >= log.DebugLevel {
+		return log.WithField("requestid", requestID)
+	}
+	std := log.StandardLogger()
+	logger := &log.Logger{Out: std.Out, Formatter: std.Formatter, Hooks: std.Hooks, Level: log.DebugLevel}
+	return logger.WithFields(map[string]interface{}{"requestid": requestID, "debuglog": true})
+}
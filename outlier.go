@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The reasons an endpoint can be ejected for.
+const (
+	EjectedConsecutiveErrors = "consecutive-errors"
+	EjectedSuccessRate       = "success-rate"
+	EjectedLatency           = "latency"
+)
+
+// outlierRecentEjections is how many ejections /internal/outliers remembers.
+const outlierRecentEjections = 100
+
+// OutlierDetector watches how the calls to each endpoint go and ejects the ones doing much worse than
+// the rest from rotation for a while. Unlike health checks it only looks at real calls, so it costs no
+// extra traffic, and catches endpoints that answer checks but fail or crawl on real work.
+//
+// An endpoint is ejected straight away after ConsecutiveErrors failed calls in a row. Every Interval,
+// the endpoints with at least MinRequests calls in it (and always at least one) are compared: one whose
+// success rate is more than SuccessRateStdev standard deviations below their mean, or whose mean latency
+// is more than LatencyFactor times the median of the others', is ejected too. Setting ConsecutiveErrors,
+// SuccessRateStdev or LatencyFactor to 0 turns that check off.
+//
+// An ejection lasts BaseEjection times how many times in a row the endpoint has been ejected, up to
+// MaxEjection; each Interval it goes without one takes one off that count. No more than MaxEjectionPercent
+// of the endpoints are ejected at once, though one can always be.
+type OutlierDetector struct {
+	Balancer           *Balancer
+	Enabled            bool
+	ConsecutiveErrors  int
+	SuccessRateStdev   float64
+	LatencyFactor      float64
+	MinRequests        int
+	Interval           time.Duration
+	BaseEjection       time.Duration
+	MaxEjection        time.Duration
+	MaxEjectionPercent int
+
+	mu     sync.Mutex
+	recent []Ejection
+	stop   chan struct{}
+}
+
+// Ejection is one endpoint being taken out of rotation as an outlier.
+type Ejection struct {
+	Endpoint string    `json:"endpoint"`
+	Reason   string    `json:"reason"`
+	Detail   string    `json:"detail"`
+	At       time.Time `json:"at"`
+	Until    time.Time `json:"until"`
+	// InARow is how many times in a row the endpoint has been ejected, this time included.
+	InARow int `json:"inARow"`
+}
+
+// outlierWindow is what the calls to an endpoint did in the current Interval.
+type outlierWindow struct {
+	requests  int
+	errors    int
+	latencyMS float64
+}
+
+func NewOutlierDetector(config *AppConfig, balancer *Balancer) *OutlierDetector {
+	return &OutlierDetector{
+		Balancer:           balancer,
+		Enabled:            config.ServiceOutlierDetection,
+		ConsecutiveErrors:  config.ServiceOutlierConsecutiveErrors,
+		SuccessRateStdev:   config.ServiceOutlierSuccessRateStdev,
+		LatencyFactor:      config.ServiceOutlierLatencyFactor,
+		MinRequests:        config.ServiceOutlierMinRequests,
+		Interval:           time.Duration(config.ServiceOutlierIntervalMS) * time.Millisecond,
+		BaseEjection:       time.Duration(config.ServiceOutlierBaseEjectionMS) * time.Millisecond,
+		MaxEjection:        time.Duration(config.ServiceOutlierMaxEjectionMS) * time.Millisecond,
+		MaxEjectionPercent: config.ServiceOutlierMaxEjectionPercent,
+	}
+}
+
+// Start has the balancer report every call to the detector, and compares the endpoints every Interval
+// in the background. It does nothing unless Enabled.
+func (d *OutlierDetector) Start() {
+	if !d.Enabled {
+		return
+	}
+	d.Balancer.mu.Lock()
+	d.Balancer.outliers = d
+	d.Balancer.mu.Unlock()
+	d.stop = make(chan struct{})
+	ticker := time.NewTicker(d.Interval)
+	go func(stop chan struct{}) {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.analyze()
+			case <-stop:
+				return
+			}
+		}
+	}(d.stop)
+}
+
+// Stop stops comparing the endpoints and has the balancer stop reporting calls. Ejections already
+// made run their course.
+func (d *OutlierDetector) Stop() {
+	if d.stop == nil {
+		return
+	}
+	close(d.stop)
+	d.stop = nil
+	d.Balancer.mu.Lock()
+	d.Balancer.outliers = nil
+	d.Balancer.mu.Unlock()
+}
+
+// record counts a finished call towards the endpoint's window, ejecting it if that makes too many errors in a row.
+func (d *OutlierDetector) record(endpoint *Endpoint, latencyMS float64, err error) {
+	endpoint.mu.Lock()
+	endpoint.window.requests++
+	if err != nil {
+		endpoint.window.errors++
+		endpoint.consecutiveErrors++
+	} else {
+		endpoint.window.latencyMS += latencyMS
+		endpoint.consecutiveErrors = 0
+	}
+	inARow := endpoint.consecutiveErrors
+	tripped := d.ConsecutiveErrors > 0 && inARow >= d.ConsecutiveErrors && !endpoint.ejected(time.Now())
+	endpoint.mu.Unlock()
+	if tripped {
+		d.eject(endpoint, EjectedConsecutiveErrors, fmt.Sprintf("%d calls in a row failed", inARow))
+	}
+}
+
+// analyze starts a new window for every endpoint, comparing the ones with enough calls in the last.
+func (d *OutlierDetector) analyze() {
+	now := time.Now()
+	type judged struct {
+		endpoint    *Endpoint
+		successRate float64
+		latencyMS   float64
+	}
+	minRequests := d.MinRequests
+	if minRequests < 1 {
+		minRequests = 1
+	}
+	var endpoints []judged
+	for _, endpoint := range d.Balancer.Endpoints() {
+		endpoint.mu.Lock()
+		window := endpoint.window
+		endpoint.window = outlierWindow{}
+		ejected := endpoint.ejected(now)
+		if !ejected && endpoint.ejections > 0 && now.Sub(endpoint.ejectedUntil) >= d.Interval {
+			endpoint.ejections--
+		}
+		endpoint.mu.Unlock()
+		if ejected || window.requests < minRequests {
+			continue
+		}
+		candidate := judged{endpoint: endpoint, successRate: 1 - float64(window.errors)/float64(window.requests)}
+		if successes := window.requests - window.errors; successes > 0 {
+			candidate.latencyMS = window.latencyMS / float64(successes)
+		}
+		endpoints = append(endpoints, candidate)
+	}
+	if len(endpoints) < 2 {
+		return
+	}
+
+	if d.SuccessRateStdev > 0 {
+		var mean, variance float64
+		for _, e := range endpoints {
+			mean += e.successRate
+		}
+		mean /= float64(len(endpoints))
+		for _, e := range endpoints {
+			variance += (e.successRate - mean) * (e.successRate - mean)
+		}
+		threshold := mean - d.SuccessRateStdev*math.Sqrt(variance/float64(len(endpoints)))
+		for _, e := range endpoints {
+			if e.successRate < threshold {
+				d.eject(e.endpoint, EjectedSuccessRate, fmt.Sprintf("%.1f%% of calls succeeded, against %.1f%% on average", 100*e.successRate, 100*mean))
+			}
+		}
+	}
+
+	if d.LatencyFactor > 0 {
+		for i, e := range endpoints {
+			var others []float64
+			for j, other := range endpoints {
+				if j != i && other.latencyMS > 0 {
+					others = append(others, other.latencyMS)
+				}
+			}
+			if len(others) == 0 || e.latencyMS == 0 {
+				continue
+			}
+			median := medianOf(others)
+			if e.latencyMS > d.LatencyFactor*median {
+				d.eject(e.endpoint, EjectedLatency, fmt.Sprintf("%.1fms on average, against %.1fms for the others", e.latencyMS, median))
+			}
+		}
+	}
+}
+
+func medianOf(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// eject takes the endpoint out of rotation unless it already is, it's the only endpoint, or enough others already are.
+func (d *OutlierDetector) eject(endpoint *Endpoint, reason, detail string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	endpoints := d.Balancer.Endpoints()
+	if len(endpoints) < 2 {
+		return
+	}
+	ejected := 0
+	for _, other := range endpoints {
+		other.mu.Lock()
+		if other.ejected(now) {
+			ejected++
+		}
+		other.mu.Unlock()
+	}
+	fields := map[string]interface{}{"endpoint": endpoint.Address, "reason": reason, "detail": detail}
+	if ejected > 0 && (ejected+1)*100 > d.MaxEjectionPercent*len(endpoints) {
+		fields["ejected"] = ejected
+		log.WithFields(fields).Debug("Endpoint is an outlier, but as many endpoints as allowed are ejected already")
+		return
+	}
+
+	endpoint.mu.Lock()
+	if endpoint.ejected(now) {
+		endpoint.mu.Unlock()
+		return
+	}
+	endpoint.ejections++
+	duration := d.BaseEjection * time.Duration(endpoint.ejections)
+	if d.MaxEjection > 0 && duration > d.MaxEjection {
+		duration = d.MaxEjection
+	}
+	ejection := Ejection{Endpoint: endpoint.Address, Reason: reason, Detail: detail, At: now, Until: now.Add(duration), InARow: endpoint.ejections}
+	endpoint.ejectedUntil = ejection.Until
+	endpoint.ejectionReason = reason
+	endpoint.consecutiveErrors = 0
+	endpoint.mu.Unlock()
+
+	d.recent = append(d.recent, ejection)
+	if len(d.recent) > outlierRecentEjections {
+		d.recent = d.recent[len(d.recent)-outlierRecentEjections:]
+	}
+	fields["ejectedForMS"] = durationMS(duration)
+	fields["inARow"] = ejection.InARow
+	log.WithFields(fields).Warn("Endpoint ejected as an outlier")
+	time.AfterFunc(duration, func() {
+		log.WithFields(map[string]interface{}{"endpoint": endpoint.Address}).Info("Endpoint's ejection is over, back in rotation")
+	})
+}
+
+// Ejections are the most recent ejections, oldest first.
+func (d *OutlierDetector) Ejections() []Ejection {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Ejection(nil), d.recent...)
+}
+
+// ServeHTTP answers /internal/outliers with the detector's settings, the endpoints ejected right now,
+// and the most recent ejections.
+func (d *OutlierDetector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ejected := []string{}
+	for _, stats := range d.Balancer.Stats() {
+		if stats.Ejected {
+			ejected = append(ejected, stats.Address)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": d.Enabled,
+		"settings": map[string]interface{}{
+			"consecutiveErrors":  d.ConsecutiveErrors,
+			"successRateStdev":   d.SuccessRateStdev,
+			"latencyFactor":      d.LatencyFactor,
+			"minRequests":        d.MinRequests,
+			"intervalMS":         durationMS(d.Interval),
+			"baseEjectionMS":     durationMS(d.BaseEjection),
+			"maxEjectionMS":      durationMS(d.MaxEjection),
+			"maxEjectionPercent": d.MaxEjectionPercent,
+		},
+		"ejected":   ejected,
+		"ejections": d.Ejections(),
+	})
+}
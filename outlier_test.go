@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testOutlierDetector makes an OutlierDetector with settings over a round-robin Balancer of n endpoints.
+func testOutlierDetector(t *testing.T, n int, settings map[string]string) (*OutlierDetector, []*Endpoint) {
+	var addresses []string
+	for i := 1; i <= n; i++ {
+		addresses = append(addresses, fmt.Sprintf("10.0.0.%d:80", i))
+	}
+	balancer := testBalancer(t, BalancerRoundRobin, addresses...)
+	return NewOutlierDetector(testConfig(t, settings), balancer), balancer.Endpoints()
+}
+
+func ejectionReason(endpoint *Endpoint) string {
+	stats := endpoint.Stats()
+	if !stats.Ejected {
+		return ""
+	}
+	return stats.EjectionReason
+}
+
+func TestEjectAfterConsecutiveErrors(t *testing.T) {
+	detector, endpoints := testOutlierDetector(t, 10, map[string]string{"SERVICE_OUTLIER_CONSECUTIVE_ERRORS": "3"})
+	failed := fmt.Errorf("503")
+	endpoint := endpoints[0]
+	for _, err := range []error{failed, failed, nil, failed, failed} {
+		detector.record(endpoint, 10, err)
+	}
+	if reason := ejectionReason(endpoint); reason != "" {
+		t.Fatalf("ejected for %s with a success between the errors", reason)
+	}
+	detector.record(endpoint, 10, failed)
+	if reason := ejectionReason(endpoint); reason != EjectedConsecutiveErrors {
+		t.Fatalf("ejection reason is %q after 3 errors in a row, want %q", reason, EjectedConsecutiveErrors)
+	}
+	if ejections := detector.Ejections(); len(ejections) != 1 || ejections[0].Endpoint != endpoint.Address {
+		t.Errorf("ejections are %+v, want just %s", ejections, endpoint.Address)
+	}
+	for i := 0; i < 3; i++ {
+		detector.record(endpoint, 10, failed)
+	}
+	if ejections := detector.Ejections(); len(ejections) != 1 {
+		t.Errorf("errors while ejected ejected it again: %+v", ejections)
+	}
+}
+
+func TestEjectSuccessRateOutlier(t *testing.T) {
+	detector, endpoints := testOutlierDetector(t, 6, map[string]string{
+		"SERVICE_OUTLIER_CONSECUTIVE_ERRORS":   "0",
+		"SERVICE_OUTLIER_LATENCY_FACTOR":       "0",
+		"SERVICE_OUTLIER_MIN_REQUESTS":         "20",
+		"SERVICE_OUTLIER_MAX_EJECTION_PERCENT": "50",
+	})
+	failed := fmt.Errorf("503")
+	// Failures out of 100 calls for the first five; the last fails every call but has too few to be judged.
+	for i, failures := range []int{0, 1, 2, 1, 40} {
+		for call := 0; call < 100; call++ {
+			var err error
+			if call < failures {
+				err = failed
+			}
+			detector.record(endpoints[i], 10, err)
+		}
+	}
+	for call := 0; call < 10; call++ {
+		detector.record(endpoints[5], 10, failed)
+	}
+	detector.analyze()
+	for i, endpoint := range endpoints {
+		want := ""
+		if i == 4 {
+			want = EjectedSuccessRate
+		}
+		if reason := ejectionReason(endpoint); reason != want {
+			t.Errorf("%s ejection reason is %q, want %q", endpoint.Address, reason, want)
+		}
+	}
+
+	// The next interval starts over, so the calls in the last one don't count again.
+	detector.analyze()
+	if ejections := detector.Ejections(); len(ejections) != 1 {
+		t.Errorf("ejections are %+v, want just one", ejections)
+	}
+}
+
+func TestEjectLatencyOutlier(t *testing.T) {
+	detector, endpoints := testOutlierDetector(t, 4, map[string]string{
+		"SERVICE_OUTLIER_SUCCESS_RATE_STDEV":   "0",
+		"SERVICE_OUTLIER_LATENCY_FACTOR":       "3",
+		"SERVICE_OUTLIER_MIN_REQUESTS":         "20",
+		"SERVICE_OUTLIER_MAX_EJECTION_PERCENT": "50",
+	})
+	for i, latencyMS := range []float64{10, 11, 12, 50} {
+		for call := 0; call < 20; call++ {
+			detector.record(endpoints[i], latencyMS, nil)
+		}
+	}
+	detector.analyze()
+	for i, endpoint := range endpoints {
+		want := ""
+		if i == 3 {
+			want = EjectedLatency
+		}
+		if reason := ejectionReason(endpoint); reason != want {
+			t.Errorf("%s ejection reason is %q, want %q", endpoint.Address, reason, want)
+		}
+	}
+}
+
+func TestNoMinRequestsStillJudgesEndpoints(t *testing.T) {
+	detector, endpoints := testOutlierDetector(t, 5, map[string]string{
+		"SERVICE_OUTLIER_SUCCESS_RATE_STDEV":   "0",
+		"SERVICE_OUTLIER_LATENCY_FACTOR":       "3",
+		"SERVICE_OUTLIER_MIN_REQUESTS":         "0",
+		"SERVICE_OUTLIER_MAX_EJECTION_PERCENT": "50",
+	})
+	// The last endpoint gets no calls, so there's nothing to judge it on.
+	for i, latencyMS := range []float64{10, 11, 12, 50} {
+		detector.record(endpoints[i], latencyMS, nil)
+	}
+	detector.analyze()
+	for i, endpoint := range endpoints {
+		want := ""
+		if i == 3 {
+			want = EjectedLatency
+		}
+		if reason := ejectionReason(endpoint); reason != want {
+			t.Errorf("%s ejection reason is %q, want %q", endpoint.Address, reason, want)
+		}
+	}
+}
+
+func TestMaxEjectionPercent(t *testing.T) {
+	tests := []struct {
+		percent     string
+		wantEjected int
+	}{
+		// One endpoint can always be ejected, however low the cap.
+		{"0", 1},
+		{"25", 1},
+		{"50", 2},
+		{"100", 4},
+	}
+	for _, test := range tests {
+		t.Run(test.percent+"%", func(t *testing.T) {
+			detector, endpoints := testOutlierDetector(t, 4, map[string]string{
+				"SERVICE_OUTLIER_CONSECUTIVE_ERRORS":   "1",
+				"SERVICE_OUTLIER_MAX_EJECTION_PERCENT": test.percent,
+			})
+			for _, endpoint := range endpoints {
+				detector.record(endpoint, 10, fmt.Errorf("503"))
+			}
+			ejected := 0
+			for _, endpoint := range endpoints {
+				if endpoint.Stats().Ejected {
+					ejected++
+				}
+			}
+			if ejected != test.wantEjected {
+				t.Errorf("%d of 4 endpoints ejected, want %d", ejected, test.wantEjected)
+			}
+		})
+	}
+
+	detector, endpoints := testOutlierDetector(t, 1, map[string]string{"SERVICE_OUTLIER_CONSECUTIVE_ERRORS": "1"})
+	detector.record(endpoints[0], 10, fmt.Errorf("503"))
+	if endpoints[0].Stats().Ejected {
+		t.Error("the only endpoint was ejected")
+	}
+}
+
+func TestEjectionsGrowLonger(t *testing.T) {
+	detector, endpoints := testOutlierDetector(t, 2, map[string]string{
+		"SERVICE_OUTLIER_INTERVAL_MS":      "1000",
+		"SERVICE_OUTLIER_BASE_EJECTION_MS": "100",
+		"SERVICE_OUTLIER_MAX_EJECTION_MS":  "350",
+	})
+	endpoint := endpoints[0]
+	// endEjection has the endpoint's last ejection end ago.
+	endEjection := func(ago time.Duration) {
+		endpoint.mu.Lock()
+		endpoint.ejectedUntil = time.Now().Add(-ago)
+		endpoint.mu.Unlock()
+	}
+	for _, want := range []time.Duration{100, 200, 300, 350, 350} {
+		detector.eject(endpoint, EjectedConsecutiveErrors, "test")
+		ejections := detector.Ejections()
+		last := ejections[len(ejections)-1]
+		if got := last.Until.Sub(last.At); got != want*time.Millisecond {
+			t.Errorf("ejection %d lasted %v, want %v", last.InARow, got, want*time.Millisecond)
+		}
+		endEjection(0)
+	}
+
+	// Each interval without being ejected takes one off the count, and so off the next ejection.
+	endEjection(time.Second)
+	for i := 0; i < 3; i++ {
+		detector.analyze()
+	}
+	detector.eject(endpoint, EjectedConsecutiveErrors, "test")
+	ejections := detector.Ejections()
+	if last := ejections[len(ejections)-1]; last.InARow != 3 || last.Until.Sub(last.At) != 300*time.Millisecond {
+		t.Errorf("ejection after 3 clean intervals is %+v, want the 3rd in a row, for 300ms", last)
+	}
+}
+
+func TestOutlierDetectorStop(t *testing.T) {
+	detector, endpoints := testOutlierDetector(t, 2, map[string]string{
+		"SERVICE_OUTLIER_DETECTION":          "true",
+		"SERVICE_OUTLIER_CONSECUTIVE_ERRORS": "1",
+	})
+	detector.Start()
+	_, done := detector.Balancer.Pick()
+	done(fmt.Errorf("503"))
+	if len(detector.Ejections()) != 1 {
+		t.Fatalf("a failed call with the detector started gave ejections %+v, want one", detector.Ejections())
+	}
+	detector.Stop()
+	for _, endpoint := range endpoints {
+		endpoint.mu.Lock()
+		endpoint.ejectedUntil = time.Time{}
+		endpoint.mu.Unlock()
+	}
+	_, done = detector.Balancer.Pick()
+	done(fmt.Errorf("503"))
+	if len(detector.Ejections()) != 1 {
+		t.Errorf("a failed call after Stop gave ejections %+v, want no new one", detector.Ejections())
+	}
+	detector.Stop()
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The HTTP_CLIENT_PROXY_URL schemes. socks5h is taken as socks5, since the proxy always resolves the service's name.
+const (
+	proxySchemeHTTP   = "http"
+	proxySchemeHTTPS  = "https"
+	proxySchemeSOCKS5 = "socks5"
+)
+
+var proxyDefaultPorts = map[string]string{
+	proxySchemeHTTP:   "80",
+	proxySchemeHTTPS:  "443",
+	proxySchemeSOCKS5: "1080",
+}
+
+// socksHandshakeTimeout bounds the SOCKS5 handshake when the call has no deadline, like Go does for CONNECT.
+const socksHandshakeTimeout = time.Minute
+
+// Proxy is the outbound proxy calls to the service go through, from HTTP_CLIENT_PROXY_URL and HTTP_CLIENT_NO_PROXY.
+//
+// An http or https proxy is used the way Go's transport does it: https services are reached through a
+// CONNECT tunnel, and calls to http services are sent to the proxy whole for it to forward. A socks5
+// proxy is spoken to by our dialer, which hands the transport a connection already tunnelled to the
+// service. Either way it's the proxy that resolves the service's hostname.
+//
+// Unlike Go's own NO_PROXY handling, loopback addresses are proxied unless they're listed, so the
+// local fake service can be called through a proxy.
+type Proxy struct {
+	URL     *url.URL
+	noProxy []noProxyRule
+}
+
+// noProxyRule is one HTTP_CLIENT_NO_PROXY entry: "*", an IP or CIDR, or a domain, which also covers its
+// subdomains unless it's written with a leading "." or "*." to mean only them. Any but "*" can have a :port.
+type noProxyRule struct {
+	all            bool
+	ipNet          *net.IPNet
+	domain         string
+	subdomainsOnly bool
+	port           string
+}
+
+// ParseProxy returns nil when rawURL is empty: calls go straight to the service.
+// Errors don't repeat the URL, as it can hold a password.
+func ParseProxy(rawURL string, noProxy []string) (*Proxy, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("proxy URL can't be parsed")
+	}
+	if proxyURL.Scheme == "socks5h" {
+		proxyURL.Scheme = proxySchemeSOCKS5
+	}
+	if _, ok := proxyDefaultPorts[proxyURL.Scheme]; !ok {
+		return nil, fmt.Errorf("proxy scheme must be http, https or socks5, got %q", proxyURL.Scheme)
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, errors.New("proxy URL has no host")
+	}
+	proxy := &Proxy{URL: proxyURL}
+	for _, entry := range noProxy {
+		rule, err := parseNoProxyRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		proxy.noProxy = append(proxy.noProxy, rule)
+	}
+	return proxy, nil
+}
+
+func parseNoProxyRule(entry string) (noProxyRule, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if entry == "*" {
+		return noProxyRule{all: true}, nil
+	}
+	if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+		return noProxyRule{ipNet: ipNet}, nil
+	}
+	var rule noProxyRule
+	host := entry
+	if net.ParseIP(host) == nil {
+		if h, port, err := net.SplitHostPort(entry); err == nil {
+			if _, err := strconv.Atoi(port); err != nil {
+				return rule, fmt.Errorf("no-proxy entry %q has an invalid port", entry)
+			}
+			host, rule.port = h, port
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * len(ip)
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		rule.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return rule, nil
+	}
+	if strings.HasPrefix(host, "*.") || strings.HasPrefix(host, ".") {
+		rule.subdomainsOnly = true
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+	}
+	if host == "" {
+		return rule, fmt.Errorf("no-proxy entry %q has no host", entry)
+	}
+	rule.domain = host
+	return rule, nil
+}
+
+func (r noProxyRule) matches(host, port string) bool {
+	if r.all {
+		return true
+	}
+	if r.port != "" && r.port != port {
+		return false
+	}
+	if r.ipNet != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.ipNet.Contains(ip)
+	}
+	if strings.HasSuffix(host, "."+r.domain) {
+		return true
+	}
+	return host == r.domain && !r.subdomainsOnly
+}
+
+// Address is the proxy's host:port.
+func (p *Proxy) Address() string {
+	port := p.URL.Port()
+	if port == "" {
+		port = proxyDefaultPorts[p.URL.Scheme]
+	}
+	return net.JoinHostPort(p.URL.Hostname(), port)
+}
+
+// String is the proxy URL without its password, for logs and traces.
+func (p *Proxy) String() string {
+	return p.URL.Redacted()
+}
+
+// UsedFor says whether calls to address, a host:port, go through the proxy. It's false for a nil Proxy.
+func (p *Proxy) UsedFor(address string) bool {
+	if p == nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range p.noProxy {
+		if rule.matches(host, port) {
+			return false
+		}
+	}
+	return true
+}
+
+// transportProxy is the http.Transport Proxy func for an http or https proxy, and nil otherwise.
+func (p *Proxy) transportProxy() func(*http.Request) (*url.URL, error) {
+	if p == nil || p.URL.Scheme == proxySchemeSOCKS5 {
+		return nil
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if !p.UsedFor(canonicalAddress(req.URL)) {
+			return nil, nil
+		}
+		return p.URL, nil
+	}
+}
+
+// markProxyConnect and markProxyConnectDone time the CONNECT to an http or https proxy as the "proxy" phase.
+func markProxyConnect(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+	if trace := contextRequestTrace(ctx); trace != nil {
+		trace.Mark("proxyconnectstart")
+	}
+	return nil, nil
+}
+
+// The connection is tunnelled to the service from here on, so it's also recorded as the dialled connection's target.
+func markProxyConnectDone(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, connectRes *http.Response) error {
+	if trace := contextRequestTrace(ctx); trace != nil {
+		trace.Mark("proxyconnectdone")
+		if conn := trace.dialedConn(); conn != nil && connectRes.StatusCode == http.StatusOK {
+			conn.tunnelledTo(connectReq.Host)
+		}
+	}
+	return nil
+}
+
+// canonicalAddress is the host:port a URL's connections go to, with the scheme's default port if it has none.
+func canonicalAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// socksDialContext connects to the service through a socks5 proxy, dialling the proxy with dial,
+// unless HTTP_CLIENT_NO_PROXY says to dial the service directly. The handshake is the "proxy" phase.
+func (p *Proxy) socksDialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if !p.UsedFor(address) {
+			return dial(ctx, network, address)
+		}
+		conn, err := dial(ctx, network, p.Address())
+		if err != nil {
+			return nil, err
+		}
+		trace := contextRequestTrace(ctx)
+		if trace != nil {
+			trace.Mark("proxyconnectstart")
+		}
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(socksHandshakeTimeout)
+		}
+		conn.SetDeadline(deadline)
+		err = socks5Connect(conn, p.URL.User, address)
+		conn.SetDeadline(time.Time{})
+		if trace != nil {
+			trace.Mark("proxyconnectdone")
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("socks5 proxy %s: %v", p.Address(), err)
+		}
+		if tracked, ok := conn.(*TrackedConn); ok {
+			tracked.tunnelledTo(address)
+		}
+		return conn, nil
+	}
+}
+
+// SOCKS5 (RFC 1928) values, with username/password authentication from RFC 1929.
+const (
+	socksVersion          = 5
+	socksAuthNone         = 0
+	socksAuthPassword     = 2
+	socksAuthNoAcceptable = 0xff
+	socksCommandConnect   = 1
+	socksAddrIPv4         = 1
+	socksAddrDomain       = 3
+	socksAddrIPv6         = 4
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect asks the SOCKS5 server on the other end of conn to connect it to address,
+// passing hostnames on for the server to resolve.
+func socks5Connect(conn net.Conn, user *url.Userinfo, address string) error {
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return errors.New("proxy wants a username and password")
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("username or password too long")
+		}
+		auth := []byte{1, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+
+	request := []byte{socksVersion, socksCommandConnect, 0}
+	addr, err := socksAddress(address)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(request, addr...)); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		if reason, ok := socksReplies[header[1]]; ok {
+			return errors.New(reason)
+		}
+		return fmt.Errorf("connect failed with reply %d", header[1])
+	}
+	// The address the proxy connected from isn't needed, but has to be read past.
+	_, err = readSocksAddress(conn, header[3])
+	return err
+}
+
+// socksAddress encodes a host:port as a SOCKS5 address type, address and port.
+func socksAddress(address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+	var addr []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("hostname %q too long", host)
+		}
+		addr = append([]byte{socksAddrDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		addr = append([]byte{socksAddrIPv4}, ip4...)
+	} else {
+		addr = append([]byte{socksAddrIPv6}, ip...)
+	}
+	return binary.BigEndian.AppendUint16(addr, uint16(port)), nil
+}
+
+// readSocksAddress reads an address of addrType and its port, returning them as a host:port.
+func readSocksAddress(r io.Reader, addrType byte) (string, error) {
+	var length int
+	switch addrType {
+	case socksAddrIPv4:
+		length = net.IPv4len
+	case socksAddrIPv6:
+		length = net.IPv6len
+	case socksAddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+		length = int(size[0])
+	default:
+		return "", fmt.Errorf("unknown address type %d", addrType)
+	}
+	addr := make([]byte, length+2)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", err
+	}
+	host := string(addr[:length])
+	if addrType != socksAddrDomain {
+		host = net.IP(addr[:length]).String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(addr[length:])))), nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadinessCheck answers /internal/ready: whether this instance should be sent traffic right now.
+// It isn't ready when it's shutting down, when the service can't be reached, or when MaxInFlight
+// calls to the service are already in flight.
+//
+// The service is probed by opening a TCP connection to it rather than calling it, so readiness checks
+// don't add to the load being measured, and the result is reused for ProbeInterval. With several
+// endpoints, one being reachable is enough. When the endpoints are health checked, their health
+// is used instead of a probe.
+type ReadinessCheck struct {
+	Endpoints *Balancer
+	// Proxy, if calls go through one, is probed instead of the service, which may not be reachable directly.
+	Proxy         *Proxy
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	// MaxInFlight is how many calls to the service in flight make us stop being ready; 0 means no limit.
+	MaxInFlight int
+	HTTPClient  *SwappableHTTPClient
+	Server      *Server
+
+	mu        sync.Mutex
+	lastProbe ReadinessResult
+}
+
+// ReadinessResult is the outcome of one part of the readiness check.
+type ReadinessResult struct {
+	OK        bool       `json:"ok"`
+	Detail    string     `json:"detail,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checkedAt,omitempty"`
+	LatencyMS float64    `json:"latencyMS,omitempty"`
+}
+
+func NewReadinessCheck(config *AppConfig, endpoints *Balancer, httpClient *SwappableHTTPClient, server *Server) *ReadinessCheck {
+	proxy, _ := ParseProxy(config.HTTPClientProxyURL, config.HTTPClientNoProxy)
+	return &ReadinessCheck{
+		Endpoints:     endpoints,
+		Proxy:         proxy,
+		ProbeInterval: time.Duration(config.ReadyProbeIntervalMS) * time.Millisecond,
+		ProbeTimeout:  time.Duration(config.ReadyProbeTimeoutMS) * time.Millisecond,
+		MaxInFlight:   config.ReadyMaxInFlight,
+		HTTPClient:    httpClient,
+		Server:        server,
+	}
+}
+
+// Check runs every part of the readiness check. The service probe is only run again if the last one is older than ProbeInterval.
+func (c *ReadinessCheck) Check() (ready bool, results map[string]ReadinessResult) {
+	results = map[string]ReadinessResult{
+		"upstream": c.upstream(),
+		"pool":     c.pool(),
+		"shutdown": c.shutdown(),
+	}
+	ready = true
+	for _, result := range results {
+		ready = ready && result.OK
+	}
+	return ready, results
+}
+
+func (c *ReadinessCheck) upstream() ReadinessResult {
+	if c.Endpoints.HealthChecked() {
+		healthy, total := c.Endpoints.Healthy()
+		result := ReadinessResult{OK: healthy > 0, Detail: fmt.Sprintf("%d of %d endpoints passing health checks", healthy, total)}
+		if !result.OK {
+			result.Error = "no endpoint is healthy"
+		}
+		return result
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastProbe.CheckedAt != nil && time.Since(*c.lastProbe.CheckedAt) < c.ProbeInterval {
+		return c.lastProbe
+	}
+	c.lastProbe = probeUpstream(c.Endpoints.Endpoints(), c.Proxy, c.ProbeTimeout)
+	return c.lastProbe
+}
+
+// probeUpstream checks a connection can be opened to at least one of the endpoints, or to the proxy
+// if calls to them go through one, trying each in turn until one connects.
+func probeUpstream(endpoints []*Endpoint, proxy *Proxy, timeout time.Duration) ReadinessResult {
+	start := time.Now()
+	result := ReadinessResult{CheckedAt: &start}
+	var failures []string
+	for _, endpoint := range endpoints {
+		network, address := endpoint.dialAddress(proxy)
+		result.Detail = endpoint.Address
+		if address != endpoint.Address {
+			result.Detail += " through proxy " + address
+		}
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		conn.Close()
+		result.OK = true
+		break
+	}
+	result.LatencyMS = durationMS(time.Since(start))
+	if !result.OK {
+		result.Error = strings.Join(failures, "; ")
+	}
+	return result
+}
+
+func (c *ReadinessCheck) pool() ReadinessResult {
+	inFlight := c.HTTPClient.InFlight()
+	if c.MaxInFlight == 0 {
+		return ReadinessResult{OK: true, Detail: fmt.Sprintf("%d calls in flight, no limit", inFlight)}
+	}
+	result := ReadinessResult{OK: inFlight < c.MaxInFlight, Detail: fmt.Sprintf("%d of %d calls in flight", inFlight, c.MaxInFlight)}
+	if !result.OK {
+		result.Error = "saturated"
+	}
+	return result
+}
+
+func (c *ReadinessCheck) shutdown() ReadinessResult {
+	if c.Server != nil && c.Server.ShuttingDown() {
+		return ReadinessResult{Error: "shutting down"}
+	}
+	return ReadinessResult{OK: true}
+}
+
+// ServeHTTP answers 200 when ready and 503 when not, with the result of each check either way.
+func (c *ReadinessCheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ready, results := c.Check()
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ready": ready, "checks": results})
+}
+
+// InternalLiveCheck answers as long as the process can serve requests at all.
+func InternalLiveCheck(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "Alive")
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configWatchInterval is how often the config file is checked for changes.
+const configWatchInterval = 2 * time.Second
+
+// ConfigReloader reloads the config the same way it was loaded at startup and swaps a new http.Client
+// into the Service when the HTTP_CLIENT_* settings change. LOG_* settings are applied to LogControl,
+// if there is one. Other settings need a restart to take effect, and keep their running values until then.
+type ConfigReloader struct {
+	// Args are the command-line flags the app was started with, so they keep winning over the file.
+	Args       []string
+	Loader     ConfigLoader
+	Client     *SwappableHTTPClient
+	LogControl *LogControl
+	// Conns is where the rebuilt client's connections are tracked.
+	Conns *ConnRegistry
+
+	mu      sync.Mutex
+	current *AppConfig
+}
+
+// ConfigChange is one setting that differs between two configs.
+type ConfigChange struct {
+	Setting string      `json:"setting"`
+	From    interface{} `json:"from"`
+	To      interface{} `json:"to"`
+	// Applied is false for a change that waits for a restart.
+	Applied bool `json:"applied"`
+}
+
+func (c ConfigChange) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Setting, c.From, c.To)
+}
+
+func NewConfigReloader(args []string, config *AppConfig, client *SwappableHTTPClient) *ConfigReloader {
+	return &ConfigReloader{
+		Args:    args,
+		Loader:  ConfigLoader{LookupEnv: os.LookupEnv, Output: os.Stderr},
+		Client:  client,
+		current: config,
+	}
+}
+
+// Config is the config currently in effect.
+func (r *ConfigReloader) Config() *AppConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload loads and validates the config again. If it's invalid nothing changes and the problems are returned.
+// Changes to settings that need a restart are returned and logged, but the running values are kept.
+func (r *ConfigReloader) Reload(reason string) ([]ConfigChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	config, _, err := r.Loader.Load(r.Args)
+	if err != nil {
+		log.WithFields(map[string]interface{}{"reason": reason, "error": err.Error()}).Error("Config reload failed")
+		return nil, err
+	}
+	problems := config.Validate()
+	var errorMessages []string
+	for _, problem := range problems {
+		if !problem.Warning {
+			errorMessages = append(errorMessages, problem.String())
+		}
+	}
+	if len(errorMessages) > 0 {
+		log.WithFields(map[string]interface{}{"reason": reason, "problems": errorMessages}).Error("Reloaded config is invalid, keeping the old one")
+		return nil, errors.New(strings.Join(errorMessages, "; "))
+	}
+
+	if config.IsLocal() && config.ServiceBaseURL == "" {
+		// Still using the local fake service started at startup.
+		config.ServiceBaseURL = r.current.ServiceBaseURL
+		config.sources["SERVICE_BASE_URL"] = r.current.Source("SERVICE_BASE_URL")
+		if config.HTTPClientTLSCAFile == "" && r.current.Source("HTTP_CLIENT_TLS_CA_FILE") == localFakeSource {
+			config.HTTPClientTLSCAFile = r.current.HTTPClientTLSCAFile
+			config.sources["HTTP_CLIENT_TLS_CA_FILE"] = localFakeSource
+		}
+	}
+	changes := ConfigChanges(r.current, config)
+	if len(changes) == 0 {
+		log.WithField("reason", reason).Info("Config reloaded, nothing changed")
+		return changes, nil
+	}
+	clientChanged, logChanged := false, false
+	for i, change := range changes {
+		clientChange := strings.HasPrefix(change.Setting, "HTTP_CLIENT_")
+		logChange := strings.HasPrefix(change.Setting, "LOG_") && r.LogControl != nil
+		clientChanged = clientChanged || clientChange
+		logChanged = logChanged || logChange
+		changes[i].Applied = clientChange || logChange
+		log.WithFields(map[string]interface{}{
+			"reason":  reason,
+			"setting": change.Setting,
+			"from":    change.From,
+			"to":      change.To,
+			"applied": changes[i].Applied,
+		}).Info("Config changed")
+		if !changes[i].Applied {
+			// Keep what's running, so Config is what's in effect and the next reload reports this again.
+			keepSetting(config, r.current, change.Setting)
+			log.WithField("setting", change.Setting).Warn("Setting requires a restart, keeping the running value")
+		}
+	}
+	r.current = config
+	if logChanged {
+		r.LogControl.Set(config.LogLevel, config.LogSampleRate)
+	}
+	if clientChanged {
+		drained := r.Client.Swap(NewHTTPClient(config, r.Conns))
+		go func() {
+			<-drained
+			log.Info("Old http client drained and its idle connections closed")
+		}()
+	}
+	return changes, nil
+}
+
+// WatchSignals reloads on SIGHUP.
+func (r *ConfigReloader) WatchSignals() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			r.Reload("SIGHUP")
+		}
+	}()
+}
+
+// WatchFile polls the config file, if there is one, and reloads when it's modified.
+func (r *ConfigReloader) WatchFile() {
+	path := r.Config().configFile
+	if path == "" {
+		return
+	}
+	lastModified := fileModTime(path)
+	go func() {
+		for range time.Tick(configWatchInterval) {
+			if modified := fileModTime(path); !modified.Equal(lastModified) {
+				lastModified = modified
+				r.Reload("config file changed")
+			}
+		}
+	}()
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// ServeHTTP is the admin endpoint: POST reloads and answers with what changed.
+func (r *ConfigReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST to reload the config", http.StatusMethodNotAllowed)
+		return
+	}
+	changes, err := r.Reload("admin endpoint")
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if changes == nil {
+		changes = []ConfigChange{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"changes": changes})
+}
+
+// keepSetting copies the named setting, and where it came from, from one config to another.
+func keepSetting(to, from *AppConfig, name string) {
+	for _, setting := range appConfigSettings() {
+		if setting.Name == name {
+			reflect.ValueOf(to).Elem().Field(setting.Index).Set(reflect.ValueOf(from).Elem().Field(setting.Index))
+			to.sources[name] = from.Source(name)
+			return
+		}
+	}
+}
+
+// ConfigChanges lists the settings whose values differ between two configs.
+func ConfigChanges(from, to *AppConfig) []ConfigChange {
+	var changes []ConfigChange
+	fromValue := reflect.ValueOf(from).Elem()
+	toValue := reflect.ValueOf(to).Elem()
+	for _, setting := range appConfigSettings() {
+		before := fromValue.Field(setting.Index).Interface()
+		after := toValue.Field(setting.Index).Interface()
+		if !reflect.DeepEqual(before, after) {
+			changes = append(changes, ConfigChange{Setting: setting.Name, From: setting.displayValue(before), To: setting.displayValue(after)})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestReloadKeepsSettingsThatNeedARestart(t *testing.T) {
+	config := testConfig(t, nil)
+	reloader := NewConfigReloader(nil, config, NewSwappableHTTPClient(NewHTTPClient(config, nil)))
+	reloader.Loader = testLoader(ioutil.Discard)
+	reloader.Args = testArgs(map[string]string{
+		"HTTP_CLIENT_TIMEOUT_MS": "2500",
+		"SERVICE_BASE_URL":       "http://127.0.0.1:9191/other",
+	})
+
+	for _, reload := range []string{"first", "second"} {
+		changes, err := reloader.Reload("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied := map[string]bool{}
+		for _, change := range changes {
+			applied[change.Setting] = change.Applied
+		}
+		want := map[string]bool{"SERVICE_BASE_URL": false}
+		if reload == "first" {
+			want["HTTP_CLIENT_TIMEOUT_MS"] = true
+		}
+		if len(applied) != len(want) || applied["SERVICE_BASE_URL"] || applied["HTTP_CLIENT_TIMEOUT_MS"] != want["HTTP_CLIENT_TIMEOUT_MS"] {
+			t.Errorf("%s reload changed %v, want %v", reload, applied, want)
+		}
+		running := reloader.Config()
+		if running.HTTPClientTimeoutMS != 2500 {
+			t.Errorf("after the %s reload HTTP_CLIENT_TIMEOUT_MS is %d, want 2500", reload, running.HTTPClientTimeoutMS)
+		}
+		if running.ServiceBaseURL != config.ServiceBaseURL || running.Source("SERVICE_BASE_URL") != config.Source("SERVICE_BASE_URL") {
+			t.Errorf("after the %s reload SERVICE_BASE_URL is %s from %s, want the running %s", reload,
+				running.ServiceBaseURL, running.Source("SERVICE_BASE_URL"), config.ServiceBaseURL)
+		}
+	}
+}
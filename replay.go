@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replayer sends recorded inbound requests to a running app, keeping the gaps between them.
+type Replayer struct {
+	Target     string
+	HTTPClient *http.Client
+	// Speed scales the gaps between requests: 1 is as recorded, 2 twice as fast. 0 means don't wait at all.
+	Speed float64
+}
+
+// ReplayResult sums up a replay.
+type ReplayResult struct {
+	Sent        int
+	StatusCodes map[int]int
+	Errors      map[string]int
+	LatencyMS   LatencySummary
+	// LatenessMS is how far behind schedule requests were sent, which says whether the replay kept up.
+	LatenessMS LatencySummary
+	Duration   time.Duration
+}
+
+func runReplayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	recordingPath := flags.String("recording", "", "JSONL traffic recording made with RECORD_FILE")
+	target := flags.String("target", "http://localhost:8000", "base URL of the app to replay against")
+	speed := flags.String("speed", "1", `how fast to replay: 1 keeps the recorded gaps, 2 halves them, "max" sends without waiting`)
+	timeoutMS := flags.Int("timeout-ms", 10000, "client timeout for each replayed request")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *recordingPath == "" {
+		fmt.Fprintln(os.Stderr, "replay: -recording is required")
+		return 2
+	}
+	replaySpeed, err := parseReplaySpeed(*speed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 2
+	}
+	records, err := ReadTrafficRecords(*recordingPath, InboundRecord)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	replayer := Replayer{
+		Target: strings.TrimRight(*target, "/"),
+		// Plenty of idle connections, so the replay client isn't what limits a production traffic shape.
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{MaxIdleConns: 1000, MaxIdleConnsPerHost: 1000},
+			Timeout:   time.Duration(*timeoutMS) * time.Millisecond,
+		},
+		Speed: replaySpeed,
+	}
+	result := replayer.Replay(records)
+	fmt.Printf("sent %d requests in %s\n", result.Sent, result.Duration)
+	fmt.Printf("latency ms: p50 %.1f p90 %.1f p99 %.1f max %.1f\n", result.LatencyMS.P50, result.LatencyMS.P90, result.LatencyMS.P99, result.LatencyMS.Max)
+	fmt.Printf("sent late by ms: p50 %.1f p99 %.1f max %.1f\n", result.LatenessMS.P50, result.LatenessMS.P99, result.LatenessMS.Max)
+	codes := make([]int, 0, len(result.StatusCodes))
+	for code := range result.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("status %d: %d\n", code, result.StatusCodes[code])
+	}
+	for class, count := range result.Errors {
+		fmt.Printf("error %s: %d\n", class, count)
+	}
+	return 0
+}
+
+func parseReplaySpeed(speed string) (float64, error) {
+	if speed == "max" {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(speed, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf(`speed must be a positive number or "max", got %q`, speed)
+	}
+	return value, nil
+}
+
+// Replay sends every record at its scheduled offset from the first one and waits for all the responses.
+func (rp Replayer) Replay(records []TrafficRecord) ReplayResult {
+	result := ReplayResult{StatusCodes: map[int]int{}, Errors: map[string]int{}}
+	if len(records) == 0 {
+		return result
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	latencies := make([]float64, 0, len(records))
+	lateness := make([]float64, 0, len(records))
+	first := records[0].Time
+	start := time.Now()
+	for _, record := range records {
+		due := start
+		if rp.Speed > 0 {
+			due = start.Add(time.Duration(float64(record.Time.Sub(first)) / rp.Speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		late := time.Since(due)
+		wg.Add(1)
+		go func(record TrafficRecord) {
+			defer wg.Done()
+			sent := time.Now()
+			statusCode, err := rp.send(record)
+			took := time.Since(sent)
+			mu.Lock()
+			defer mu.Unlock()
+			result.Sent++
+			latencies = append(latencies, durationMS(took))
+			lateness = append(lateness, durationMS(late))
+			if err != nil {
+				result.Errors[classifyError(err)]++
+				return
+			}
+			result.StatusCodes[statusCode]++
+		}(record)
+	}
+	wg.Wait()
+	result.Duration = time.Since(start)
+	result.LatencyMS = summarizeLatencies(latencies)
+	result.LatenessMS = summarizeLatencies(lateness)
+	return result
+}
+
+func (rp Replayer) send(record TrafficRecord) (int, error) {
+	req, err := http.NewRequest(record.Method, rp.Target+record.URL, strings.NewReader(record.RequestBody))
+	if err != nil {
+		return 0, err
+	}
+	for name, values := range record.RequestHeaders {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	resp, err := rp.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// histogramBuckets is how many buckets latency histograms get in reports, not counting overflow.
+const histogramBuckets = 40
+
+// Report is everything the HTML and Markdown reports show, worked out once so both say the same thing.
+type Report struct {
+	Title       string
+	GeneratedAt time.Time
+	Current     ExperimentResults
+	Baseline    *ExperimentResults
+	Alpha       float64
+	Comparisons []CellComparison
+}
+
+// CellComparison lines up the same cell from two runs.
+type CellComparison struct {
+	Name        string
+	Baseline    ExperimentCell
+	Current     ExperimentCell
+	P50DeltaMS  float64
+	P99DeltaMS  float64
+	Test        MannWhitneyResult
+	Significant bool
+}
+
+// Verdict sums up the comparison in a word or two.
+func (c CellComparison) Verdict() string {
+	if !c.Significant {
+		return "no significant change"
+	}
+	if c.Test.ProbabilityGreater > 0.5 {
+		return "slower"
+	}
+	return "faster"
+}
+
+func runReportCommand(args []string) int {
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	resultsPath := flags.String("results", "experiment-results.json", "results written by the experiment command")
+	baselinePath := flags.String("baseline", "", "optional earlier results to compare against")
+	htmlPath := flags.String("html", "report.html", "where to write the HTML report, empty to skip")
+	markdownPath := flags.String("markdown", "report.md", "where to write the Markdown report, empty to skip")
+	alpha := flags.Float64("alpha", 0.05, "p-value below which a latency difference counts as significant")
+	title := flags.String("title", "http-client-test experiment", "report title")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var current ExperimentResults
+	if err := decodeFile(*resultsPath, &current); err != nil {
+		fmt.Fprintln(os.Stderr, "report:", err)
+		return 1
+	}
+	var baseline *ExperimentResults
+	if *baselinePath != "" {
+		baseline = &ExperimentResults{}
+		if err := decodeFile(*baselinePath, baseline); err != nil {
+			fmt.Fprintln(os.Stderr, "report:", err)
+			return 1
+		}
+	}
+	report := NewReport(*title, current, baseline, *alpha)
+
+	if *htmlPath != "" {
+		if err := writeReportFile(*htmlPath, report, WriteHTMLReport); err != nil {
+			fmt.Fprintln(os.Stderr, "report:", err)
+			return 1
+		}
+	}
+	if *markdownPath != "" {
+		if err := writeReportFile(*markdownPath, report, WriteMarkdownReport); err != nil {
+			fmt.Fprintln(os.Stderr, "report:", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func writeReportFile(path string, report Report, write func(io.Writer, Report) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(file, report); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func NewReport(title string, current ExperimentResults, baseline *ExperimentResults, alpha float64) Report {
+	report := Report{Title: title, GeneratedAt: time.Now(), Current: current, Baseline: baseline, Alpha: alpha}
+	if baseline == nil {
+		return report
+	}
+	baselineCells := make(map[string]ExperimentCell, len(baseline.Cells))
+	for _, cell := range baseline.Cells {
+		baselineCells[cell.Name] = cell
+	}
+	for _, cell := range current.Cells {
+		before, ok := baselineCells[cell.Name]
+		if !ok {
+			continue
+		}
+		test := MannWhitneyU(before.LatencySamplesMS, cell.LatencySamplesMS)
+		report.Comparisons = append(report.Comparisons, CellComparison{
+			Name:        cell.Name,
+			Baseline:    before,
+			Current:     cell,
+			P50DeltaMS:  cell.LatencyMS.P50 - before.LatencyMS.P50,
+			P99DeltaMS:  cell.LatencyMS.P99 - before.LatencyMS.P99,
+			Test:        test,
+			Significant: test.P < alpha,
+		})
+	}
+	return report
+}
+
+// histogramUpperMS picks where histograms stop so that a few slow outliers don't squash everything
+// else into the first bucket; anything slower lands in the overflow bucket.
+func histogramUpperMS(cells ...ExperimentCell) float64 {
+	upper := 0.0
+	for _, cell := range cells {
+		upper = math.Max(upper, cell.LatencyMS.P99)
+	}
+	return upper * 1.1
+}
+
+// reportPhases are the tracePhases that follow one another, so they can be stacked.
+var reportPhases = []string{"connwait", "write", "wait", "read"}
+
+// reportInnerPhases are the tracePhases that happen inside "connwait" when a connection is opened.
+var reportInnerPhases = []string{"dns", "connect", "proxy", "tls"}
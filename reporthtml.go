@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+)
+
+// The HTML report is a single file with the CSS and charts (inline SVG) built in,
+// so it can be attached to a ticket or opened offline.
+
+var (
+	currentColour  = "#4e79a7"
+	baselineColour = "#f28e2b"
+	phaseColours   = map[string]string{"connwait": "#e15759", "write": "#76b7b2", "wait": "#4e79a7", "read": "#59a14f"}
+	reuseColour    = "#59a14f"
+	dialColour     = "#f28e2b"
+)
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"histogram":       cellHistogramSVG,
+	"comparison":      comparisonHistogramSVG,
+	"phases":          phasesSVG,
+	"reuse":           reuseSVG,
+	"errors":          formatErrorClasses,
+	"phaseNames":      func() []string { return reportPhases },
+	"phaseNamesInner": func() []string { return reportInnerPhases },
+	"phase":           func(cell ExperimentCell, name string) LatencySummary { return cell.PhasesMS[name] },
+	"phaseColour":     func(name string) string { return phaseColours[name] },
+	"currentColour":   func() string { return currentColour },
+	"baselineColour":  func() string { return baselineColour },
+	"signedMS":        func(ms float64) string { return fmt.Sprintf("%+.1fms", ms) },
+	"pValue":          func(p float64) string { return fmt.Sprintf("%.3g", p) },
+	"percent":         func(f float64) string { return fmt.Sprintf("%.0f%%", f*100) },
+	"formatTimestamp": func(r Report) string { return r.GeneratedAt.Format("2006-01-02 15:04:05 MST") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: right; }
+th { background: #f4f4f4; }
+td.name, th.name { text-align: left; }
+.cell { border-top: 1px solid #ccc; margin-top: 2em; padding-top: 1em; }
+.swatch { display: inline-block; width: 0.8em; height: 0.8em; margin: 0 0.3em 0 1em; }
+.significant { font-weight: bold; }
+.slower { color: #c0392b; }
+.faster { color: #27ae60; }
+svg text { font-size: 10px; fill: #555; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{formatTimestamp .}} from a run started {{.Current.StartedAt.Format "2006-01-02 15:04:05 MST"}}
+({{.Current.Matrix.Requests}} requests per cell, concurrency {{.Current.Matrix.Concurrency}}).</p>
+
+<h2>Summary</h2>
+<table>
+<tr><th class="name">cell</th><th>errors</th><th>p50</th><th>p90</th><th>p99</th><th>max</th><th>new dials</th><th>reuses</th><th>peak conns</th><th>req/s</th></tr>
+{{range .Current.Cells}}<tr><td class="name">{{.Name}}</td><td>{{errors .}}</td><td>{{printf "%.1f" .LatencyMS.P50}}</td><td>{{printf "%.1f" .LatencyMS.P90}}</td><td>{{printf "%.1f" .LatencyMS.P99}}</td><td>{{printf "%.1f" .LatencyMS.Max}}</td><td>{{.NewDials}}</td><td>{{.Reuses}}</td><td>{{.PeakOpenConnections}}</td><td>{{printf "%.0f" .RequestsPerSecond}}</td></tr>
+{{end}}</table>
+<p>Latencies in milliseconds.</p>
+
+<h2>Connection reuse</h2>
+{{reuse .Current.Cells}}
+
+{{if .Baseline}}
+<h2>Compared with the run started {{.Baseline.StartedAt.Format "2006-01-02 15:04:05 MST"}}</h2>
+<p>Each cell is compared with the cell of the same name using a two-sided Mann-Whitney U test on the latency samples.
+Differences with p &lt; {{.Alpha}} are marked significant.
+<span class="swatch" style="background:{{baselineColour}}"></span>baseline
+<span class="swatch" style="background:{{currentColour}}"></span>this run</p>
+<table>
+<tr><th class="name">cell</th><th>p50 change</th><th>p99 change</th><th>errors before</th><th>errors now</th><th>P(slower)</th><th>p-value</th><th class="name">verdict</th></tr>
+{{range .Comparisons}}<tr{{if .Significant}} class="significant"{{end}}><td class="name">{{.Name}}</td><td>{{signedMS .P50DeltaMS}}</td><td>{{signedMS .P99DeltaMS}}</td><td>{{.Baseline.ErrorCount}}</td><td>{{.Current.ErrorCount}}</td><td>{{percent .Test.ProbabilityGreater}}</td><td>{{pValue .Test.P}}</td><td class="name {{.Verdict}}">{{.Verdict}}</td></tr>
+{{end}}</table>
+{{range .Comparisons}}<h3>{{.Name}}</h3>
+{{comparison .}}
+{{end}}
+{{end}}
+
+<h2>Cells</h2>
+{{range .Current.Cells}}<div class="cell">
+<h3>{{.Name}}</h3>
+<p>MaxIdleConnsPerHost {{.Settings.MaxIdleConnsPerHost}}, IdleConnTimeout {{.Settings.IdleConnTimeoutMS}}ms,
+Timeout {{.Settings.TimeoutMS}}ms, latency profile {{.Settings.LatencyProfile}}.</p>
+<h4>Latency</h4>
+{{histogram .}}
+<h4>Where the time went</h4>
+{{phases .}}
+<table>
+<tr><th class="name">phase</th><th>mean</th><th>p50</th><th>p90</th><th>p99</th><th>max</th></tr>
+{{$cell := .}}{{range phaseNames}}{{$phase := phase $cell .}}<tr><td class="name"><span class="swatch" style="background:{{phaseColour .}}"></span>{{.}}</td><td>{{printf "%.2f" $phase.Mean}}</td><td>{{printf "%.2f" $phase.P50}}</td><td>{{printf "%.2f" $phase.P90}}</td><td>{{printf "%.2f" $phase.P99}}</td><td>{{printf "%.2f" $phase.Max}}</td></tr>
+{{end}}{{range $name := phaseNamesInner}}{{$phase := phase $cell $name}}<tr><td class="name">&nbsp;&nbsp;{{$name}}</td><td>{{printf "%.2f" $phase.Mean}}</td><td>{{printf "%.2f" $phase.P50}}</td><td>{{printf "%.2f" $phase.P90}}</td><td>{{printf "%.2f" $phase.P99}}</td><td>{{printf "%.2f" $phase.Max}}</td></tr>
+{{end}}</table>
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+func WriteHTMLReport(w io.Writer, report Report) error {
+	return htmlReportTemplate.Execute(w, report)
+}
+
+const (
+	chartWidth  = 640
+	chartHeight = 160
+	chartMargin = 24
+)
+
+func cellHistogramSVG(cell ExperimentCell) template.HTML {
+	upper := histogramUpperMS(cell)
+	return histogramSVG(upper, []Histogram{NewHistogram(cell.LatencySamplesMS, upper, histogramBuckets)}, []string{currentColour})
+}
+
+func comparisonHistogramSVG(comparison CellComparison) template.HTML {
+	upper := histogramUpperMS(comparison.Baseline, comparison.Current)
+	return histogramSVG(upper, []Histogram{
+		NewHistogram(comparison.Baseline.LatencySamplesMS, upper, histogramBuckets),
+		NewHistogram(comparison.Current.LatencySamplesMS, upper, histogramBuckets),
+	}, []string{baselineColour, currentColour})
+}
+
+// histogramSVG draws histograms sharing the same buckets on top of each other, with the overflow bucket last.
+func histogramSVG(upperMS float64, histograms []Histogram, colours []string) template.HTML {
+	var svg bytes.Buffer
+	plotWidth := float64(chartWidth - 2*chartMargin)
+	plotHeight := float64(chartHeight - 2*chartMargin)
+	barWidth := plotWidth / float64(histogramBuckets+1)
+	maxCount := 1
+	for _, histogram := range histograms {
+		if count := histogram.MaxCount(); count > maxCount {
+			maxCount = count
+		}
+	}
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`, chartWidth, chartHeight)
+	for i, histogram := range histograms {
+		counts := append(append([]int(nil), histogram.Counts...), histogram.Overflow)
+		for bucket, count := range counts {
+			if count == 0 {
+				continue
+			}
+			height := plotHeight * float64(count) / float64(maxCount)
+			fmt.Fprintf(&svg, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" fill-opacity="0.6"><title>%d</title></rect>`,
+				float64(chartMargin)+float64(bucket)*barWidth, float64(chartMargin)+plotHeight-height, barWidth-1, height, colours[i], count)
+		}
+	}
+	axisY := float64(chartMargin) + plotHeight
+	fmt.Fprintf(&svg, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#999"/>`, chartMargin, axisY, chartWidth-chartMargin, axisY)
+	fmt.Fprintf(&svg, `<text x="%d" y="%.1f">0ms</text>`, chartMargin, axisY+14)
+	fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" text-anchor="middle">%.1fms</text>`, float64(chartMargin)+plotWidth/2-barWidth/2, axisY+14, upperMS/2)
+	fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" text-anchor="end">%.1fms</text>`, float64(chartMargin)+plotWidth-barWidth, axisY+14, upperMS)
+	fmt.Fprintf(&svg, `<text x="%d" y="%.1f" text-anchor="end">&gt;</text>`, chartWidth-chartMargin, axisY+14)
+	fmt.Fprintf(&svg, `<text x="%d" y="%d">%d calls</text>`, chartMargin, chartMargin-6, maxCount)
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
+
+// phasesSVG stacks the mean time spent in each phase so it's obvious which one dominates.
+func phasesSVG(cell ExperimentCell) template.HTML {
+	var svg bytes.Buffer
+	total := 0.0
+	for _, name := range reportPhases {
+		total += cell.PhasesMS[name].Mean
+	}
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="40">`, chartWidth)
+	if total > 0 {
+		x := float64(chartMargin)
+		for _, name := range reportPhases {
+			width := float64(chartWidth-2*chartMargin) * cell.PhasesMS[name].Mean / total
+			fmt.Fprintf(&svg, `<rect x="%.1f" y="4" width="%.1f" height="20" fill="%s"><title>%s %.2fms</title></rect>`,
+				x, width, phaseColours[name], html.EscapeString(name), cell.PhasesMS[name].Mean)
+			x += width
+		}
+		fmt.Fprintf(&svg, `<text x="%d" y="36">mean %.2fms per call</text>`, chartMargin, total)
+	}
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
+
+// reuseSVG draws a bar per cell split between calls that reused a pooled connection and calls that dialled.
+func reuseSVG(cells []ExperimentCell) template.HTML {
+	var svg bytes.Buffer
+	rowHeight := 22
+	labelWidth := 300
+	barWidth := float64(chartWidth + 160 - labelWidth - chartMargin)
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`, chartWidth+160, rowHeight*len(cells)+rowHeight)
+	for i, cell := range cells {
+		y := i * rowHeight
+		calls := cell.Reuses + cell.NewDials
+		fmt.Fprintf(&svg, `<text x="0" y="%d">%s</text>`, y+14, html.EscapeString(cell.Name))
+		if calls == 0 {
+			continue
+		}
+		reused := barWidth * float64(cell.Reuses) / float64(calls)
+		fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="%.1f" height="16" fill="%s"><title>%d reused</title></rect>`, labelWidth, y+2, reused, reuseColour, cell.Reuses)
+		fmt.Fprintf(&svg, `<rect x="%.1f" y="%d" width="%.1f" height="16" fill="%s"><title>%d new dials</title></rect>`, float64(labelWidth)+reused, y+2, barWidth-reused, dialColour, cell.NewDials)
+		fmt.Fprintf(&svg, `<text x="%d" y="%d" fill="#fff">%d reused / %d dialled, peak %d open</text>`, labelWidth+4, y+14, cell.Reuses, cell.NewDials, cell.PeakOpenConnections)
+	}
+	fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/><text x="%d" y="%d">reused</text>`, labelWidth, len(cells)*rowHeight+6, reuseColour, labelWidth+14, len(cells)*rowHeight+15)
+	fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/><text x="%d" y="%d">new dial</text>`, labelWidth+70, len(cells)*rowHeight+6, dialColour, labelWidth+84, len(cells)*rowHeight+15)
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// sparkBlocks draw histograms in plain text, lowest to highest.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// WriteMarkdownReport writes the same content as the HTML report, with text sparklines instead of charts,
+// for pasting into pull requests and wiki pages.
+func WriteMarkdownReport(w io.Writer, report Report) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "# %s\n\n", report.Title)
+	fmt.Fprintf(out, "Generated %s from a run started %s (%d requests per cell, concurrency %d).\n\n",
+		report.GeneratedAt.Format("2006-01-02 15:04:05 MST"),
+		report.Current.StartedAt.Format("2006-01-02 15:04:05 MST"),
+		report.Current.Matrix.Requests,
+		report.Current.Matrix.Concurrency)
+
+	fmt.Fprintf(out, "## Summary\n\nLatencies in milliseconds.\n\n")
+	fmt.Fprintln(out, "| cell | errors | p50 | p90 | p99 | max | new dials | reuses | reused | peak conns | req/s |")
+	fmt.Fprintln(out, "|---|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|")
+	for _, cell := range report.Current.Cells {
+		fmt.Fprintf(out, "| %s | %s | %.1f | %.1f | %.1f | %.1f | %d | %d | %s | %d | %.0f |\n",
+			cell.Name, formatErrorClasses(cell),
+			cell.LatencyMS.P50, cell.LatencyMS.P90, cell.LatencyMS.P99, cell.LatencyMS.Max,
+			cell.NewDials, cell.Reuses, reusedPercent(cell), cell.PeakOpenConnections, cell.RequestsPerSecond)
+	}
+
+	if report.Baseline != nil {
+		fmt.Fprintf(out, "\n## Compared with the run started %s\n\n", report.Baseline.StartedAt.Format("2006-01-02 15:04:05 MST"))
+		fmt.Fprintf(out, "Two-sided Mann-Whitney U test on the latency samples of cells with the same name; significant means p < %g.\n\n", report.Alpha)
+		fmt.Fprintln(out, "| cell | p50 change | p99 change | errors before | errors now | P(slower) | p-value | verdict |")
+		fmt.Fprintln(out, "|---|---:|---:|---:|---:|---:|---:|---|")
+		for _, comparison := range report.Comparisons {
+			verdict := comparison.Verdict()
+			if comparison.Significant {
+				verdict = "**" + verdict + "**"
+			}
+			fmt.Fprintf(out, "| %s | %+.1fms | %+.1fms | %d | %d | %.0f%% | %.3g | %s |\n",
+				comparison.Name, comparison.P50DeltaMS, comparison.P99DeltaMS,
+				comparison.Baseline.ErrorCount, comparison.Current.ErrorCount,
+				comparison.Test.ProbabilityGreater*100, comparison.Test.P, verdict)
+		}
+		fmt.Fprintln(out)
+		for _, comparison := range report.Comparisons {
+			upper := histogramUpperMS(comparison.Baseline, comparison.Current)
+			fmt.Fprintf(out, "%s, 0 to %.1fms then overflow:\n\n```\nbaseline %s\nthis run %s\n```\n\n",
+				comparison.Name, upper,
+				sparkline(NewHistogram(comparison.Baseline.LatencySamplesMS, upper, histogramBuckets)),
+				sparkline(NewHistogram(comparison.Current.LatencySamplesMS, upper, histogramBuckets)))
+		}
+	}
+
+	fmt.Fprintf(out, "\n## Cells\n")
+	for _, cell := range report.Current.Cells {
+		upper := histogramUpperMS(cell)
+		fmt.Fprintf(out, "\n### %s\n\n", cell.Name)
+		fmt.Fprintf(out, "MaxIdleConnsPerHost %d, IdleConnTimeout %dms, Timeout %dms, latency profile %s.\n\n",
+			cell.Settings.MaxIdleConnsPerHost, cell.Settings.IdleConnTimeoutMS, cell.Settings.TimeoutMS, cell.Settings.LatencyProfile)
+		fmt.Fprintf(out, "Latency, 0 to %.1fms then overflow:\n\n```\n%s\n```\n\n", upper,
+			sparkline(NewHistogram(cell.LatencySamplesMS, upper, histogramBuckets)))
+		fmt.Fprintln(out, "| phase | mean | p50 | p90 | p99 | max |")
+		fmt.Fprintln(out, "|---|---:|---:|---:|---:|---:|")
+		for _, name := range append(append([]string(nil), reportPhases...), reportInnerPhases...) {
+			phase := cell.PhasesMS[name]
+			fmt.Fprintf(out, "| %s | %.2f | %.2f | %.2f | %.2f | %.2f |\n", name, phase.Mean, phase.P50, phase.P90, phase.P99, phase.Max)
+		}
+	}
+	return out.Flush()
+}
+
+func sparkline(histogram Histogram) string {
+	maxCount := histogram.MaxCount()
+	var line bytes.Buffer
+	for _, count := range append(append([]int(nil), histogram.Counts...), histogram.Overflow) {
+		switch {
+		case count == 0:
+			line.WriteRune(' ')
+		default:
+			line.WriteRune(sparkBlocks[(count*(len(sparkBlocks)-1)+maxCount-1)/maxCount])
+		}
+	}
+	return line.String()
+}
+
+func reusedPercent(cell ExperimentCell) string {
+	calls := cell.Reuses + cell.NewDials
+	if calls == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", 100*float64(cell.Reuses)/float64(calls))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RequestTrace collects what httptrace tells us about a single call to the service.
+// The httptrace hooks can fire from the transport's own goroutines, so access goes through a mutex.
+type RequestTrace struct {
+	mu         sync.Mutex
+	RequestID  string
+	Start      time.Time
+	End        time.Time
+	Timings    map[string]time.Time
+	GotConn    bool
+	Reused     bool
+	WasIdle    bool
+	StatusCode int
+	Err        error
+	// Endpoint is the address of the instance of the service the call went to, when there's a choice.
+	Endpoint string
+	// Protocol is what the call went over, e.g. HTTP/1.1 or HTTP/2.0.
+	Protocol string
+	// TLS is what the TLS handshake settled on, for calls that opened an https connection.
+	TLS *TLSInfo
+	// ConnectTCPInfo is the connection's TCP_INFO just after it was opened, for calls that opened one.
+	// TCPInfo is from when the call was done with the connection. Both are nil where TCP_INFO isn't available.
+	ConnectTCPInfo *TCPInfo
+	TCPInfo        *TCPInfo
+
+	// conn is the connection dialled for the call, for markProxyConnectDone to record where a CONNECT tunnels it to.
+	conn *TrackedConn
+}
+
+// TraceRecorder receives a snapshot of every RequestTrace once the call to the service is done.
+type TraceRecorder interface {
+	Record(trace *RequestTrace)
+}
+
+func newRequestTrace(requestID string) *RequestTrace {
+	return &RequestTrace{
+		RequestID: requestID,
+		Start:     time.Now(),
+		Timings:   make(map[string]time.Time),
+	}
+}
+
+type requestTraceKey struct{}
+
+// withRequestTrace puts trace in ctx, for hooks outside httptrace that only get the context,
+// like the transport's proxy callbacks.
+func withRequestTrace(ctx context.Context, trace *RequestTrace) context.Context {
+	return context.WithValue(ctx, requestTraceKey{}, trace)
+}
+
+// contextRequestTrace is the trace withRequestTrace put in ctx, or nil.
+func contextRequestTrace(ctx context.Context) *RequestTrace {
+	trace, _ := ctx.Value(requestTraceKey{}).(*RequestTrace)
+	return trace
+}
+
+// Mark records the time an httptrace event happened.
+func (t *RequestTrace) Mark(event string) {
+	t.mu.Lock()
+	t.Timings[event] = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *RequestTrace) gotConn(reused bool, wasIdle bool) {
+	t.mu.Lock()
+	t.Timings["gotconn"] = time.Now()
+	t.GotConn = true
+	t.Reused = reused
+	t.WasIdle = wasIdle
+	t.mu.Unlock()
+}
+
+func (t *RequestTrace) tcpInfo(connect *TCPInfo, response *TCPInfo) {
+	t.mu.Lock()
+	if connect != nil {
+		t.ConnectTCPInfo = connect
+	}
+	if response != nil {
+		t.TCPInfo = response
+	}
+	t.mu.Unlock()
+}
+
+func (t *RequestTrace) tls(info *TLSInfo) {
+	t.mu.Lock()
+	t.TLS = info
+	t.mu.Unlock()
+}
+
+func (t *RequestTrace) dialed(conn *TrackedConn) {
+	t.mu.Lock()
+	t.conn = conn
+	t.mu.Unlock()
+}
+
+func (t *RequestTrace) dialedConn() *TrackedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn
+}
+
+func (t *RequestTrace) endpoint(address string) {
+	t.mu.Lock()
+	t.Endpoint = address
+	t.mu.Unlock()
+}
+
+func (t *RequestTrace) protocol(proto string) {
+	t.mu.Lock()
+	t.Protocol = proto
+	t.mu.Unlock()
+}
+
+func (t *RequestTrace) finish(statusCode int, err error) {
+	t.mu.Lock()
+	t.End = time.Now()
+	t.StatusCode = statusCode
+	t.Err = err
+	t.mu.Unlock()
+}
+
+// Snapshot returns a copy that is safe to hand to a TraceRecorder.
+func (t *RequestTrace) Snapshot() *RequestTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timings := make(map[string]time.Time, len(t.Timings))
+	for event, at := range t.Timings {
+		timings[event] = at
+	}
+	return &RequestTrace{
+		RequestID:  t.RequestID,
+		Start:      t.Start,
+		End:        t.End,
+		Timings:    timings,
+		GotConn:    t.GotConn,
+		Reused:     t.Reused,
+		WasIdle:    t.WasIdle,
+		StatusCode: t.StatusCode,
+		Err:        t.Err,
+		Endpoint:   t.Endpoint,
+		Protocol:   t.Protocol,
+		TLS:        t.TLS,
+
+		ConnectTCPInfo: t.ConnectTCPInfo,
+		TCPInfo:        t.TCPInfo,
+	}
+}
+
+// Duration is how long the whole call to the service took.
+func (t *RequestTrace) Duration() time.Duration {
+	return t.End.Sub(t.Start)
+}
+
+// tracePhases are the parts of a call worth timing, each running from one httptrace event to another.
+// "connwait", "write", "wait" and "read" follow one another and add up to the whole call;
+// "dns", "connect", "proxy" and "tls" happen inside "connwait" when a new connection is dialled,
+// where "proxy" is the CONNECT or SOCKS5 handshake with HTTP_CLIENT_PROXY_URL.
+var tracePhases = []struct {
+	Name  string
+	From  string
+	Until string
+}{
+	{"connwait", "getconn", "gotconn"},
+	{"dns", "dnsstart", "dnsdone"},
+	{"connect", "connectstart", "connectdone"},
+	{"proxy", "proxyconnectstart", "proxyconnectdone"},
+	{"tls", "tlshandshakestart", "tlshandshakedone"},
+	{"write", "gotconn", "wroterequest"},
+	{"wait", "wroterequest", "gotfirstresponsebyte"},
+	{"read", "gotfirstresponsebyte", "end"},
+}
+
+// Phases returns how long each phase in tracePhases took, leaving out the ones that didn't happen.
+func (t *RequestTrace) Phases() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	phases := make(map[string]time.Duration)
+	for _, phase := range tracePhases {
+		from, ok := t.Timings[phase.From]
+		if !ok {
+			continue
+		}
+		until, ok := t.Timings[phase.Until]
+		if phase.Until == "end" {
+			until, ok = t.End, !t.End.IsZero()
+		}
+		if ok {
+			phases[phase.Name] = until.Sub(from)
+		}
+	}
+	return phases
+}
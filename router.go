@@ -5,13 +5,21 @@ import (
 	"net/http"
 )
 
-func NewRouter(handler http.Handler) http.Handler {
+// NewRouter serves the api handler on /api, and each of internalHandlers under /internal/ by name.
+// InternalHealthCheck is used for /internal/healthcheck unless internalHandlers has its own.
+func NewRouter(handler http.Handler, internalHandlers map[string]http.Handler) http.Handler {
 
 	serveMux := http.NewServeMux()
 
 	// Add healthcheck handler
 
-	serveMux.HandleFunc("/internal/healthcheck", InternalHealthCheck)
+	if _, ok := internalHandlers["healthcheck"]; !ok {
+		serveMux.HandleFunc("/internal/healthcheck", InternalHealthCheck)
+	}
+
+	for name, internalHandler := range internalHandlers {
+		serveMux.Handle("/internal/"+name, internalHandler)
+	}
 
 	// Add api handler
 	apiPath := "/api"
@@ -1,25 +1,16 @@
 #!/bin/bash -e
 
 function lintAppCode() {
-    gometalinter \
-        --vendor \
-        --exclude='error return value not checked.*(Close|Log|Print).*\(errcheck\)$' \
-        --exclude='.*_test\.go:.*error return value not checked.*\(errcheck\)$' \
-        --exclude='duplicate of.*_test.go.*\(dupl\)$' \
-        --disable=aligncheck \
-        --disable=golint \
-        --disable=gotype \
-        --disable=structcheck \
-        --disable=varcheck \
-        --disable=unconvert \
-        --disable=aligncheck \
-        --disable=dupl \
-        --disable=goconst  \
-        --disable=gosimple  \
-        --disable=staticcheck \
-        --cyclo-over=20 \
-        --tests \
-        --deadline=30s
+    (
+        cd "$PROJECT_BASE_DIR"
+        go vet $(go list ./... | grep -v /vendor/)
+        unformatted=$(gofmt -l $(find . -name '*.go' -not -path './vendor/*'))
+        if [ -n "$unformatted" ]; then
+            echo "gofmt needs running on:"
+            echo "$unformatted"
+            exit 1
+        fi
+    )
 }
 
 function fmtAppCode() {
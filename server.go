@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Server is the app's http.Server plus what it takes to stop it without dropping calls:
+//
+//  1. health checks start failing, so the load balancer stops sending new requests
+//  2. it waits DrainPeriod for the load balancer to notice
+//  3. it stops accepting connections and waits up to ShutdownTimeout for requests in flight to finish
+//  4. it stops Background, the work it does on timers, like sampling sockets and refreshing endpoints
+//  5. it closes the upstream client's idle connections
+type Server struct {
+	HTTPServer      *http.Server
+	HTTPClient      *SwappableHTTPClient
+	DrainPeriod     time.Duration
+	ShutdownTimeout time.Duration
+	SocketOptions   SocketOptions
+	Background      []interface{ Stop() }
+
+	shuttingDown int32
+}
+
+func NewServer(config *AppConfig, handler http.Handler, httpClient *SwappableHTTPClient) *Server {
+	httpServer := &http.Server{
+		Addr:              fmt.Sprintf(":%d", config.Port),
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(config.ServerReadHeaderTimeoutMS) * time.Millisecond,
+		ReadTimeout:       time.Duration(config.ServerReadTimeoutMS) * time.Millisecond,
+		WriteTimeout:      time.Duration(config.ServerWriteTimeoutMS) * time.Millisecond,
+		IdleTimeout:       time.Duration(config.ServerIdleTimeoutMS) * time.Millisecond,
+		MaxHeaderBytes:    config.ServerMaxHeaderBytes,
+	}
+	httpServer.SetKeepAlivesEnabled(config.ServerKeepAlives)
+	return &Server{
+		HTTPServer:      httpServer,
+		HTTPClient:      httpClient,
+		DrainPeriod:     time.Duration(config.ShutdownDrainMS) * time.Millisecond,
+		ShutdownTimeout: time.Duration(config.ShutdownTimeoutMS) * time.Millisecond,
+		SocketOptions:   serverSocketOptions(config),
+	}
+}
+
+// ShuttingDown is true from the moment shutdown starts.
+func (s *Server) ShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 1
+}
+
+// HealthCheck is InternalHealthCheck, except it fails once shutdown has started.
+func (s *Server) HealthCheck() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.ShuttingDown() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "Shutting down")
+			return
+		}
+		InternalHealthCheck(w, r)
+	})
+}
+
+// Run serves until the server fails or a signal arrives, then shuts down gracefully.
+// A second signal while shutting down exits straight away.
+func (s *Server) Run(signals <-chan os.Signal) error {
+	listenConfig := net.ListenConfig{Control: s.SocketOptions.Control}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", s.HTTPServer.Addr)
+	if err != nil {
+		return err
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.HTTPServer.Serve(socketOptionsListener{listener, s.SocketOptions})
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		log.WithField("signal", sig.String()).Info("Shutting down")
+		go func() {
+			sig := <-signals
+			log.WithField("signal", sig.String()).Warn("Second signal, exiting without waiting")
+			os.Exit(1)
+		}()
+		return s.Shutdown()
+	}
+}
+
+// Shutdown runs the shutdown sequence. Requests still running after ShutdownTimeout are dropped.
+func (s *Server) Shutdown() error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	log.WithField("drainMS", durationMS(s.DrainPeriod)).Info("Failing health checks while load balancers notice")
+	time.Sleep(s.DrainPeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	log.WithField("timeoutMS", durationMS(s.ShutdownTimeout)).Info("Waiting for requests in flight")
+	err := s.HTTPServer.Shutdown(ctx)
+	if err != nil {
+		log.WithField("error", err.Error()).Warn("Requests still in flight after the shutdown timeout, dropping them")
+		s.HTTPServer.Close()
+	}
+	for _, background := range s.Background {
+		background.Stop()
+	}
+	if s.HTTPClient != nil {
+		s.HTTPClient.Client().CloseIdleConnections()
+	}
+	log.Info("Shut down")
+	return err
+}
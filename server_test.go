@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startTestServer serves a health check and a /slow endpoint that takes slow to answer, on a loopback port.
+func startTestServer(t *testing.T, drain, timeout, slow time.Duration) (*Server, string) {
+	server := &Server{HTTPServer: &http.Server{}, DrainPeriod: drain, ShutdownTimeout: timeout}
+	mux := http.NewServeMux()
+	mux.Handle("/health", server.HealthCheck())
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(slow)
+		w.Write([]byte("done"))
+	})
+	server.HTTPServer.Handler = mux
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.HTTPServer.Serve(listener)
+	return server, "http://" + listener.Addr().String()
+}
+
+// get makes a request on a new connection, so one closed by shutdown isn't reused.
+func get(url string) (int, error) {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestShutdownFailsHealthChecksWhileDraining(t *testing.T) {
+	server, url := startTestServer(t, 300*time.Millisecond, time.Second, 0)
+	if status, err := get(url + "/health"); err != nil || status != http.StatusOK {
+		t.Fatalf("before shutdown: %d, %v, want 200", status, err)
+	}
+	done := make(chan error)
+	go func() { done <- server.Shutdown() }()
+	time.Sleep(100 * time.Millisecond)
+
+	// The listener is still open, so the load balancer gets an answer, and it's a failure.
+	if status, err := get(url + "/health"); err != nil || status != http.StatusServiceUnavailable {
+		t.Errorf("while draining: %d, %v, want 503", status, err)
+	}
+	if status, err := get(url + "/slow"); err != nil || status != http.StatusOK {
+		t.Errorf("request while draining: %d, %v, want it served", status, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if _, err := get(url + "/health"); err == nil {
+		t.Error("still accepting connections after shutdown")
+	}
+}
+
+func TestShutdownWaitsOutDrainPeriod(t *testing.T) {
+	drain := 250 * time.Millisecond
+	server, _ := startTestServer(t, drain, time.Second, 0)
+	start := time.Now()
+	if err := server.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if took := time.Since(start); took < drain {
+		t.Errorf("Shutdown took %s, want at least the drain period of %s", took, drain)
+	}
+}
+
+func TestShutdownStopsBackgroundWork(t *testing.T) {
+	server, _ := startTestServer(t, 0, time.Second, 0)
+	sampler := &SocketSampler{Endpoints: testBalancer(t, BalancerRoundRobin, "10.0.0.1:80"), Interval: 5 * time.Millisecond}
+	sampler.Start()
+	server.Background = []interface{ Stop() }{sampler}
+	if err := server.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	last := sampler.Latest()
+	time.Sleep(5 * sampler.Interval)
+	if sampler.Latest() != last {
+		t.Error("the socket sampler is still sampling after shutdown")
+	}
+}
+
+func TestShutdownWaitsForRequestsInFlight(t *testing.T) {
+	server, url := startTestServer(t, 0, 2*time.Second, 300*time.Millisecond)
+	result := make(chan error)
+	go func() {
+		_, err := get(url + "/slow")
+		result <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := server.Shutdown(); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("request in flight failed: %v, want it to finish", err)
+	}
+}
+
+func TestShutdownCutsOffRequestsAfterTimeout(t *testing.T) {
+	timeout := 200 * time.Millisecond
+	server, url := startTestServer(t, 0, timeout, 3*time.Second)
+	result := make(chan error)
+	go func() {
+		_, err := get(url + "/slow")
+		result <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if err := server.Shutdown(); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if took := time.Since(start); took > timeout+time.Second {
+		t.Errorf("Shutdown took %s, want about the timeout of %s", took, timeout)
+	}
+	if err := <-result; err == nil {
+		t.Error("request in flight past the timeout finished, want it cut off")
+	}
+}
+
+func TestShutdownClosesUpstreamConnections(t *testing.T) {
+	endpoints, err := LoadFakeEndpoints("fakes/fake-service.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := NewFakeUpstream(endpoints, nil)
+	if err := upstream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	server, _ := startTestServer(t, 0, time.Second, 0)
+	server.HTTPClient = NewSwappableHTTPClient(NewHTTPClient(testConfig(t, nil), NewConnRegistry()))
+	service := Service{BaseURL: upstream.URL + "/service", HttpClient: server.HTTPClient}
+	if _, err := service.Call(ServiceRequest{RequestID: "shutdown"}); err != nil {
+		t.Fatal(err)
+	}
+	if open := upstream.OpenConnections(); open != 1 {
+		t.Fatalf("%d upstream connections open after a call, want the one kept alive", open)
+	}
+	if err := server.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	// The upstream notices the close when it next reads from the connection.
+	for deadline := time.Now().Add(time.Second); upstream.OpenConnections() != 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d upstream connections still open after shutdown, want 0", upstream.OpenConnections())
+		}
+	}
+}
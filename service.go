@@ -1,20 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptrace"
 	"strings"
-	"time"
+	"sync"
 )
 
+// ErrNon200Response is returned by Call when the service answers with anything but a 200.
+var ErrNon200Response = errors.New("Service returned non-200 response")
+
 // Service sends requests to a remote HTTP API
 type Service struct {
-	BaseURL    string
-	HttpClient HttpClient
+	BaseURL       string
+	HttpClient    HttpClient
+	TraceRecorder TraceRecorder
+	// TrafficRecorder, when set, gets every exchange with the service including headers and bodies.
+	TrafficRecorder *TrafficRecorder
+	// Endpoints, when set, picks the instance of the service each call goes to, instead of BaseURL.
+	Endpoints *Balancer
 }
 
 type HttpClient interface {
@@ -24,112 +35,174 @@ type HttpClient interface {
 func (svc Service) Call(serviceRequest ServiceRequest) (serviceResponse ServiceResponse, err error) {
 	serviceResponse.RequestID = serviceRequest.RequestID
 	var resp *http.Response
-	req, err := http.NewRequest("POST", svc.BaseURL, strings.NewReader(serviceRequest.String()))
+	var respBodyCopy bytes.Buffer
+	trace := newRequestTrace(serviceRequest.RequestID)
+	logger := requestLogger(serviceRequest.RequestID, serviceRequest.Debug)
+	statusCode := 0
+	serviceURL := svc.BaseURL
+	defer func() {
+		trace.finish(statusCode, err)
+		if svc.TraceRecorder != nil {
+			svc.TraceRecorder.Record(trace.Snapshot())
+		}
+		if svc.TrafficRecorder != nil {
+			svc.TrafficRecorder.Record(upstreamTrafficRecord(trace.Snapshot(), serviceURL, serviceRequest.String(), resp, respBodyCopy.String()))
+		}
+	}()
+	var endpoint *Endpoint
+	if svc.Endpoints != nil {
+		var endpointDone func(error)
+		endpoint, endpointDone = svc.Endpoints.Pick()
+		defer func() { endpointDone(err) }()
+		serviceURL = endpoint.URL
+		trace.endpoint(endpoint.Address)
+	}
+	req, err := http.NewRequest("POST", serviceURL, strings.NewReader(serviceRequest.String()))
 	if err != nil {
-		log.WithField("requestid", serviceRequest.RequestID).Error("Error creating request to service", err)
+		logger.Error("Error creating request to service", err)
 		return
 	}
+	if endpoint != nil && endpoint.Host != "" {
+		req.Host = endpoint.Host
+	}
 	req.Header.Set("Content-type", "application/json")
-	requestTimings := make(map[string]time.Time)
-	req = req.WithContext(httptrace.WithClientTrace(req.Context(), clientTrace(serviceRequest, requestTimings)))
-	log.WithField("requestid", serviceRequest.RequestID).Debug("About to send request to service")
+	httpTrace, callDone := clientTrace(logger, trace)
+	defer callDone()
+	req = req.WithContext(withRequestTrace(httptrace.WithClientTrace(req.Context(), httpTrace), trace))
+	logger.Debug("About to send request to service")
 	resp, err = svc.HttpClient.Do(req)
 	if err != nil {
-		log.WithFields(map[string]interface{}{
-			"requestTimings":  requestTimings,
-			"requestid":  serviceRequest.RequestID,
-			"error": err,
+		logger.WithFields(map[string]interface{}{
+			"requestTimings": trace.Snapshot().Timings,
+			"error":          err,
 		}).Error("Error sending request to service")
 		return
 	}
 	defer resp.Body.Close()
+	statusCode = resp.StatusCode
+	trace.protocol(resp.Proto)
+	if svc.TrafficRecorder != nil {
+		resp.Body = teeBody{io.TeeReader(resp.Body, &respBodyCopy), resp.Body}
+	}
 	if resp.StatusCode != 200 {
 		var respBody string
 		if resp.Body != nil {
 			respErrorBody, _ := ioutil.ReadAll(resp.Body)
 			respBody = string(respErrorBody)
 		}
-		log.WithFields(map[string]interface{}{
+		logger.WithFields(map[string]interface{}{
 			"statuscode": resp.StatusCode,
 			"body":       respBody,
-			"requestid":  serviceRequest.RequestID,
 		}).Error("Service returned non-200 response")
-		return serviceResponse, errors.New("Service returned non-200 response")
+		return serviceResponse, ErrNon200Response
 	}
 	err = json.NewDecoder(resp.Body).Decode(&serviceResponse)
 	if err != nil {
-		log.WithFields(map[string]interface{}{
-			"err":       err,
-			"requestid": serviceRequest.RequestID,
+		logger.WithFields(map[string]interface{}{
+			"err": err,
 		}).Error("Error parsing response from Service.")
 	} else {
-		log.WithFields(map[string]interface{}{
-			"requestid": serviceRequest.RequestID,
-		}).Debug("Done with request")
+		logger.Debug("Done with request")
 	}
 	return
 }
 
-func clientTrace(serviceRequest ServiceRequest, requestTimings map[string]time.Time) *httptrace.ClientTrace {
+// clientTrace also returns a func to call once the call is done. HTTP/2 connections are shared by many
+// calls and never go back to an idle pool, so that's when the call stops counting as active on its connection.
+func clientTrace(logger *log.Entry, trace *RequestTrace) (*httptrace.ClientTrace, func()) {
+	var conn *TrackedConn
+	var released sync.Once
+	// The call's TCP_INFO is read here, once the whole response has arrived, so it covers the call's
+	// transfer rather than just the first packet of the response.
+	release := func() {
+		if conn != nil {
+			released.Do(func() {
+				if info, err := conn.TCPInfo(); err == nil {
+					trace.tcpInfo(nil, info)
+				}
+				conn.released()
+			})
+		}
+	}
 	return &httptrace.ClientTrace{
 		GetConn: func(hostPort string) {
-			requestTimings["getconn"] = time.Now()
-			log.WithField("requestid", serviceRequest.RequestID).Debug("About to get connection")
+			trace.Mark("getconn")
+			logger.Debug("About to get connection")
 		},
 		GotConn: func(connInfo httptrace.GotConnInfo) {
-			requestTimings["gotconn"] = time.Now()
-			log.WithFields(map[string]interface{}{
-				"requestid": serviceRequest.RequestID,
-				"reused":    connInfo.Reused,
-				"idletime":  connInfo.IdleTime,
-				"wasidle":   connInfo.WasIdle,
+			trace.gotConn(connInfo.Reused, connInfo.WasIdle)
+			if conn = trackedConn(connInfo.Conn); conn != nil {
+				conn.acquired()
+				if !connInfo.Reused {
+					trace.tcpInfo(conn.ConnectTCPInfo, nil)
+				}
+			}
+			logger.WithFields(map[string]interface{}{
+				"reused":   connInfo.Reused,
+				"idletime": connInfo.IdleTime,
+				"wasidle":  connInfo.WasIdle,
 			}).Debug("Got connection")
 		},
 		PutIdleConn: func(err error) {
-			requestTimings["putidleconn"] = time.Now()
-			log.WithFields(map[string]interface{}{
-				"requestid": serviceRequest.RequestID,
-				"err":       err,
+			trace.Mark("putidleconn")
+			if err == nil {
+				release()
+			}
+			logger.WithFields(map[string]interface{}{
+				"err": err,
 			}).Debug("Put idle connection")
 		},
 		Got100Continue: func() {
-			requestTimings["got100continue"] = time.Now()
-			log.WithField("requestid", serviceRequest.RequestID).Debug("Got 100 Continue")
+			trace.Mark("got100continue")
+			logger.Debug("Got 100 Continue")
 		},
 		ConnectStart: func(network, addr string) {
-			requestTimings["connectstart"] = time.Now()
-			log.WithField("requestid", serviceRequest.RequestID).Debug("Dial start")
+			trace.Mark("connectstart")
+			logger.Debug("Dial start")
 		},
 		DNSStart: func(info httptrace.DNSStartInfo) {
-			requestTimings["dnsstart"] = time.Now()
-			log.WithField("requestid", serviceRequest.RequestID).Debug("DNS start", info.Host)
+			trace.Mark("dnsstart")
+			logger.Debug("DNS start", info.Host)
 		},
 		DNSDone: func(info httptrace.DNSDoneInfo) {
-			requestTimings["dnsdone"] = time.Now()
-			log.WithFields(map[string]interface{}{
-				"requestid": serviceRequest.RequestID,
+			trace.Mark("dnsdone")
+			logger.WithFields(map[string]interface{}{
 				"coalesced": info.Coalesced,
 				"err":       info.Err,
 			}).Debug("DNS done")
 		},
 		ConnectDone: func(network, addr string, err error) {
-			requestTimings["connectdone"] = time.Now()
-			log.WithFields(map[string]interface{}{
-				"requestid": serviceRequest.RequestID,
-				"err":       err,
+			trace.Mark("connectdone")
+			logger.WithFields(map[string]interface{}{
+				"err": err,
 			}).Debug("Dial done")
 		},
+		TLSHandshakeStart: func() {
+			trace.Mark("tlshandshakestart")
+			logger.Debug("Starting TLS handshake")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			trace.Mark("tlshandshakedone")
+			if err == nil {
+				trace.tls(newTLSInfo(state))
+			}
+			logger.WithFields(map[string]interface{}{
+				"version": tls.VersionName(state.Version),
+				"resumed": state.DidResume,
+				"err":     err,
+			}).Debug("TLS handshake done")
+		},
 		GotFirstResponseByte: func() {
-			requestTimings["gotfirstresponsebyte"] = time.Now()
-			log.WithField("requestid", serviceRequest.RequestID).Debug("First response byte!")
+			trace.Mark("gotfirstresponsebyte")
+			logger.Debug("First response byte!")
 		},
 		WroteHeaders: func() {
-			requestTimings["wroteheaders"] = time.Now()
-			log.WithField("requestid", serviceRequest.RequestID).Debug("Wrote headers")
+			trace.Mark("wroteheaders")
+			logger.Debug("Wrote headers")
 		},
 		WroteRequest: func(wr httptrace.WroteRequestInfo) {
-			requestTimings["wroterequest"] = time.Now()
-			log.WithField("requestid", serviceRequest.RequestID).Debug("Wrote request")
+			trace.Mark("wroterequest")
+			logger.Debug("Wrote request")
 		},
-	}
+	}, release
 }
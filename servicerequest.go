@@ -6,6 +6,8 @@ import (
 
 type ServiceRequest struct {
 	RequestID string `json:"requestid,omitempty"`
+	// Debug turns on debug logs for this request whatever the log level, see requestLogger.
+	Debug bool `json:"-"`
 }
 
 func (req ServiceRequest) String() string {
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fdHeadroom is how many file descriptors to leave for everything that isn't a connection: the
+// listener, log and recording files, DNS lookups.
+const fdHeadroom = 64
+
+// fdWarnFraction is how full the file descriptor table gets before each sample logs a warning.
+const fdWarnFraction = 0.8
+
+// SocketStats is one sample of the sockets between us and the service and of our file descriptors.
+// Misconfigured pooling shows up here first: connections closed after every request pile up in
+// TIME_WAIT, each holding a local port, until there are no ephemeral ports left to dial from.
+type SocketStats struct {
+	Time time.Time `json:"time"`
+	// Upstream is the addresses the service resolved to.
+	Upstream []string `json:"upstream"`
+	// States counts our sockets to the service by TCP state, e.g. ESTABLISHED or TIME_WAIT.
+	States map[string]int `json:"states"`
+	// LocalPortsInUse is how many ephemeral ports those sockets are holding, out of EphemeralPorts.
+	LocalPortsInUse int    `json:"localPortsInUse"`
+	EphemeralPorts  int    `json:"ephemeralPorts,omitempty"`
+	OpenFDs         int    `json:"openFDs"`
+	FDLimit         int    `json:"fdLimit,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// SocketSampler samples SocketStats every Interval, keeping the latest for /internal/sockets.
+type SocketSampler struct {
+	Endpoints *Balancer
+	// Proxy, if calls go through one, is where the connections counted go instead of the service.
+	Proxy    *Proxy
+	Interval time.Duration
+
+	mu      sync.Mutex
+	latest  *SocketStats
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func NewSocketSampler(config *AppConfig, endpoints *Balancer) *SocketSampler {
+	proxy, _ := ParseProxy(config.HTTPClientProxyURL, config.HTTPClientNoProxy)
+	return &SocketSampler{
+		Endpoints: endpoints,
+		Proxy:     proxy,
+		Interval:  time.Duration(config.SocketStatsIntervalMS) * time.Millisecond,
+	}
+}
+
+// Start samples straight away and then every Interval. An Interval of 0 means only sampling when asked.
+func (s *SocketSampler) Start() {
+	s.Sample()
+	if s.Interval == 0 {
+		return
+	}
+	s.stop, s.stopped = make(chan struct{}), make(chan struct{})
+	go func(stop, stopped chan struct{}) {
+		defer close(stopped)
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Sample()
+			case <-stop:
+				return
+			}
+		}
+	}(s.stop, s.stopped)
+}
+
+// Stop stops sampling every Interval, waiting for a sample already under way. Latest goes on answering
+// with the last sample.
+func (s *SocketSampler) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.stopped
+	s.stop, s.stopped = nil, nil
+}
+
+// Latest is the most recent sample, or a new one if there isn't one yet or sampling isn't periodic.
+func (s *SocketSampler) Latest() *SocketStats {
+	s.mu.Lock()
+	latest := s.latest
+	s.mu.Unlock()
+	if latest == nil || s.Interval == 0 {
+		return s.Sample()
+	}
+	return latest
+}
+
+func (s *SocketSampler) Sample() *SocketStats {
+	stats := &SocketStats{Time: time.Now(), States: map[string]int{}}
+	upstream, err := upstreamAddrs(s.Endpoints.Endpoints(), s.Proxy)
+	if err == nil {
+		for _, addr := range upstream {
+			stats.Upstream = append(stats.Upstream, addr.String())
+		}
+		err = sampleSocketStats(stats, upstream)
+	}
+	if err != nil {
+		stats.Error = err.Error()
+	}
+	if stats.FDLimit > 0 && float64(stats.OpenFDs) > fdWarnFraction*float64(stats.FDLimit) {
+		log.WithFields(map[string]interface{}{"openFDs": stats.OpenFDs, "fdLimit": stats.FDLimit}).Warn("Running out of file descriptors")
+	}
+	if stats.EphemeralPorts > 0 && float64(stats.LocalPortsInUse) > fdWarnFraction*float64(stats.EphemeralPorts) {
+		log.WithFields(map[string]interface{}{"localPortsInUse": stats.LocalPortsInUse, "ephemeralPorts": stats.EphemeralPorts, "states": stats.States}).Warn("Running out of ephemeral ports to the service")
+	}
+	s.mu.Lock()
+	s.latest = stats
+	s.mu.Unlock()
+	return stats
+}
+
+// upstreamAddrs resolves the endpoints' hosts to the addresses our connections to them go to,
+// which are the proxy's if calls go through one. There are none for a service on a Unix socket,
+// which doesn't use up ports.
+func upstreamAddrs(endpoints []*Endpoint, proxy *Proxy) ([]*net.TCPAddr, error) {
+	var addrs []*net.TCPAddr
+	seen := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		network, address := endpoint.dialAddress(proxy)
+		if network != "tcp" || seen[address] {
+			continue
+		}
+		seen[address] = true
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := dnsResolver.Fetch(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip.String(), port))
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+func (s *SocketSampler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Latest())
+}
+
+// ResourceProblems checks the pool settings against the limits of the machine we're running on:
+// the file descriptor limit, and whether EXPECTED_CONCURRENCY fits in the idle pool.
+func (c *AppConfig) ResourceProblems() []ConfigProblem {
+	var problems []ConfigProblem
+	// Every call in flight holds a connection from its client and one to the service.
+	needed := c.HTTPClientMaxIdleConns + 2*c.ExpectedConcurrency + fdHeadroom
+	if limit, err := fdLimit(); err == nil && limit > 0 && needed > limit {
+		problems = append(problems, ConfigProblem{
+			Setting: "HTTP_CLIENT_MAX_IDLE_CONNS",
+			Message: fmt.Sprintf("%d idle connections plus %d concurrent calls need about %d file descriptors, but the limit (ulimit -n) is %d",
+				c.HTTPClientMaxIdleConns, c.ExpectedConcurrency, needed, limit),
+			Warning: true,
+		})
+	}
+	if c.ExpectedConcurrency > c.HTTPClientMaxIdleConnsPerHost && c.HTTPClientMaxIdleConnsPerHost > 0 {
+		problems = append(problems, ConfigProblem{
+			Setting: "HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST",
+			Message: fmt.Sprintf("%d is less than EXPECTED_CONCURRENCY (%d), so up to %d connections are closed after each round of calls and pile up in TIME_WAIT, using up ephemeral ports",
+				c.HTTPClientMaxIdleConnsPerHost, c.ExpectedConcurrency, c.ExpectedConcurrency-c.HTTPClientMaxIdleConnsPerHost),
+			Warning: true,
+		})
+	}
+	return problems
+}
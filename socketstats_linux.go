@@ -0,0 +1,140 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpStates are the st column of /proc/net/tcp, see include/net/tcp_states.h.
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+// sampleSocketStats fills in stats from /proc for sockets whose remote end is one of upstream.
+func sampleSocketStats(stats *SocketStats, upstream []*net.TCPAddr) error {
+	localPorts := make(map[int]bool)
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if err := readProcNetTCP(path, upstream, stats.States, localPorts); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	stats.LocalPortsInUse = len(localPorts)
+	stats.EphemeralPorts, _ = ephemeralPortCount()
+
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return err
+	}
+	stats.OpenFDs = len(fds)
+	stats.FDLimit, err = fdLimit()
+	return err
+}
+
+func readProcNetTCP(path string, upstream []*net.TCPAddr, states map[string]int, localPorts map[int]bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		remote, err := parseProcNetAddr(fields[2])
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if !matchesAny(remote, upstream) {
+			continue
+		}
+		local, err := parseProcNetAddr(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		state, ok := tcpStates[fields[3]]
+		if !ok {
+			state = fields[3]
+		}
+		states[state]++
+		localPorts[local.Port] = true
+	}
+	return scanner.Err()
+}
+
+// parseProcNetAddr parses an address like 0100007F:1F90. The IP is in hex, each 32-bit word in host
+// byte order (little-endian on everything we run on); the port is plain hex.
+func parseProcNetAddr(s string) (*net.TCPAddr, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("bad address %q", s)
+	}
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, fmt.Errorf("bad address %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for word := 0; word < len(raw); word += 4 {
+		for i := 0; i < 4; i++ {
+			ip[word+i] = raw[word+3-i]
+		}
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port in %q", s)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func matchesAny(addr *net.TCPAddr, candidates []*net.TCPAddr) bool {
+	for _, candidate := range candidates {
+		if addr.Port == candidate.Port && addr.IP.Equal(candidate.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func ephemeralPortCount() (int, error) {
+	raw, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err != nil {
+		return 0, err
+	}
+	var low, high int
+	if _, err := fmt.Sscan(string(raw), &low, &high); err != nil {
+		return 0, err
+	}
+	return high - low + 1, nil
+}
+
+// fdLimit is the soft RLIMIT_NOFILE.
+func fdLimit() (int, error) {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, err
+	}
+	return int(limit.Cur), nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func sampleSocketStats(stats *SocketStats, upstream []*net.TCPAddr) error {
+	return errors.New("socket stats come from /proc, which only Linux has")
+}
+
+func fdLimit() (int, error) {
+	return 0, errors.New("fd limit is only read on Linux")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SocketOptions are the TCP settings below what net/http exposes, for connections to the service
+// (the HTTP_CLIENT_* ones) or to us (the SERVER_* ones). Zero leaves a setting at the OS default.
+//
+// Go sets TCP_NODELAY and the keep-alive options itself once a connection is made, so those are set
+// again after connecting or accepting; the rest are set in Dialer.Control and ListenConfig.Control,
+// before connecting, where the buffer sizes have to be set to affect the TCP window.
+type SocketOptions struct {
+	NoDelay                  bool
+	SendBufferBytes          int
+	ReceiveBufferBytes       int
+	KeepAliveIntervalSeconds int
+	KeepAliveCount           int
+	UserTimeoutMS            int
+	// LingerSeconds is -1 to leave SO_LINGER off.
+	LingerSeconds int
+	// BindAddressNoPort sets IP_BIND_ADDRESS_NO_PORT, so binding to a source IP leaves picking the
+	// port until connect, when the kernel can reuse a port that's in use towards other destinations.
+	BindAddressNoPort bool
+}
+
+// defaultSocketOptions leave everything as Go and the OS would.
+var defaultSocketOptions = SocketOptions{NoDelay: true, LingerSeconds: -1}
+
+func clientSocketOptions(config *AppConfig) SocketOptions {
+	return SocketOptions{
+		NoDelay:                  config.HTTPClientTCPNoDelay,
+		SendBufferBytes:          config.HTTPClientSendBufferBytes,
+		ReceiveBufferBytes:       config.HTTPClientReceiveBufferBytes,
+		KeepAliveIntervalSeconds: config.HTTPClientTCPKeepAliveIntervalS,
+		KeepAliveCount:           config.HTTPClientTCPKeepAliveCount,
+		UserTimeoutMS:            config.HTTPClientTCPUserTimeoutMS,
+		LingerSeconds:            config.HTTPClientLingerSeconds,
+	}
+}
+
+func serverSocketOptions(config *AppConfig) SocketOptions {
+	return SocketOptions{
+		NoDelay:                  config.ServerTCPNoDelay,
+		SendBufferBytes:          config.ServerSendBufferBytes,
+		ReceiveBufferBytes:       config.ServerReceiveBufferBytes,
+		KeepAliveIntervalSeconds: config.ServerTCPKeepAliveIntervalS,
+		KeepAliveCount:           config.ServerTCPKeepAliveCount,
+		UserTimeoutMS:            config.ServerTCPUserTimeoutMS,
+		LingerSeconds:            config.ServerLingerSeconds,
+	}
+}
+
+// Control is for Dialer.Control and ListenConfig.Control.
+func (o SocketOptions) Control(network, address string, rawConn syscall.RawConn) error {
+	var err error
+	controlErr := rawConn.Control(func(fd uintptr) {
+		err = o.setBeforeConnect(int(fd))
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// Connected sets what Go would otherwise overwrite once conn is connected.
+func (o SocketOptions) Connected(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetNoDelay(o.NoDelay); err != nil {
+		return err
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	controlErr := rawConn.Control(func(fd uintptr) {
+		err = o.setAfterConnect(int(fd))
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// socketOptionsListener applies SocketOptions to every connection it accepts.
+type socketOptionsListener struct {
+	net.Listener
+	options SocketOptions
+}
+
+func (l socketOptionsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	// Failing Accept would stop the server, so a connection we couldn't tune is still served.
+	if err := l.options.Connected(conn); err != nil {
+		log.WithFields(map[string]interface{}{"remoteAddr": conn.RemoteAddr().String(), "error": err.Error()}).Warn("Couldn't set socket options")
+	}
+	return conn, nil
+}
+
+// ReadSocketOptions reads back what the kernel has for conn's socket options, by getsockopt name.
+func ReadSocketOptions(conn net.Conn) (map[string]int, error) {
+	syscallConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, nil
+	}
+	rawConn, err := syscallConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]int
+	controlErr := rawConn.Control(func(fd uintptr) {
+		values, err = readSocketOptions(int(fd))
+	})
+	if controlErr != nil {
+		return nil, controlErr
+	}
+	return values, err
+}
+
+// CheckSocketOptions makes a connection to itself over loopback with clientOptions on the dialling side
+// and serverOptions on the accepting side, and reads back what the kernel ended up with on each.
+func CheckSocketOptions(clientOptions, serverOptions SocketOptions) (client, server map[string]int, err error) {
+	listenConfig := net.ListenConfig{Control: serverOptions.Control}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := socketOptionsListener{listener, serverOptions}.Accept()
+		accepted <- conn
+	}()
+
+	dialer := net.Dialer{Timeout: time.Second, Control: clientOptions.Control}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if err := clientOptions.Connected(conn); err != nil {
+		return nil, nil, err
+	}
+	serverConn := <-accepted
+	if serverConn == nil {
+		return nil, nil, errors.New("loopback connection wasn't accepted")
+	}
+	defer serverConn.Close()
+
+	if client, err = ReadSocketOptions(conn); err != nil {
+		return nil, nil, err
+	}
+	if server, err = ReadSocketOptions(serverConn); err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
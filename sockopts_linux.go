@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const socketOptionsSupported = true
+
+func (o SocketOptions) setBeforeConnect(fd int) error {
+	if o.SendBufferBytes > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBufferBytes); err != nil {
+			return err
+		}
+	}
+	if o.BindAddressNoPort {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_BIND_ADDRESS_NO_PORT, 1); err != nil {
+			return err
+		}
+	}
+	if o.ReceiveBufferBytes > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, o.ReceiveBufferBytes); err != nil {
+			return err
+		}
+	}
+	return o.setAnyTime(fd)
+}
+
+func (o SocketOptions) setAfterConnect(fd int) error {
+	if o.KeepAliveIntervalSeconds > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, o.KeepAliveIntervalSeconds); err != nil {
+			return err
+		}
+	}
+	if o.KeepAliveCount > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, o.KeepAliveCount); err != nil {
+			return err
+		}
+	}
+	// Accepted sockets mostly inherit from the listener, but setting these again costs nothing.
+	return o.setAnyTime(fd)
+}
+
+func (o SocketOptions) setAnyTime(fd int) error {
+	if o.UserTimeoutMS > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, o.UserTimeoutMS); err != nil {
+			return err
+		}
+	}
+	if o.LingerSeconds >= 0 {
+		linger := unix.Linger{Onoff: 1, Linger: int32(o.LingerSeconds)}
+		if err := unix.SetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER, &linger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSocketOptions(fd int) (map[string]int, error) {
+	options := []struct {
+		name  string
+		level int
+		opt   int
+	}{
+		{"TCP_NODELAY", unix.IPPROTO_TCP, unix.TCP_NODELAY},
+		{"SO_SNDBUF", unix.SOL_SOCKET, unix.SO_SNDBUF},
+		{"SO_RCVBUF", unix.SOL_SOCKET, unix.SO_RCVBUF},
+		{"SO_KEEPALIVE", unix.SOL_SOCKET, unix.SO_KEEPALIVE},
+		{"TCP_KEEPIDLE", unix.IPPROTO_TCP, unix.TCP_KEEPIDLE},
+		{"TCP_KEEPINTVL", unix.IPPROTO_TCP, unix.TCP_KEEPINTVL},
+		{"TCP_KEEPCNT", unix.IPPROTO_TCP, unix.TCP_KEEPCNT},
+		{"TCP_USER_TIMEOUT", unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT},
+	}
+	values := make(map[string]int, len(options)+1)
+	for _, option := range options {
+		value, err := unix.GetsockoptInt(fd, option.level, option.opt)
+		if err != nil {
+			return nil, err
+		}
+		values[option.name] = value
+	}
+	// x/sys/unix has no GetsockoptLinger, so this one is by hand. -1 means off, like LingerSeconds.
+	var linger unix.Linger
+	size := uint32(unsafe.Sizeof(linger))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_SOCKET, unix.SO_LINGER,
+		uintptr(unsafe.Pointer(&linger)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	values["SO_LINGER"] = -1
+	if linger.Onoff != 0 {
+		values["SO_LINGER"] = int(linger.Linger)
+	}
+	return values, nil
+}
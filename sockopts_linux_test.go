@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// loopbackConns connects to itself over loopback with client options on the dialling side and server
+// options on the accepting side, the way the HTTP client and the server apply them.
+func loopbackConns(t *testing.T, client, server SocketOptions) (dialled, accepted net.Conn) {
+	listenConfig := net.ListenConfig{Control: server.Control}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	acceptedConns := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := socketOptionsListener{listener, server}.Accept()
+		acceptedConns <- conn
+	}()
+
+	dialer := net.Dialer{Timeout: time.Second, Control: client.Control}
+	dialled, err = dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dialled.Close() })
+	if err := client.Connected(dialled); err != nil {
+		t.Fatal(err)
+	}
+	if accepted = <-acceptedConns; accepted == nil {
+		t.Fatal("loopback connection wasn't accepted")
+	}
+	t.Cleanup(func() { accepted.Close() })
+	return dialled, accepted
+}
+
+func getsockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	rawConn, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	controlErr := rawConn.Control(func(fd uintptr) {
+		value, err = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if controlErr != nil {
+		t.Fatal(controlErr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestSocketOptionsApplied(t *testing.T) {
+	options := SocketOptions{
+		NoDelay:                  false,
+		SendBufferBytes:          64 * 1024,
+		ReceiveBufferBytes:       96 * 1024,
+		KeepAliveIntervalSeconds: 7,
+		KeepAliveCount:           3,
+		UserTimeoutMS:            4500,
+		LingerSeconds:            2,
+		BindAddressNoPort:        true,
+	}
+	// Linux reports back double the buffer sizes that were set, to allow for its own overhead.
+	want := map[string]int{
+		"TCP_NODELAY":      0,
+		"SO_SNDBUF":        2 * options.SendBufferBytes,
+		"SO_RCVBUF":        2 * options.ReceiveBufferBytes,
+		"TCP_KEEPINTVL":    options.KeepAliveIntervalSeconds,
+		"TCP_KEEPCNT":      options.KeepAliveCount,
+		"TCP_USER_TIMEOUT": options.UserTimeoutMS,
+		"SO_LINGER":        options.LingerSeconds,
+	}
+	serverOptions := options
+	serverOptions.BindAddressNoPort = false
+	client, server := loopbackConns(t, options, serverOptions)
+	for side, conn := range map[string]net.Conn{"client": client, "server": server} {
+		got, err := ReadSocketOptions(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range want {
+			if got[name] != value {
+				t.Errorf("%s %s = %d, want %d", side, name, got[name], value)
+			}
+		}
+	}
+	if got := getsockopt(t, client, unix.IPPROTO_IP, unix.IP_BIND_ADDRESS_NO_PORT); got != 1 {
+		t.Errorf("client IP_BIND_ADDRESS_NO_PORT = %d, want 1", got)
+	}
+}
+
+func TestDefaultSocketOptionsLeaveTheOSDefaults(t *testing.T) {
+	client, _ := loopbackConns(t, defaultSocketOptions, defaultSocketOptions)
+	got, err := ReadSocketOptions(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["TCP_NODELAY"] != 1 || got["SO_LINGER"] != -1 || got["TCP_USER_TIMEOUT"] != 0 {
+		t.Errorf("got %v, want TCP_NODELAY on, SO_LINGER off and no TCP_USER_TIMEOUT", got)
+	}
+	if value := getsockopt(t, client, unix.IPPROTO_IP, unix.IP_BIND_ADDRESS_NO_PORT); value != 0 {
+		t.Errorf("IP_BIND_ADDRESS_NO_PORT = %d, want 0", value)
+	}
+}
+
+func TestCheckSocketOptions(t *testing.T) {
+	options := defaultSocketOptions
+	options.NoDelay = false
+	options.LingerSeconds = 0
+	client, server, err := CheckSocketOptions(options, defaultSocketOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client["TCP_NODELAY"] != 0 || client["SO_LINGER"] != 0 {
+		t.Errorf("client got %v, want TCP_NODELAY off and SO_LINGER 0", client)
+	}
+	if server["TCP_NODELAY"] != 1 || server["SO_LINGER"] != -1 {
+		t.Errorf("server got %v, want TCP_NODELAY on and SO_LINGER off", server)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// Socket options are only set on Linux; elsewhere Go's and the OS's defaults are left alone.
+const socketOptionsSupported = false
+
+func (o SocketOptions) setBeforeConnect(fd int) error {
+	return nil
+}
+
+func (o SocketOptions) setAfterConnect(fd int) error {
+	return nil
+}
+
+func readSocketOptions(fd int) (map[string]int, error) {
+	return nil, nil
+}
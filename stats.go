@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Histogram counts samples into equal-width buckets from 0 to UpperMS, with anything above in Overflow.
+type Histogram struct {
+	BucketWidthMS float64
+	UpperMS       float64
+	Counts        []int
+	Overflow      int
+}
+
+func NewHistogram(samples []float64, upperMS float64, buckets int) Histogram {
+	if upperMS <= 0 {
+		upperMS = 1
+	}
+	histogram := Histogram{
+		BucketWidthMS: upperMS / float64(buckets),
+		UpperMS:       upperMS,
+		Counts:        make([]int, buckets),
+	}
+	for _, sample := range samples {
+		bucket := int(sample / histogram.BucketWidthMS)
+		if bucket >= buckets {
+			histogram.Overflow++
+			continue
+		}
+		if bucket < 0 {
+			bucket = 0
+		}
+		histogram.Counts[bucket]++
+	}
+	return histogram
+}
+
+// MaxCount is the biggest bucket, counting the overflow bucket.
+func (h Histogram) MaxCount() int {
+	max := h.Overflow
+	for _, count := range h.Counts {
+		if count > max {
+			max = count
+		}
+	}
+	return max
+}
+
+// MannWhitneyResult says whether two sets of latencies are likely to come from the same distribution.
+type MannWhitneyResult struct {
+	U float64 `json:"u"`
+	Z float64 `json:"z"`
+	P float64 `json:"p"`
+	// ProbabilityGreater is the chance a random sample from b is slower than one from a (0.5 means no difference).
+	ProbabilityGreater float64 `json:"probabilityGreater"`
+}
+
+// MannWhitneyU runs a two-sided Mann-Whitney U test on a and b using the normal approximation,
+// corrected for ties. It makes no assumption about the shape of the distributions, which matters
+// for latencies since they're never normal.
+func MannWhitneyU(a, b []float64) MannWhitneyResult {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return MannWhitneyResult{P: 1, ProbabilityGreater: 0.5}
+	}
+	type sample struct {
+		value float64
+		fromA bool
+	}
+	combined := make([]sample, 0, len(a)+len(b))
+	for _, value := range a {
+		combined = append(combined, sample{value, true})
+	}
+	for _, value := range b {
+		combined = append(combined, sample{value, false})
+	}
+	sort.Slice(combined, func(i, j int) bool { return combined[i].value < combined[j].value })
+
+	rankSumA := 0.0
+	tieCorrection := 0.0
+	for i := 0; i < len(combined); {
+		j := i
+		for j < len(combined) && combined[j].value == combined[i].value {
+			j++
+		}
+		// Tied values share the average of the ranks they span.
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if combined[k].fromA {
+				rankSumA += rank
+			}
+		}
+		ties := float64(j - i)
+		tieCorrection += ties*ties*ties - ties
+		i = j
+	}
+
+	n := n1 + n2
+	uA := rankSumA - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - tieCorrection/(n*(n-1)))
+	result := MannWhitneyResult{U: uA, P: 1, ProbabilityGreater: 1 - uA/(n1*n2)}
+	if variance <= 0 {
+		return result
+	}
+	diff := uA - mean
+	// continuity correction
+	if diff > 0 {
+		diff -= 0.5
+	} else if diff < 0 {
+		diff += 0.5
+	}
+	result.Z = diff / math.Sqrt(variance)
+	result.P = math.Erfc(math.Abs(result.Z) / math.Sqrt2)
+	return result
+}
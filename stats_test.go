@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMannWhitneyU(t *testing.T) {
+	shiftedA := make([]float64, 200)
+	shiftedB := make([]float64, 200)
+	for i := range shiftedA {
+		shiftedA[i] = 10 + float64(i%20)*0.1
+		shiftedB[i] = 15 + float64(i%20)*0.1
+	}
+	tests := []struct {
+		name        string
+		a, b        []float64
+		wantU       float64
+		wantP       float64
+		pTolerance  float64
+		wantGreater float64
+	}{
+		// Worked by hand, and matching scipy.stats.mannwhitneyu(method="asymptotic"):
+		// U=0, mean 4.5, variance 5.25, z=(0-4.5+0.5)/sqrt(5.25).
+		{"known answer", []float64{1, 2, 3}, []float64{4, 5, 6}, 0, 0.0809, 0.0005, 1},
+		{"identical samples", []float64{3, 1, 4, 1, 5, 9, 2, 6}, []float64{3, 1, 4, 1, 5, 9, 2, 6}, 32, 1, 1e-9, 0.5},
+		{"clearly shifted", shiftedA, shiftedB, 0, 0, 1e-6, 1},
+		{"shifted the other way", shiftedB, shiftedA, 200 * 200, 0, 1e-6, 0},
+		{"all values tied", []float64{7, 7, 7}, []float64{7, 7, 7, 7}, 6, 1, 0, 0.5},
+		{"empty sample", nil, []float64{1, 2}, 0, 1, 0, 0.5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := MannWhitneyU(test.a, test.b)
+			if math.IsNaN(result.Z) || math.IsNaN(result.P) {
+				t.Fatalf("got NaN: %+v", result)
+			}
+			if result.U != test.wantU {
+				t.Errorf("U = %g, want %g", result.U, test.wantU)
+			}
+			if math.Abs(result.P-test.wantP) > test.pTolerance {
+				t.Errorf("P = %g, want %g ± %g", result.P, test.wantP, test.pTolerance)
+			}
+			if math.Abs(result.ProbabilityGreater-test.wantGreater) > 1e-9 {
+				t.Errorf("ProbabilityGreater = %g, want %g", result.ProbabilityGreater, test.wantGreater)
+			}
+		})
+	}
+}
+
+func TestMannWhitneyUTiedVarianceIsZero(t *testing.T) {
+	result := MannWhitneyU([]float64{2, 2}, []float64{2, 2, 2})
+	if result.Z != 0 || result.P != 1 {
+		t.Errorf("all tied: Z = %g, P = %g, want 0 and 1 since there's no variance to test against", result.Z, result.P)
+	}
+}
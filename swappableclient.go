@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// SwappableHTTPClient is an HttpClient whose underlying http.Client can be replaced while calls are in flight.
+// Calls already using the old client finish on it; once the last one has closed its response body,
+// the old transport's idle connections are closed so they don't linger.
+type SwappableHTTPClient struct {
+	current atomic.Value // *clientGeneration
+}
+
+// clientGeneration is one http.Client and the calls currently using it.
+type clientGeneration struct {
+	client   *http.Client
+	mu       sync.Mutex
+	inFlight int
+	retired  bool
+	drained  chan struct{}
+}
+
+func NewSwappableHTTPClient(client *http.Client) *SwappableHTTPClient {
+	s := &SwappableHTTPClient{}
+	s.current.Store(newClientGeneration(client))
+	return s
+}
+
+func newClientGeneration(client *http.Client) *clientGeneration {
+	return &clientGeneration{client: client, drained: make(chan struct{})}
+}
+
+// Client is the http.Client new calls go through.
+func (s *SwappableHTTPClient) Client() *http.Client {
+	return s.current.Load().(*clientGeneration).client
+}
+
+func (s *SwappableHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	generation := s.acquire()
+	resp, err := generation.client.Do(req)
+	if err != nil {
+		generation.release()
+		return resp, err
+	}
+	resp.Body = &generationBody{ReadCloser: resp.Body, generation: generation}
+	return resp, nil
+}
+
+// acquire gets the current generation, retrying if it was retired between loading it and counting the call.
+func (s *SwappableHTTPClient) acquire() *clientGeneration {
+	for {
+		generation := s.current.Load().(*clientGeneration)
+		generation.mu.Lock()
+		if !generation.retired {
+			generation.inFlight++
+			generation.mu.Unlock()
+			return generation
+		}
+		generation.mu.Unlock()
+	}
+}
+
+// Swap makes new calls use client and returns a channel that's closed once every call still using
+// the previous client is done and its idle connections have been closed.
+func (s *SwappableHTTPClient) Swap(client *http.Client) <-chan struct{} {
+	old := s.current.Load().(*clientGeneration)
+	s.current.Store(newClientGeneration(client))
+	old.mu.Lock()
+	old.retired = true
+	if old.inFlight == 0 {
+		close(old.drained)
+	}
+	old.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		<-old.drained
+		old.client.CloseIdleConnections()
+		close(done)
+	}()
+	return done
+}
+
+// InFlight is how many calls are using the current client right now.
+func (s *SwappableHTTPClient) InFlight() int {
+	generation := s.current.Load().(*clientGeneration)
+	generation.mu.Lock()
+	defer generation.mu.Unlock()
+	return generation.inFlight
+}
+
+func (g *clientGeneration) release() {
+	g.mu.Lock()
+	g.inFlight--
+	if g.retired && g.inFlight == 0 {
+		close(g.drained)
+	}
+	g.mu.Unlock()
+}
+
+// generationBody counts a call as in flight until its response body is closed,
+// since the connection is still busy until then.
+type generationBody struct {
+	io.ReadCloser
+	generation *clientGeneration
+	once       sync.Once
+}
+
+func (b *generationBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.generation.release)
+	return err
+}
@@ -0,0 +1,17 @@
+package main
+
+import "errors"
+
+// TCPInfo is what the kernel knows about a TCP connection, from getsockopt TCP_INFO. It tells network
+// trouble (a high or jumpy RTT, retransmits, a collapsed congestion window) apart from a slow upstream.
+type TCPInfo struct {
+	RTTMicros          uint32 `json:"rttMicros"`
+	RTTVarMicros       uint32 `json:"rttVarMicros"`
+	Retransmits        uint32 `json:"retransmits"`
+	Lost               uint32 `json:"lost"`
+	CongestionWindow   uint32 `json:"cwnd"`
+	SlowStartThreshold uint32 `json:"ssthresh"`
+}
+
+// errTCPInfoUnsupported is what readTCPInfo returns on platforms without TCP_INFO.
+var errTCPInfoUnsupported = errors.New("TCP_INFO is only available on Linux")
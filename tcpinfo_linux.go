@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// readTCPInfo asks the kernel for conn's TCP_INFO.
+func readTCPInfo(conn net.Conn) (*TCPInfo, error) {
+	syscallConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	rawConn, err := syscallConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var info *unix.TCPInfo
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		info, sockoptErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockoptErr != nil {
+		return nil, sockoptErr
+	}
+	return &TCPInfo{
+		RTTMicros:          info.Rtt,
+		RTTVarMicros:       info.Rttvar,
+		Retransmits:        info.Total_retrans,
+		Lost:               info.Lost,
+		CongestionWindow:   info.Snd_cwnd,
+		SlowStartThreshold: info.Snd_ssthresh,
+	}, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestCallRecordsTCPInfo(t *testing.T) {
+	endpoints, err := LoadFakeEndpoints("fakes/fake-service.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := NewFakeUpstream(endpoints, nil)
+	if err := upstream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	recorder := &tracesRecorded{}
+	service := Service{
+		BaseURL:       upstream.URL + "/service",
+		HttpClient:    NewHTTPClient(testConfig(t, nil), NewConnRegistry()),
+		TraceRecorder: recorder,
+	}
+	// The second call reuses the connection, so only the first has TCP_INFO from connecting.
+	for i := 0; i < 2; i++ {
+		if _, err := service.Call(ServiceRequest{RequestID: "tcpinfo"}); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	if len(recorder.traces) != 2 {
+		t.Fatalf("recorded %d traces, want 2", len(recorder.traces))
+	}
+	for i, trace := range recorder.traces {
+		if trace.TCPInfo == nil {
+			t.Errorf("call %d: no TCP_INFO from the end of the call", i)
+		}
+		if (trace.ConnectTCPInfo != nil) != (i == 0) {
+			t.Errorf("call %d: ConnectTCPInfo is %v", i, trace.ConnectTCPInfo)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "net"
+
+func readTCPInfo(conn net.Conn) (*TCPInfo, error) {
+	return nil, errTCPInfoUnsupported
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// tlsVersions are the HTTP_CLIENT_TLS_MIN_VERSION values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSInfo is what a TLS handshake with the service settled on.
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipherSuite"`
+	Resumed     bool   `json:"resumed"`
+	ALPN        string `json:"alpn,omitempty"`
+	ServerName  string `json:"serverName,omitempty"`
+}
+
+func newTLSInfo(state tls.ConnectionState) *TLSInfo {
+	return &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		Resumed:     state.DidResume,
+		ALPN:        state.NegotiatedProtocol,
+		ServerName:  state.ServerName,
+	}
+}
+
+// NewClientTLSConfig builds the TLS config for calling an https service from the HTTP_CLIENT_TLS_* settings.
+// It returns nil when none are set, leaving Go's defaults.
+func NewClientTLSConfig(config *AppConfig) (*tls.Config, error) {
+	if config.HTTPClientTLSCAFile == "" && config.HTTPClientTLSCertFile == "" && config.HTTPClientTLSKeyFile == "" &&
+		config.HTTPClientTLSServerName == "" && config.HTTPClientTLSMinVersion == "" && len(config.HTTPClientTLSCipherSuites) == 0 &&
+		config.HTTPClientTLSSessionCacheSize == 0 {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{ServerName: config.HTTPClientTLSServerName}
+	// Without a session cache every new connection does a full handshake, even to a server it's just talked to.
+	if config.HTTPClientTLSSessionCacheSize > 0 {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(config.HTTPClientTLSSessionCacheSize)
+	}
+	if config.HTTPClientTLSCAFile != "" {
+		pem, err := ioutil.ReadFile(config.HTTPClientTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in %s", config.HTTPClientTLSCAFile)
+		}
+	}
+	if config.HTTPClientTLSCertFile != "" || config.HTTPClientTLSKeyFile != "" {
+		if config.HTTPClientTLSCertFile == "" || config.HTTPClientTLSKeyFile == "" {
+			return nil, errors.New("a client certificate needs both HTTP_CLIENT_TLS_CERT_FILE and HTTP_CLIENT_TLS_KEY_FILE")
+		}
+		cert, err := tls.LoadX509KeyPair(config.HTTPClientTLSCertFile, config.HTTPClientTLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.HTTPClientTLSMinVersion != "" {
+		version, ok := tlsVersions[config.HTTPClientTLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("TLS version %q is not one of 1.0, 1.1, 1.2 or 1.3", config.HTTPClientTLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	for _, name := range config.HTTPClientTLSCipherSuites {
+		id, err := cipherSuiteID(name)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	return tlsConfig, nil
+}
+
+// cipherSuiteID looks a cipher suite up by its name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+func cipherSuiteID(name string) (uint16, error) {
+	var known []string
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+		known = append(known, suite.Name)
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+	sort.Strings(known)
+	return 0, fmt.Errorf("unknown cipher suite %q, use one of %s", name, strings.Join(known, ", "))
+}
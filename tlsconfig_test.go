@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testCerts generates a CA with a server certificate for hosts and a client certificate, in a directory
+// removed after the test.
+func testCerts(t *testing.T, hosts ...string) string {
+	dir := t.TempDir()
+	if err := GenerateCerts(dir, hosts); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// startTLSServer serves https with the server certificate from certs. With clientCAs set it requires a
+// client certificate signed by the CA there.
+func startTLSServer(t *testing.T, certs, clientCAs string, maxVersion uint16) string {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certs, "server.pem"), filepath.Join(certs, "server-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: maxVersion}
+	if clientCAs != "" {
+		pem, err := ioutil.ReadFile(filepath.Join(clientCAs, "ca.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		tlsConfig.ClientCAs.AppendCertsFromPEM(pem)
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }),
+		TLSConfig: tlsConfig,
+		// The failure cases would each log the handshake error.
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+func TestClientTLS(t *testing.T) {
+	certs := testCerts(t, "127.0.0.1")
+	otherCerts := testCerts(t, "127.0.0.1")
+	namedCerts := testCerts(t, "service.internal")
+
+	tests := []struct {
+		name string
+		// server is the directory of the server's certificate, clientCAs that of the CA it wants client certificates from.
+		server, clientCAs string
+		maxVersion        uint16
+		settings          map[string]string
+		wantErr           string
+	}{
+		{"verified with the CA file", certs, "", 0,
+			map[string]string{"HTTP_CLIENT_TLS_CA_FILE": filepath.Join(certs, "ca.pem")}, ""},
+		{"not verified without the CA file", certs, "", 0,
+			map[string]string{"HTTP_CLIENT_TLS_MIN_VERSION": "1.2"}, "certificate signed by unknown authority"},
+		{"pinned to a CA that didn't sign the server's certificate", otherCerts, "", 0,
+			map[string]string{"HTTP_CLIENT_TLS_CA_FILE": filepath.Join(certs, "ca.pem")}, "certificate signed by unknown authority"},
+		{"certificate for another name", namedCerts, "", 0,
+			map[string]string{"HTTP_CLIENT_TLS_CA_FILE": filepath.Join(namedCerts, "ca.pem")}, "doesn't contain any IP SANs"},
+		{"server name override", namedCerts, "", 0, map[string]string{
+			"HTTP_CLIENT_TLS_CA_FILE":     filepath.Join(namedCerts, "ca.pem"),
+			"HTTP_CLIENT_TLS_SERVER_NAME": "service.internal",
+		}, ""},
+		{"mutual TLS", certs, certs, 0, map[string]string{
+			"HTTP_CLIENT_TLS_CA_FILE":   filepath.Join(certs, "ca.pem"),
+			"HTTP_CLIENT_TLS_CERT_FILE": filepath.Join(certs, "client.pem"),
+			"HTTP_CLIENT_TLS_KEY_FILE":  filepath.Join(certs, "client-key.pem"),
+		}, ""},
+		{"mutual TLS without a client certificate", certs, certs, 0,
+			map[string]string{"HTTP_CLIENT_TLS_CA_FILE": filepath.Join(certs, "ca.pem")}, "certificate required"},
+		{"mutual TLS with a client certificate from another CA", certs, certs, 0, map[string]string{
+			"HTTP_CLIENT_TLS_CA_FILE":   filepath.Join(certs, "ca.pem"),
+			"HTTP_CLIENT_TLS_CERT_FILE": filepath.Join(otherCerts, "client.pem"),
+			"HTTP_CLIENT_TLS_KEY_FILE":  filepath.Join(otherCerts, "client-key.pem"),
+		}, "unknown certificate authority"},
+		{"minimum version the server doesn't reach", certs, "", tls.VersionTLS12, map[string]string{
+			"HTTP_CLIENT_TLS_CA_FILE":     filepath.Join(certs, "ca.pem"),
+			"HTTP_CLIENT_TLS_MIN_VERSION": "1.3",
+		}, "protocol version"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			url := startTLSServer(t, test.server, test.clientCAs, test.maxVersion)
+			settings := map[string]string{"SERVICE_BASE_URL": url}
+			for name, value := range test.settings {
+				settings[name] = value
+			}
+			config := testConfig(t, settings)
+			if problems := config.Validate(); len(problems) > 0 {
+				t.Fatalf("config problems: %v", problems)
+			}
+			client := NewHTTPClient(config, nil)
+			defer client.CloseIdleConnections()
+			resp, err := client.Get(url)
+			if err == nil {
+				resp.Body.Close()
+			}
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("got %v, want it to succeed", err)
+			case test.wantErr != "" && err == nil:
+				t.Errorf("succeeded, want an error with %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Errorf("got %v, want an error with %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientTLSConfigErrors(t *testing.T) {
+	certs := testCerts(t, "127.0.0.1")
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		settings map[string]string
+		wantErr  string
+	}{
+		{"missing CA file", map[string]string{"HTTP_CLIENT_TLS_CA_FILE": filepath.Join(certs, "nope.pem")}, "no such file"},
+		{"CA file without certificates", map[string]string{"HTTP_CLIENT_TLS_CA_FILE": notPEM}, "no PEM certificates"},
+		{"certificate without a key", map[string]string{"HTTP_CLIENT_TLS_CERT_FILE": filepath.Join(certs, "client.pem")}, "needs both"},
+		{"key that doesn't match the certificate", map[string]string{
+			"HTTP_CLIENT_TLS_CERT_FILE": filepath.Join(certs, "client.pem"),
+			"HTTP_CLIENT_TLS_KEY_FILE":  filepath.Join(certs, "server-key.pem"),
+		}, "private key does not match"},
+		{"unknown version", map[string]string{"HTTP_CLIENT_TLS_MIN_VERSION": "1.4"}, "is not one of"},
+		{"insecure cipher suite", map[string]string{"HTTP_CLIENT_TLS_CIPHER_SUITES": "TLS_RSA_WITH_RC4_128_SHA"}, "insecure"},
+		{"unknown cipher suite", map[string]string{"HTTP_CLIENT_TLS_CIPHER_SUITES": "TLS_MADE_UP"}, "unknown cipher suite"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := map[string]string{"SERVICE_BASE_URL": "https://127.0.0.1:9443/service"}
+			for name, value := range test.settings {
+				settings[name] = value
+			}
+			_, err := NewClientTLSConfig(testConfig(t, settings))
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got %v, want an error with %q", err, test.wantErr)
+			}
+		})
+	}
+}
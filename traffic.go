@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// InboundRecord is a request to our /api and what we answered.
+	InboundRecord = "inbound"
+	// UpstreamRecord is a request we sent to the service and what it answered.
+	UpstreamRecord = "upstream"
+)
+
+// TrafficRecord is one line of a traffic recording.
+type TrafficRecord struct {
+	Type            string               `json:"type"`
+	RequestID       string               `json:"requestid"`
+	Time            time.Time            `json:"time"`
+	DurationMS      float64              `json:"durationMS"`
+	Method          string               `json:"method"`
+	URL             string               `json:"url"`
+	RequestHeaders  http.Header          `json:"requestHeaders,omitempty"`
+	RequestBody     string               `json:"requestBody,omitempty"`
+	StatusCode      int                  `json:"statusCode,omitempty"`
+	ResponseHeaders http.Header          `json:"responseHeaders,omitempty"`
+	ResponseBody    string               `json:"responseBody,omitempty"`
+	Timings         map[string]time.Time `json:"timings,omitempty"`
+	Protocol        string               `json:"protocol,omitempty"`
+	TLS             *TLSInfo             `json:"tls,omitempty"`
+	Outcome         string               `json:"outcome"`
+	Error           string               `json:"error,omitempty"`
+	ConnectTCPInfo  *TCPInfo             `json:"connectTCPInfo,omitempty"`
+	TCPInfo         *TCPInfo             `json:"tcpInfo,omitempty"`
+}
+
+// TrafficRecorder appends TrafficRecords to a JSONL file, one JSON object per line.
+type TrafficRecorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func NewTrafficRecorder(path string) (*TrafficRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &TrafficRecorder{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Record writes the record straight away, so a recording is usable even if the app is killed.
+func (r *TrafficRecorder) Record(record TrafficRecord) {
+	r.mu.Lock()
+	err := r.encoder.Encode(record)
+	r.mu.Unlock()
+	if err != nil {
+		log.WithFields(map[string]interface{}{
+			"requestid": record.RequestID,
+			"error":     err,
+		}).Error("Error writing traffic record")
+	}
+}
+
+func (r *TrafficRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// outcome is "ok" for a successful exchange, otherwise the class of error.
+func outcome(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return classifyError(err)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// ReadTrafficRecords reads every record of the given type from a recording, or all of them if recordType is empty.
+func ReadTrafficRecords(path string, recordType string) ([]TrafficRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []TrafficRecord
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		var record TrafficRecord
+		if err := decoder.Decode(&record); err != nil {
+			return records, err
+		}
+		if recordType == "" || record.Type == recordType {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// teeBody lets Service.Call keep a copy of a response body while decoding it.
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+func upstreamTrafficRecord(trace *RequestTrace, url string, requestBody string, resp *http.Response, responseBody string) TrafficRecord {
+	record := TrafficRecord{
+		Type:           UpstreamRecord,
+		RequestID:      trace.RequestID,
+		Time:           trace.Start,
+		DurationMS:     durationMS(trace.Duration()),
+		Method:         "POST",
+		URL:            url,
+		RequestHeaders: http.Header{"Content-Type": {"application/json"}},
+		RequestBody:    requestBody,
+		StatusCode:     trace.StatusCode,
+		ResponseBody:   responseBody,
+		Timings:        trace.Timings,
+		Protocol:       trace.Protocol,
+		TLS:            trace.TLS,
+		Outcome:        outcome(trace.Err),
+		Error:          errorString(trace.Err),
+		ConnectTCPInfo: trace.ConnectTCPInfo,
+		TCPInfo:        trace.TCPInfo,
+	}
+	if resp != nil {
+		record.ResponseHeaders = resp.Header
+	}
+	return record
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// unixScheme is the SERVICE_BASE_URL scheme for a service listening on a Unix domain socket, as in
+// unix:///var/run/service.sock, for sidecars on the same host. The socket takes the whole URL path,
+// so the HTTP path to call goes in SERVICE_PATH.
+const unixScheme = "unix"
+
+// unixSocketHost is the Host calls over a Unix socket are sent with. Nothing resolves it, the dialer
+// connects to the socket whatever the host.
+const unixSocketHost = "localhost"
+
+// unixSocketPath is the socket path in a unix:// SERVICE_BASE_URL, or "" for any other URL.
+func unixSocketPath(serviceBaseURL string) string {
+	serviceURL, err := url.Parse(serviceBaseURL)
+	if err != nil || serviceURL.Scheme != unixScheme {
+		return ""
+	}
+	return serviceURL.Path
+}
+
+// serviceRequestURL is the URL to send calls to: SERVICE_BASE_URL itself, or over a Unix socket,
+// an http URL with SERVICE_PATH as the path.
+func serviceRequestURL(config *AppConfig) string {
+	if unixSocketPath(config.ServiceBaseURL) == "" {
+		return config.ServiceBaseURL
+	}
+	return "http://" + unixSocketHost + "/" + strings.TrimPrefix(config.ServicePath, "/")
+}
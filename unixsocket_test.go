@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCallOverUnixSocketWithSocketOptions(t *testing.T) {
+	endpoints, err := LoadFakeEndpoints("fakes/fake-service.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := NewFakeUpstream(endpoints, nil)
+	upstream.SocketPath = filepath.Join(t.TempDir(), "service.sock")
+	if err := upstream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	// TCP options like these can't be set on a Unix socket, so dialling it has to leave them out.
+	config := testConfig(t, map[string]string{
+		"SERVICE_BASE_URL":                           upstream.URL,
+		"SERVICE_PATH":                               "/service",
+		"HTTP_CLIENT_TCP_USER_TIMEOUT_MS":            "5000",
+		"HTTP_CLIENT_TCP_KEEPALIVE_INTERVAL_SECONDS": "5",
+		"HTTP_CLIENT_SEND_BUFFER_BYTES":              "65536",
+	})
+	var warned bool
+	for _, problem := range config.Validate() {
+		if !problem.Warning {
+			t.Errorf("unexpected problem: %s", problem)
+		}
+		warned = warned || problem.Setting == "HTTP_CLIENT_*"
+	}
+	if !warned {
+		t.Error("no warning that the socket options do nothing")
+	}
+
+	conns := NewConnRegistry()
+	service := Service{BaseURL: serviceRequestURL(config), HttpClient: NewHTTPClient(config, conns)}
+	if _, err := service.Call(ServiceRequest{RequestID: "unix"}); err != nil {
+		t.Fatalf("call over the Unix socket: %v", err)
+	}
+	if infos := conns.Conns(); len(infos) != 1 || infos[0].Address != upstream.SocketPath {
+		t.Errorf("connections are %+v, want one to %s", infos, upstream.SocketPath)
+	}
+}
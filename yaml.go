@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// decodeYAML parses data and stores the result in the value pointed to by v. The types files are
+// decoded into only have json tags, so the YAML goes through JSON to use them.
+func decodeYAML(data []byte, v interface{}) error {
+	var parsed interface{}
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	asJSON, err := json.Marshal(jsonCompatible(parsed))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(asJSON, v)
+}
+
+// jsonCompatible turns the map[interface{}]interface{} yaml.v2 decodes maps into, which encoding/json
+// can't encode, into map[string]interface{}.
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonCompatible(item)
+		}
+	}
+	return value
+}
+
+// decodeFile reads a JSON or YAML file, going by its extension, into v.
+func decodeFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return decodeFileData(path, data, v)
+}
+
+// decodeFileData decodes data, already read from path, the way decodeFile would.
+func decodeFileData(path string, data []byte, v interface{}) error {
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		err = decodeYAML(data, v)
+	default:
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}